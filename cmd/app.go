@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/go-oauth2/oauth2/v4/store"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/laonix/oauth2/internal/config"
+	"github.com/laonix/oauth2/internal/metrics"
+	"github.com/laonix/oauth2/internal/service/auth"
+	"github.com/laonix/oauth2/internal/tracing"
+)
+
+// app is the wiring of the stores, the manager and the grants, shared by the commands.
+type app struct {
+	tokenRepo     oauth2.TokenStore
+	clients       *auth.ClientRegistry
+	manager       *auth.Manager
+	refresh       *auth.RefreshGrant
+	device        *auth.DeviceGrant
+	jwtBearer     *auth.JWTBearerGrant
+	tokenExchange *auth.TokenExchangeGrant
+}
+
+// newApp creates the stores, the manager and the grants of the config.
+func newApp(cfg *config.Config) (*app, error) {
+	// token store
+	memoryTokenRepo, err := store.NewMemoryTokenStore()
+	if err != nil {
+		return nil, errors.Wrap(errors.WithStack(err), "failed to create token store")
+	}
+
+	tokenRepo, err := metrics.InstrumentTokenStore(tracing.InstrumentTokenStore(memoryTokenRepo), prometheus.DefaultRegisterer)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to instrument token store")
+	}
+
+	// client store
+	clients, err := auth.NewClientRegistry(cfg.Clients)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create client store")
+	}
+
+	manager := auth.NewManager(cfg, tokenRepo, tracing.InstrumentClientStore(clients))
+
+	jwtBearer, err := auth.NewJWTBearerGrant(cfg.Grants.JWTBearer, manager)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create jwt bearer grant")
+	}
+
+	tokenExchange, err := auth.NewTokenExchangeGrant(cfg.Grants.TokenExchange, manager)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create token exchange grant")
+	}
+
+	return &app{
+		tokenRepo:     tokenRepo,
+		clients:       clients,
+		manager:       manager,
+		refresh:       auth.NewRefreshGrant(cfg.JWT, manager),
+		device:        auth.NewDeviceGrant(cfg.Grants.DeviceCode, manager),
+		jwtBearer:     jwtBearer,
+		tokenExchange: tokenExchange,
+	}, nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+
+	"github.com/laonix/oauth2/internal/config"
+)
+
+// clientSecretSize is the size of the generated client secrets, before encoding.
+const clientSecretSize = 32
+
+// clientsFile is the content of the clients file, see config.Config.ClientsFile.
+//
+// The clients are kept as maps, so that their keys are written back as they were read.
+type clientsFile struct {
+	Clients []map[string]interface{} `yaml:"clients"`
+}
+
+// clientsAdd adds a client with a generated secret to the clients file and prints the secret.
+func clientsAdd(args []string) error {
+	fs := flag.NewFlagSet("clients add", flag.ExitOnError)
+	configFiles := configFlag(fs)
+	id := fs.String("id", "", "client id")
+	public := fs.Bool("public", false, "public client, without secret")
+	refreshTokens := fs.Bool("refresh-tokens", false, "issue refresh tokens to the client")
+	audience := fs.String("audience", "", "aud of the tokens issued to the client, its id if empty")
+	var redirectURIs stringsFlag
+	fs.Var(&redirectURIs, "redirect-uri", "redirect URI of the client, repeated for several")
+	_ = fs.Parse(args)
+
+	if *id == "" {
+		return errors.New("--id is required")
+	}
+
+	cfg, err := loadConfig(*configFiles)
+	if err != nil {
+		return err
+	}
+
+	for _, cli := range cfg.Clients {
+		if cli.ID == *id {
+			return errors.Errorf("client %q already exists", *id)
+		}
+	}
+
+	file, err := readClientsFile(cfg)
+	if err != nil {
+		return err
+	}
+
+	client := map[string]interface{}{
+		"id":             *id,
+		"public":         *public,
+		"refresh_tokens": *refreshTokens,
+		"redirect_uris":  []string(redirectURIs),
+	}
+
+	if *audience != "" {
+		client["audience"] = *audience
+	}
+
+	var secret string
+	if !*public {
+		if secret, err = generateClientSecret(); err != nil {
+			return err
+		}
+		client["secret"] = secret
+	}
+
+	file.Clients = append(file.Clients, client)
+
+	if err := writeClientsFile(cfg, *configFiles, file); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "added client %q to %s\n", *id, cfg.ClientsFile)
+	if secret != "" {
+		fmt.Fprintln(os.Stderr, "its secret is printed once, store it now")
+		fmt.Println(secret)
+	}
+
+	return nil
+}
+
+// clientsList prints the clients of the config and of the clients file, with the fingerprint of their secret,
+// keyed by the signing key, see config.Config.Redacted.
+func clientsList(args []string) error {
+	fs := flag.NewFlagSet("clients list", flag.ExitOnError)
+	configFiles := configFlag(fs)
+	_ = fs.Parse(args)
+
+	cfg, err := loadConfig(*configFiles)
+	if err != nil {
+		return err
+	}
+
+	// the clients of the clients file are appended to the ones of the config
+	fromFile := 0
+	if cfg.ClientsFile != "" {
+		file, err := readClientsFile(cfg)
+		if err != nil {
+			return err
+		}
+		fromFile = len(file.Clients)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTYPE\tREFRESH\tREDIRECT URIS\tSECRET\tSOURCE")
+
+	redacted := cfg.Redacted()
+
+	for i, cli := range cfg.Clients {
+		kind, secret := "confidential", redacted.Clients[i].Secret
+		if cli.Public {
+			kind, secret = "public", "-"
+		}
+
+		source := "config"
+		if i >= len(cfg.Clients)-fromFile {
+			source = cfg.ClientsFile
+		}
+
+		redirectURIs := strings.Join(cli.RedirectURIs, ",")
+		if redirectURIs == "" {
+			redirectURIs = "-"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%t\t%s\t%s\t%s\n", cli.ID, kind, cli.RefreshTokens, redirectURIs, secret, source)
+	}
+
+	return tw.Flush()
+}
+
+// clientsRotateSecret replaces the secret of a client of the clients file by a generated one and prints it.
+//
+// The running servers pick it up on their next reload.
+func clientsRotateSecret(args []string) error {
+	fs := flag.NewFlagSet("clients rotate-secret", flag.ExitOnError)
+	configFiles := configFlag(fs)
+	id := fs.String("id", "", "client id")
+	_ = fs.Parse(args)
+
+	if *id == "" {
+		return errors.New("--id is required")
+	}
+
+	cfg, err := loadConfig(*configFiles)
+	if err != nil {
+		return err
+	}
+
+	file, err := readClientsFile(cfg)
+	if err != nil {
+		return err
+	}
+
+	var client map[string]interface{}
+	for _, cli := range file.Clients {
+		if cli["id"] == *id {
+			client = cli
+		}
+	}
+
+	if client == nil {
+		return errors.Errorf("client %q isn't in the clients file %s", *id, cfg.ClientsFile)
+	}
+
+	if public, _ := client["public"].(bool); public {
+		return errors.Errorf("client %q is public, it has no secret", *id)
+	}
+
+	if _, ok := client["secret_file"]; ok {
+		return errors.Errorf("client %q reads its secret from its secret_file, replace the secret there", *id)
+	}
+
+	if _, ok := client["secret_ref"]; ok {
+		return errors.Errorf("client %q references its secret with its secret_ref, replace the secret there", *id)
+	}
+
+	secret, err := generateClientSecret()
+	if err != nil {
+		return err
+	}
+	client["secret"] = secret
+
+	if err := writeClientsFile(cfg, *configFiles, file); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "rotated the secret of client %q, the servers use it from their next reload\n", *id)
+	fmt.Fprintln(os.Stderr, "its secret is printed once, store it now")
+	fmt.Println(secret)
+
+	return nil
+}
+
+// readClientsFile reads the clients file of the config.
+func readClientsFile(cfg *config.Config) (*clientsFile, error) {
+	if cfg.ClientsFile == "" {
+		return nil, errors.New("the clients commands manage the clients file, set clients_file")
+	}
+
+	data, err := os.ReadFile(cfg.ClientsFile)
+	if err != nil {
+		return nil, errors.Wrap(errors.WithStack(err), "failed to read clients file")
+	}
+
+	var file clientsFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, errors.Wrapf(errors.WithStack(err), "failed to decode clients file %s", cfg.ClientsFile)
+	}
+
+	return &file, nil
+}
+
+// writeClientsFile replaces the clients file of the config and checks that the config is still valid,
+// restoring the previous clients file otherwise.
+func writeClientsFile(cfg *config.Config, configFiles []string, file *clientsFile) error {
+	previous, err := os.ReadFile(cfg.ClientsFile)
+	if err != nil {
+		return errors.Wrap(errors.WithStack(err), "failed to read clients file")
+	}
+
+	var data bytes.Buffer
+	enc := yaml.NewEncoder(&data)
+	enc.SetIndent(2)
+	if err := enc.Encode(file); err != nil {
+		return errors.Wrap(errors.WithStack(err), "failed to encode clients file")
+	}
+
+	if err := replaceFile(cfg.ClientsFile, data.Bytes()); err != nil {
+		return err
+	}
+
+	if _, err := loadConfig(configFiles); err != nil {
+		if restoreErr := replaceFile(cfg.ClientsFile, previous); restoreErr != nil {
+			return errors.Wrap(restoreErr, "failed to restore clients file")
+		}
+
+		return errors.Wrap(err, "clients file left unchanged")
+	}
+
+	return nil
+}
+
+// generateClientSecret returns a random base64url encoded client secret.
+func generateClientSecret() (string, error) {
+	secret := make([]byte, clientSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", errors.Wrap(errors.WithStack(err), "failed to generate client secret")
+	}
+
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/laonix/oauth2/internal/config"
+)
+
+func TestClientsAdd(t *testing.T) {
+	tests := []struct {
+		name          string
+		args          []string
+		expectError   bool
+		expectSecret  bool
+		expectedCount int
+	}{
+		{
+			name:          "Confidential client gets a secret",
+			args:          []string{"--id", "new"},
+			expectSecret:  true,
+			expectedCount: 2,
+		},
+		{
+			name:          "Public client has no secret",
+			args:          []string{"--id", "new", "--public", "--redirect-uri", "https://app.example.com/callback"},
+			expectedCount: 2,
+		},
+		{
+			name:          "Existing client is refused",
+			args:          []string{"--id", "existing"},
+			expectError:   true,
+			expectedCount: 1,
+		},
+		{
+			name:          "Invalid config is rolled back",
+			args:          []string{"--id", "new", "--public", "--redirect-uri", "/callback"},
+			expectError:   true,
+			expectedCount: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			clients := "clients:\n  - id: existing\n    secret: existing_secret\n"
+			path := writeTestConfig(t, dir, "HS256", clients)
+
+			out, err := runCommand(t, clientsAdd, append([]string{"--config", path}, tt.args...)...)
+			if tt.expectError != (err != nil) {
+				t.Fatalf("got error %v but wanted error %t\n", err, tt.expectError)
+			}
+
+			if tt.expectError {
+				if content := readFile(t, dir+"/clients.yaml"); content != clients {
+					t.Errorf("got clients file\n%s\nbut wanted it unchanged\n%s\n", content, clients)
+				}
+			}
+
+			cfg, err := config.LoadConfig(path)
+			if err != nil {
+				t.Fatalf("could not load config: %v\n", err)
+			}
+
+			if len(cfg.Clients) != tt.expectedCount {
+				t.Fatalf("got %d clients but wanted %d\n", len(cfg.Clients), tt.expectedCount)
+			}
+
+			secret := strings.TrimSpace(out)
+			if (secret != "") != tt.expectSecret {
+				t.Errorf("got secret %q printed but wanted secret %t\n", secret, tt.expectSecret)
+			}
+
+			if tt.expectSecret && cfg.Clients[1].Secret != secret {
+				t.Errorf("got secret %q in the clients file but wanted the printed one %q\n", cfg.Clients[1].Secret, secret)
+			}
+		})
+	}
+}
+
+func TestClientsRotateSecret(t *testing.T) {
+	tests := []struct {
+		name         string
+		id           string
+		expectError  bool
+		expectRotate bool
+	}{
+		{
+			name:         "Confidential client gets a new secret",
+			id:           "confidential",
+			expectRotate: true,
+		},
+		{
+			name:        "Public client is refused",
+			id:          "public",
+			expectError: true,
+		},
+		{
+			name:        "Client of a secret file is refused",
+			id:          "file",
+			expectError: true,
+		},
+		{
+			name:        "Unknown client is refused",
+			id:          "unknown",
+			expectError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := writeTestConfig(t, dir, "HS256", `
+clients:
+  - id: confidential
+    secret: old_secret
+    refresh_tokens: true
+  - id: public
+    public: true
+  - id: file
+    secret_file: `+writeFile(t, dir, "file.secret", "file_secret\n")+`
+`)
+
+			out, err := runCommand(t, clientsRotateSecret, "--config", path, "--id", tt.id)
+			if tt.expectError != (err != nil) {
+				t.Fatalf("got error %v but wanted error %t\n", err, tt.expectError)
+			}
+
+			cfg, err := config.LoadConfig(path)
+			if err != nil {
+				t.Fatalf("could not load config: %v\n", err)
+			}
+
+			secret := cfg.Clients[0].Secret
+			if rotated := secret != "old_secret"; rotated != tt.expectRotate {
+				t.Errorf("got secret %q rotated %t but wanted rotated %t\n", secret, rotated, tt.expectRotate)
+			}
+
+			if tt.expectRotate && strings.TrimSpace(out) != secret {
+				t.Errorf("got secret %q printed but wanted %q\n", strings.TrimSpace(out), secret)
+			}
+
+			// the other keys of the client are written back as they were
+			if !cfg.Clients[0].RefreshTokens || cfg.Clients[2].Secret != "file_secret" {
+				t.Errorf("got clients %+v but wanted the other keys kept\n", cfg.Clients)
+			}
+		})
+	}
+}
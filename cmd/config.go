@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/laonix/oauth2/internal/config"
+)
+
+// printConfig prints the effective config with its secrets redacted and the sources of its values.
+func printConfig(args []string) error {
+	fs := flag.NewFlagSet("config print", flag.ExitOnError)
+	configFiles := configFlag(fs)
+	format := fs.String("format", config.FormatYAML, "output format, yaml or json")
+	_ = fs.Parse(args)
+
+	cfg, err := loadConfig(*configFiles)
+	if err != nil {
+		return err
+	}
+
+	out, err := cfg.Dump(*format)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(out)
+
+	return err
+}
+
+// validateConfig checks the config files, reporting every problem, without starting the server.
+func validateConfig(args []string) error {
+	fs := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	configFiles := configFlag(fs)
+	_ = fs.Parse(args)
+
+	files := config.Locate(*configFiles)
+	if _, err := config.LoadConfig(files...); err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		fmt.Println("config is valid: defaults and env only")
+	} else {
+		fmt.Println("config is valid: " + strings.Join(files, ", "))
+	}
+
+	return nil
+}
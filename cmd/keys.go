@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/laonix/oauth2/internal/config"
+	"github.com/laonix/oauth2/internal/keys"
+)
+
+// keysGenerate generates a signing key and prints it, or writes it to a new file.
+func keysGenerate(args []string) error {
+	fs := flag.NewFlagSet("keys generate", flag.ExitOnError)
+	alg := fs.String("alg", "RS256", "signing algorithm of the key, one of the jwt.algorithm values")
+	out := fs.String("out", "", "new file to write the key to, readable by its owner only (default stdout)")
+	_ = fs.Parse(args)
+
+	key, err := keys.GenerateSigningKey(*alg)
+	if err != nil {
+		return err
+	}
+
+	// the trailing newline is dropped when the key is read from a file
+	key = bytes.TrimSuffix(key, []byte("\n"))
+	if err := writeOutput(*out, append(key, '\n')); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "generated %s\n", describeKey(*alg, key))
+
+	return nil
+}
+
+// keysRotate replaces the signing key of jwt.secret_file by a new key of jwt.algorithm.
+//
+// The current key is kept in the file suffixed with config.PreviousKeySuffix. The servers sign with the new key once
+// restarted, and verify and publish the previous one until the tokens it signed expire. HMAC secrets have no key ID
+// telling the tokens of either secret apart, so they aren't kept: the tokens signed with the previous secret are
+// rejected once the servers restart.
+func keysRotate(args []string) error {
+	fs := flag.NewFlagSet("keys rotate", flag.ExitOnError)
+	configFiles := configFlag(fs)
+	_ = fs.Parse(args)
+
+	cfg, err := loadConfig(*configFiles)
+	if err != nil {
+		return err
+	}
+
+	file := cfg.JWT.SecretFile
+	if file == "" {
+		return errors.New("keys rotate requires the key in a file, set jwt.secret_file")
+	}
+
+	key, err := keys.GenerateSigningKey(cfg.JWT.Algorithm)
+	if err != nil {
+		return err
+	}
+
+	current, err := keys.ParseSigningKey(cfg.JWT.Algorithm, []byte(cfg.JWT.Secret))
+	if err != nil {
+		return err
+	}
+
+	_, signer := current.(crypto.Signer)
+	hmac := !signer
+
+	if hmac {
+		if err := os.Remove(file + config.PreviousKeySuffix); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(errors.WithStack(err), "failed to remove the previous key")
+		}
+	} else if err := os.WriteFile(file+config.PreviousKeySuffix, []byte(cfg.JWT.Secret), 0o600); err != nil {
+		return errors.Wrap(errors.WithStack(err), "failed to keep the current key")
+	}
+
+	key = bytes.TrimSuffix(key, []byte("\n"))
+	if err := replaceFile(file, append(key, '\n')); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "rotated %s\n     to %s\n",
+		describeKey(cfg.JWT.Algorithm, []byte(cfg.JWT.Secret)), describeKey(cfg.JWT.Algorithm, key))
+
+	if hmac {
+		fmt.Fprintf(os.Stderr, "restart the servers to sign with it; the tokens signed with the previous secret are rejected from then on\n")
+	} else {
+		fmt.Fprintf(os.Stderr, "restart the servers to sign with it; they verify the tokens of the previous key for %s\n",
+			cfg.JWT.AccessTokenExpiresIn)
+	}
+
+	return nil
+}
+
+// keysExportJWKS prints the JWKS of the public key of the signing key.
+func keysExportJWKS(args []string) error {
+	fs := flag.NewFlagSet("keys export-jwks", flag.ExitOnError)
+	key := keyFlags(fs)
+	out := fs.String("out", "", "new file to write the JWKS to (default stdout)")
+	_ = fs.Parse(args)
+
+	alg, pub, err := key.public()
+	if err != nil {
+		return err
+	}
+
+	keyID, err := keys.KeyID(pub)
+	if err != nil {
+		return err
+	}
+
+	jwk, err := keys.NewJWK(pub, keyID, alg)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(&keys.JWKS{Keys: []keys.JWK{jwk}}, "", "  ")
+	if err != nil {
+		return errors.Wrap(errors.WithStack(err), "failed to encode JWKS")
+	}
+
+	return writeOutput(*out, append(data, '\n'))
+}
+
+// keysExportPEM prints the PEM encoded public key of the signing key.
+func keysExportPEM(args []string) error {
+	fs := flag.NewFlagSet("keys export-pem", flag.ExitOnError)
+	key := keyFlags(fs)
+	out := fs.String("out", "", "new file to write the public key to (default stdout)")
+	_ = fs.Parse(args)
+
+	_, pub, err := key.public()
+	if err != nil {
+		return err
+	}
+
+	data, err := keys.EncodePublicKeyPEM(pub)
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(*out, data)
+}
+
+// keysFingerprint prints the algorithm and the fingerprint of the signing key, its key ID, without revealing it.
+//
+// The fingerprint is the one of jwt.secret in the effective config of the servers, see config print and /admin/config.
+// HMAC secrets have no fingerprint.
+func keysFingerprint(args []string) error {
+	fs := flag.NewFlagSet("keys fingerprint", flag.ExitOnError)
+	key := keyFlags(fs)
+	_ = fs.Parse(args)
+
+	alg, secret, err := key.load()
+	if err != nil {
+		return err
+	}
+
+	if _, err := keys.ParseSigningKey(alg, secret); err != nil {
+		return err
+	}
+
+	fmt.Println(describeKey(alg, secret))
+
+	return nil
+}
+
+// signingKeyFlags select the signing key of a command: the key file of --key, else the key of the config.
+type signingKeyFlags struct {
+	configFiles *stringsFlag
+	file        *string
+	alg         *string
+}
+
+// keyFlags adds the flags selecting the signing key to fs.
+func keyFlags(fs *flag.FlagSet) *signingKeyFlags {
+	return &signingKeyFlags{
+		configFiles: configFlag(fs),
+		file:        fs.String("key", "", "key file, e.g. written by keys generate, instead of the jwt.secret of the config"),
+		alg:         fs.String("alg", "", "signing algorithm of the --key file (default the one matching the key type, RS256 for RSA keys)"),
+	}
+}
+
+// load returns the algorithm and the signing key selected by the flags.
+func (f *signingKeyFlags) load() (string, []byte, error) {
+	if *f.file == "" {
+		cfg, err := loadConfig(*f.configFiles)
+		if err != nil {
+			return "", nil, err
+		}
+
+		return cfg.JWT.Algorithm, []byte(cfg.JWT.Secret), nil
+	}
+
+	secret, err := os.ReadFile(*f.file)
+	if err != nil {
+		return "", nil, errors.Wrap(errors.WithStack(err), "failed to read key file")
+	}
+	secret = bytes.TrimSuffix(secret, []byte("\n"))
+
+	if *f.alg != "" {
+		return *f.alg, secret, nil
+	}
+
+	signer, err := keys.ParsePrivateKeyPEM(secret)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "set --alg for HMAC secrets")
+	}
+
+	return defaultAlgorithm(signer), secret, nil
+}
+
+// public returns the algorithm and the public key of the signing key selected by the flags.
+func (f *signingKeyFlags) public() (string, crypto.PublicKey, error) {
+	alg, secret, err := f.load()
+	if err != nil {
+		return "", nil, err
+	}
+
+	key, err := keys.ParseSigningKey(alg, secret)
+	if err != nil {
+		return "", nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return "", nil, errors.Errorf("%s keys are secret, they have no public key to export", alg)
+	}
+
+	return alg, signer.Public(), nil
+}
+
+// defaultAlgorithm returns the signing algorithm matching the type of the key.
+func defaultAlgorithm(key crypto.Signer) string {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		switch k.Curve.Params().BitSize {
+		case 384:
+			return "ES384"
+		case 521:
+			return "ES512"
+		default:
+			return "ES256"
+		}
+	case ed25519.PrivateKey:
+		return "EdDSA"
+	default:
+		return "RS256"
+	}
+}
+
+// describeKey returns the algorithm and the fingerprint of a signing key, see keys.SigningKeyFingerprint.
+func describeKey(alg string, secret []byte) string {
+	fingerprint, ok := keys.SigningKeyFingerprint(alg, secret)
+	if !ok {
+		return alg + " secret, HMAC secrets have no fingerprint"
+	}
+
+	return alg + " key fingerprint " + fingerprint
+}
+
+// writeOutput writes data to stdout or, if set, to the new file out, readable by its owner only.
+func writeOutput(out string, data []byte) error {
+	if out == "" {
+		_, err := os.Stdout.Write(data)
+
+		return err
+	}
+
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return errors.Wrap(errors.WithStack(err), "failed to create output file")
+	}
+
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+
+		return errors.Wrap(errors.WithStack(err), "failed to write output file")
+	}
+
+	return errors.WithStack(f.Close())
+}
+
+// replaceFile replaces the content of file atomically, by renaming a temporary file over it.
+func replaceFile(file string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return errors.Wrap(errors.WithStack(err), "failed to create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+
+		return errors.Wrap(errors.WithStack(err), "failed to write temporary file")
+	}
+
+	if err := tmp.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.Wrapf(errors.WithStack(os.Rename(tmp.Name(), file)), "failed to replace %s", file)
+}
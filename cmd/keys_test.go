@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/laonix/oauth2/internal/config"
+	"github.com/laonix/oauth2/internal/keys"
+)
+
+func TestKeysRotate(t *testing.T) {
+	tests := []struct {
+		name           string
+		alg            string
+		stalePrevious  bool
+		expectPrevious bool
+	}{
+		{
+			name:           "Private key is kept as the previous key",
+			alg:            "RS256",
+			expectPrevious: true,
+		},
+		{
+			name:           "HMAC secret is replaced with a cutover",
+			alg:            "HS256",
+			stalePrevious:  true,
+			expectPrevious: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := writeTestConfig(t, dir, tt.alg, "clients: []\n")
+
+			before, err := config.LoadConfig(path)
+			if err != nil {
+				t.Fatalf("could not load config: %v\n", err)
+			}
+
+			if tt.stalePrevious {
+				writeFile(t, dir, "jwt.key"+config.PreviousKeySuffix, "stale")
+			}
+
+			if _, err := runCommand(t, keysRotate, "--config", path); err != nil {
+				t.Fatalf("could not rotate key: %v\n", err)
+			}
+
+			after, err := config.LoadConfig(path)
+			if err != nil {
+				t.Fatalf("could not load the rotated config: %v\n", err)
+			}
+
+			if after.JWT.Secret == before.JWT.Secret {
+				t.Errorf("got the signing key unchanged but wanted a new one\n")
+			}
+
+			if _, err := keys.ParseSigningKey(tt.alg, []byte(after.JWT.Secret)); err != nil {
+				t.Errorf("got invalid %s key: %v\n", tt.alg, err)
+			}
+
+			expectedPrevious := ""
+			if tt.expectPrevious {
+				expectedPrevious = before.JWT.Secret
+			}
+
+			if after.JWT.PreviousSecret != expectedPrevious {
+				t.Errorf("got previous key %q but wanted %q\n", after.JWT.PreviousSecret, expectedPrevious)
+			}
+
+			if _, err := os.Stat(dir + "/jwt.key" + config.PreviousKeySuffix); os.IsNotExist(err) == tt.expectPrevious {
+				t.Errorf("got previous key file %v but wanted it kept %t\n", err, tt.expectPrevious)
+			}
+		})
+	}
+}
+
+func TestKeysExportJWKS(t *testing.T) {
+	tests := []struct {
+		name        string
+		alg         string
+		args        func(dir string) []string
+		expectError bool
+		expectedAlg string
+	}{
+		{
+			name:        "Key of the config",
+			alg:         "ES256",
+			expectedAlg: "ES256",
+		},
+		{
+			name: "Key file with the algorithm of its type",
+			alg:  "HS256",
+			args: func(dir string) []string {
+				return []string{"--key", writeFile(t, dir, "ed.key", generateKey(t, "EdDSA"))}
+			},
+			expectedAlg: "EdDSA",
+		},
+		{
+			name:        "HMAC secret has no public key",
+			alg:         "HS256",
+			expectError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := writeTestConfig(t, dir, tt.alg, "clients: []\n")
+
+			args := []string{"--config", path}
+			if tt.args != nil {
+				args = append(args, tt.args(dir)...)
+			}
+
+			out, err := runCommand(t, keysExportJWKS, args...)
+			if tt.expectError != (err != nil) {
+				t.Fatalf("got error %v but wanted error %t\n", err, tt.expectError)
+			}
+
+			if tt.expectError {
+				return
+			}
+
+			var set keys.JWKS
+			if err := json.Unmarshal([]byte(out), &set); err != nil {
+				t.Fatalf("could not decode JWKS %q: %v\n", out, err)
+			}
+
+			if len(set.Keys) != 1 || set.Keys[0].Algorithm != tt.expectedAlg {
+				t.Fatalf("got keys %+v but wanted a single %s key\n", set.Keys, tt.expectedAlg)
+			}
+
+			secret := readFile(t, dir+"/jwt.key")
+			if tt.args != nil {
+				secret = readFile(t, dir+"/ed.key")
+			}
+
+			signer, err := keys.ParsePrivateKeyPEM([]byte(strings.TrimSpace(secret)))
+			if err != nil {
+				t.Fatalf("could not parse key: %v\n", err)
+			}
+
+			if keyID, _ := keys.KeyID(signer.Public()); set.Keys[0].KeyID != keyID {
+				t.Errorf("got kid %q but wanted %q\n", set.Keys[0].KeyID, keyID)
+			}
+
+			pub, err := set.Keys[0].PublicKey()
+			if err != nil {
+				t.Fatalf("could not decode public key: %v\n", err)
+			}
+
+			if !pub.(interface{ Equal(crypto.PublicKey) bool }).Equal(signer.Public()) {
+				t.Errorf("got public key %v but wanted the one of the signing key\n", pub)
+			}
+		})
+	}
+}
@@ -1,95 +1,140 @@
 package main
 
 import (
-	"context"
-	golog "log"
-	"net/http"
-	"os/signal"
-	"syscall"
-
-	"github.com/go-oauth2/oauth2/v4/models"
-	"github.com/go-oauth2/oauth2/v4/store"
-	"github.com/oklog/run"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
 	"github.com/pkg/errors"
 
-	"oauth2/internal/config"
-	"oauth2/internal/handler"
-	"oauth2/internal/logger"
-	"oauth2/internal/service/auth"
+	"github.com/laonix/oauth2/internal/config"
 )
 
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// command is a command of the binary.
+type command struct {
+	summary string
+	run     func(args []string) error
+}
+
+// commands are the commands of the binary, serve being the default one.
+var commands = map[string]command{
+	"serve":           {"run the server, the default command", serve},
+	"validate-config": {"check the config without starting the server", validateConfig},
+	"config": {"inspect the config", subcommands("config", map[string]command{
+		"print": {"print the effective config with the sources of its values", printConfig},
+	})},
+	"keys": {"manage the signing keys", subcommands("keys", map[string]command{
+		"generate":    {"generate a signing key", keysGenerate},
+		"rotate":      {"replace the signing key of jwt.secret_file", keysRotate},
+		"export-jwks": {"print the JWKS of the public key of the signing key, for the resource servers", keysExportJWKS},
+		"export-pem":  {"print the PEM encoded public key of the signing key", keysExportPEM},
+		"fingerprint": {"print the key ID and fingerprint of the signing key, without revealing it", keysFingerprint},
+	})},
+	"clients": {"manage the clients of the clients file", subcommands("clients", map[string]command{
+		"add":           {"add a client", clientsAdd},
+		"list":          {"list the clients", clientsList},
+		"rotate-secret": {"replace the secret of a client", clientsRotateSecret},
+	})},
+	"token": {"debug access tokens", subcommands("token", map[string]command{
+		"issue":  {"issue an access token locally, unknown to the running servers", tokenIssue},
+		"decode": {"print the header and claims of a token, without verifying it", tokenDecode},
+		"verify": {"verify the signature and expiry of a token and print its claims", tokenVerify},
+	})},
+}
+
 func main() {
-	// load config
-	cfg, err := config.LoadConfig()
-	if err != nil {
-		golog.Fatal(errors.Wrap(errors.WithStack(err), "failed to load config"))
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
 
-	// get logger
-	logger.SetLogLevel(cfg.Log.Level)
-	log := logger.Get()
+	if name == "help" {
+		usage(os.Stdout, "oauth2", commands)
 
-	// token store
-	tokenRepo, err := store.NewMemoryTokenStore()
-	if err != nil {
-		log.Fatal().Err(errors.WithStack(err)).Msg("failed to create token store")
+		return
 	}
 
-	// client store for mock user
-	clientRepo := store.NewClientStore()
-	if err := clientRepo.Set("client_id", &models.Client{
-		ID:     "client_id",
-		Secret: "client_secret",
-	}); err != nil {
-		log.Fatal().Err(errors.WithStack(err)).Msg("failed to set mock client")
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+		usage(os.Stderr, "oauth2", commands)
+		os.Exit(2)
 	}
 
-	manager := auth.NewManager(cfg, tokenRepo, clientRepo)
-	h := handler.New(manager)
-	httpServer := &http.Server{
-		Addr:         ":" + cfg.HTTP.Port,
-		Handler:      h.Routes(),
-		ReadTimeout:  cfg.HTTP.Timeout,
-		WriteTimeout: cfg.HTTP.Timeout,
+	if err := cmd.run(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
+}
 
-	var group run.Group
-
-	// http server
-	group.Add(func() error {
-		log.Info().Msg("http server listening on port " + cfg.HTTP.Port)
+// subcommands returns a command running the subcommand named by its first argument.
+func subcommands(name string, cmds map[string]command) func(args []string) error {
+	return func(args []string) error {
+		if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+			usage(os.Stdout, "oauth2 "+name, cmds)
 
-		return httpServer.ListenAndServe()
-	}, func(err error) {
-		if errors.Is(err, http.ErrServerClosed) {
-			log.Info().Msg("http server closed")
-		} else {
-			log.Error().Err(err).Msg("http server stopped with error")
+			return nil
 		}
-	})
 
-	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer cancel()
+		cmd, ok := cmds[args[0]]
+		if !ok {
+			usage(os.Stderr, "oauth2 "+name, cmds)
 
-	// graceful shutdown
-	group.Add(func() error {
-		<-ctx.Done()
+			return errors.Errorf("unknown command %q", name+" "+args[0])
+		}
 
-		log.Info().Msg("start graceful shutdown")
-		defer log.Info().Msg("graceful shutdown completed")
+		return cmd.run(args[1:])
+	}
+}
 
-		return httpServer.Shutdown(context.Background())
-	}, func(err error) {
-		if !errors.Is(err, http.ErrServerClosed) {
-			log.Fatal().Err(err).Msg("graceful shutdown interrupted")
-		}
-	})
+// usage prints the commands with their summary.
+func usage(w io.Writer, prefix string, cmds map[string]command) {
+	names := make([]string, 0, len(cmds))
+	for name := range cmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-	if err := group.Run(); err != nil {
-		if errors.Is(err, http.ErrServerClosed) {
-			log.Info().Msg("service stopped")
-		} else {
-			log.Fatal().Err(err).Msg("service stopped with error")
-		}
+	fmt.Fprintf(w, "Usage: %s <command> [flags]\n\nCommands:\n", prefix)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s\t%s\n", name, cmds[name].summary)
 	}
+	_ = tw.Flush()
+
+	fmt.Fprintf(w, "\nRun '%s <command> -h' for the flags of a command.\n", prefix)
+}
+
+// loadConfig loads the config of the files of the --config flags, see config.Locate.
+func loadConfig(files []string) (*config.Config, error) {
+	return config.LoadConfig(config.Locate(files)...)
+}
+
+// configFlag adds the repeatable --config flag to fs.
+func configFlag(fs *flag.FlagSet) *stringsFlag {
+	var files stringsFlag
+	fs.Var(&files, "config", "config file, repeated for overlays applied in order (default $"+config.EnvConfigFiles+", else config.yaml in "+strings.Join(config.SearchPaths, ", ")+")")
+
+	return &files
+}
+
+// stringsFlag is a flag that may be repeated, collecting its values in order.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+
+	return nil
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/laonix/oauth2/internal/keys"
+)
+
+// writeFile writes the file in dir and returns its path.
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("could not write %s: %v\n", name, err)
+	}
+
+	return path
+}
+
+// readFile returns the content of the file.
+func readFile(t *testing.T, path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read %s: %v\n", path, err)
+	}
+
+	return string(data)
+}
+
+// generateKey returns a new signing key of the algorithm, as written by keys generate.
+func generateKey(t *testing.T, alg string) string {
+	key, err := keys.GenerateSigningKey(alg)
+	if err != nil {
+		t.Fatalf("could not generate %s key: %v\n", alg, err)
+	}
+
+	return string(key)
+}
+
+// writeTestConfig writes a dev config of the algorithm with its key in jwt.key and its clients in clients.yaml,
+// and returns the path of the config.
+func writeTestConfig(t *testing.T, dir, alg, clients string) string {
+	secret := "0123456789abcdef0123456789abcdef"
+	if alg != "HS256" {
+		secret = generateKey(t, alg)
+	}
+
+	return writeFile(t, dir, "config.yaml", `
+mode: dev
+jwt:
+  algorithm: `+alg+`
+  secret_file: `+writeFile(t, dir, "jwt.key", secret)+`
+clients_file: `+writeFile(t, dir, "clients.yaml", clients)+`
+`)
+}
+
+// runCommand runs the command with args and returns what it printed on stdout. What it prints on stderr is discarded.
+//
+// The command registers its metrics in a registry of its own, as if it ran in a process of its own.
+func runCommand(t *testing.T, cmd func(args []string) error, args ...string) (string, error) {
+	stdout, stderr, registerer := os.Stdout, os.Stderr, prometheus.DefaultRegisterer
+	defer func() { os.Stdout, os.Stderr, prometheus.DefaultRegisterer = stdout, stderr, registerer }()
+
+	prometheus.DefaultRegisterer = prometheus.NewRegistry()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("could not create pipe: %v\n", err)
+	}
+	defer r.Close()
+
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("could not open %s: %v\n", os.DevNull, err)
+	}
+	defer devNull.Close()
+
+	os.Stdout, os.Stderr = w, devNull
+
+	out := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- string(data)
+	}()
+
+	err = cmd(args)
+	_ = w.Close()
+
+	return <-out, err
+}
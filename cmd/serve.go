@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	golog "log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/oklog/run"
+	"github.com/pkg/errors"
+
+	"github.com/laonix/oauth2/internal/config"
+	"github.com/laonix/oauth2/internal/handler"
+	"github.com/laonix/oauth2/internal/logger"
+	"github.com/laonix/oauth2/internal/reload"
+	"github.com/laonix/oauth2/internal/service/auth"
+	"github.com/laonix/oauth2/internal/tlsconfig"
+	"github.com/laonix/oauth2/internal/tracing"
+)
+
+// serve runs the server until it receives SIGINT or SIGTERM.
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	configFlags := configFlag(fs)
+	_ = fs.Parse(args)
+
+	// load config
+	configFiles := config.Locate(*configFlags)
+
+	cfg, err := config.LoadConfig(configFiles...)
+	if err != nil {
+		golog.Fatal(errors.Wrap(errors.WithStack(err), "failed to load config"))
+	}
+
+	// get logger
+	if err := logger.Configure(cfg.Log, map[string]string{
+		"service": "oauth2",
+		"version": version,
+		"pod":     podName(),
+	}); err != nil {
+		golog.Fatal(errors.Wrap(err, "failed to configure logger"))
+	}
+	log := logger.Get()
+
+	if len(configFiles) == 0 {
+		log.Warn().Str("mode", cfg.Mode).Msg("no config file found, running on the defaults and env")
+	} else {
+		log.Info().Strs("files", configFiles).Str("mode", cfg.Mode).Msg("config loaded")
+	}
+
+	// tracing
+	shutdownTracing, err := tracing.Init(cfg.Tracing)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to init tracing")
+	}
+
+	// stores, manager and grants
+	a, err := newApp(cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to create the server")
+	}
+
+	manager, refresh, device := a.manager, a.refresh, a.device
+
+	h := handler.New(manager,
+		handler.WithConfig(cfg),
+		handler.WithAdminToken(cfg.Admin.Token),
+		handler.WithAccessLog(cfg.Log.Access),
+		handler.WithTrustedRequestID(cfg.HTTP.TrustRequestID),
+		handler.WithReadinessCheck("signing", manager.CheckSigning),
+		handler.WithReadinessCheck("token_store", manager.CheckTokenStore),
+		handler.WithUserAuthenticator(auth.HeaderUserAuthenticator(cfg.Grants.AuthorizationCode.UserHeader)),
+		handler.WithDeviceAuthorization(device.HandleDeviceAuthorizationRequest, device.Approve),
+		handler.WithGrant(oauth2.Refreshing, refresh.HandleTokenRequest),
+		handler.WithGrant(auth.DeviceCodeGrantType, device.HandleTokenRequest),
+		handler.WithGrant(auth.JWTBearerGrantType, a.jwtBearer.HandleTokenRequest),
+		handler.WithGrant(auth.TokenExchangeGrantType, a.tokenExchange.HandleTokenRequest),
+	)
+	httpServer := &http.Server{
+		Addr:         ":" + cfg.HTTP.Port,
+		Handler:      h.Routes(),
+		ReadTimeout:  cfg.HTTP.Timeout,
+		WriteTimeout: cfg.HTTP.Timeout,
+	}
+
+	var certReloader *tlsconfig.CertReloader
+	var plainServer *http.Server
+	if cfg.HTTP.TLS.Enabled {
+		certReloader, err = tlsconfig.NewCertReloader(cfg.HTTP.TLS.CertFile, cfg.HTTP.TLS.KeyFile, cfg.HTTP.TLS.ReloadInterval)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to load TLS certificate")
+		}
+
+		httpServer.TLSConfig, err = tlsconfig.New(cfg.HTTP.TLS, certReloader)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create TLS config")
+		}
+
+		if !cfg.HTTP.TLS.HTTP2 {
+			// a non-nil map disables the automatic HTTP/2 of net/http
+			httpServer.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		}
+
+		if cfg.HTTP.TLS.PlainPort != "" {
+			plainServer = &http.Server{
+				Addr:         ":" + cfg.HTTP.TLS.PlainPort,
+				Handler:      h.PlainHTTPRoutes(cfg.HTTP.TLS.PlainHTTP, cfg.HTTP.Port),
+				ReadTimeout:  cfg.HTTP.Timeout,
+				WriteTimeout: cfg.HTTP.Timeout,
+			}
+		}
+	}
+
+	var adminServer *http.Server
+	if cfg.Admin.Address != "" {
+		adminServer = &http.Server{
+			Addr:         cfg.Admin.Address,
+			Handler:      h.AdminRoutes(),
+			ReadTimeout:  cfg.HTTP.Timeout,
+			WriteTimeout: cfg.HTTP.Timeout,
+		}
+	}
+
+	// every actor interrupts by starting the graceful shutdown, which stops the actors in order
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+
+	var group run.Group
+
+	// http server
+	group.Add(func() error {
+		if certReloader != nil {
+			log.Info().Msg("https server listening on port " + cfg.HTTP.Port)
+
+			return httpServer.ListenAndServeTLS("", "")
+		}
+
+		log.Info().Msg("http server listening on port " + cfg.HTTP.Port)
+
+		return httpServer.ListenAndServe()
+	}, func(err error) {
+		cancel()
+	})
+
+	// plain http server of the tls server
+	if plainServer != nil {
+		group.Add(func() error {
+			log.Info().Msg("plain http server listening on port " + cfg.HTTP.TLS.PlainPort)
+
+			if err := plainServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+
+			return nil
+		}, func(err error) {
+			cancel()
+		})
+	}
+
+	// tls certificate reload
+	reloadDone := make(chan struct{})
+	group.Add(func() error {
+		defer close(reloadDone)
+
+		if certReloader != nil {
+			certReloader.Run(workersCtx)
+		}
+
+		<-workersCtx.Done()
+
+		return nil
+	}, func(err error) {
+		cancel()
+	})
+
+	// admin server
+	if adminServer != nil {
+		group.Add(func() error {
+			log.Info().Msg("admin server listening on " + cfg.Admin.Address)
+
+			if err := adminServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+
+			return nil
+		}, func(err error) {
+			cancel()
+		})
+	}
+
+	// token gc
+	gcDone := make(chan struct{})
+	group.Add(func() error {
+		defer close(gcDone)
+
+		refresh.Run(workersCtx)
+
+		return nil
+	}, func(err error) {
+		cancel()
+	})
+
+	// config reload, on SIGHUP or once the files change
+	watcher := reload.NewWatcher(configFiles, cfg, func(reloaded *config.Config) error {
+		if err := a.clients.Replace(reloaded.Clients); err != nil {
+			return err
+		}
+
+		manager.Reload(reloaded)
+		refresh.Reload(reloaded.JWT)
+		logger.SetLogLevel(reloaded.Log.Level)
+		h.SetConfig(reloaded)
+
+		return nil
+	})
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	watcherDone := make(chan struct{})
+	group.Add(func() error {
+		defer close(watcherDone)
+		defer signal.Stop(hup)
+
+		go watcher.Run(workersCtx)
+
+		for {
+			select {
+			case <-hup:
+				_ = watcher.Reload(workersCtx)
+			case <-workersCtx.Done():
+				return nil
+			}
+		}
+	}, func(err error) {
+		cancel()
+	})
+
+	// graceful shutdown
+	group.Add(func() error {
+		<-ctx.Done()
+
+		log.Info().Msg("start graceful shutdown")
+		defer log.Info().Msg("graceful shutdown completed")
+
+		// readiness fails first, so that no new traffic is routed to the server
+		h.Drain()
+
+		log.Info().Dur("pre_stop_delay", cfg.HTTP.PreStopDelay).Msg("waiting for the traffic to stop")
+		time.Sleep(cfg.HTTP.PreStopDelay)
+
+		drainHTTPServer(httpServer, h, cfg.HTTP.DrainTimeout)
+
+		if plainServer != nil {
+			if err := plainServer.Close(); err != nil {
+				log.Error().Err(errors.WithStack(err)).Msg("failed to close plain http server")
+			}
+		}
+
+		// the workers are stopped once no request uses them anymore, in order
+		stopWorkers()
+		<-gcDone
+		log.Info().Msg("token gc stopped")
+		<-reloadDone
+		<-watcherDone
+
+		if adminServer != nil {
+			adminCtx, cancelAdmin := context.WithTimeout(context.Background(), cfg.HTTP.DrainTimeout)
+			defer cancelAdmin()
+
+			if err := adminServer.Shutdown(adminCtx); err != nil {
+				log.Error().Err(errors.WithStack(err)).Msg("admin server stopped with error")
+			} else {
+				log.Info().Msg("admin server closed")
+			}
+		}
+
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Error().Err(errors.WithStack(err)).Msg("failed to flush traces")
+		}
+
+		return nil
+	}, func(err error) {
+		cancel()
+	})
+
+	if err := group.Run(); err != nil {
+		if errors.Is(err, http.ErrServerClosed) {
+			log.Info().Msg("service stopped")
+		} else {
+			log.Fatal().Err(err).Msg("service stopped with error")
+		}
+	}
+
+	return nil
+}
+
+// drainHTTPServer shuts the http server down, waiting for the in-flight requests to complete up to the timeout.
+//
+// The connections of the requests still in flight after the timeout are closed.
+func drainHTTPServer(httpServer *http.Server, h *handler.Handler, timeout time.Duration) {
+	log := logger.Get()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- httpServer.Shutdown(ctx)
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	log.Info().Int64("in_flight", h.InFlight()).Dur("drain_timeout", timeout).Msg("draining http server")
+
+	for {
+		select {
+		case err := <-done:
+			if err == nil {
+				log.Info().Msg("http server closed")
+
+				return
+			}
+
+			log.Warn().Err(err).Int64("in_flight", h.InFlight()).Msg("drain timeout exceeded, closing connections")
+
+			if err := httpServer.Close(); err != nil {
+				log.Error().Err(errors.WithStack(err)).Msg("failed to close http server")
+			}
+
+			return
+		case <-ticker.C:
+			log.Info().Int64("in_flight", h.InFlight()).Msg("waiting for in-flight requests")
+		}
+	}
+}
+
+// podName returns the name of the pod set by the Downward API, or the hostname, which Kubernetes sets to the pod name.
+func podName() string {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name
+	}
+
+	name, _ := os.Hostname()
+
+	return name
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/golang-jwt/jwt"
+	"github.com/pkg/errors"
+
+	"github.com/laonix/oauth2/pkg/resource"
+)
+
+// tokenIssue issues an access token with the signing key of the config and prints it as a token response.
+//
+// The token is stored in the token store of the command only: the running servers reject it on /secure,
+// but the resource servers verifying its signature accept it.
+func tokenIssue(args []string) error {
+	fs := flag.NewFlagSet("token issue", flag.ExitOnError)
+	configFiles := configFlag(fs)
+	clientID := fs.String("client-id", "", "client the token is issued to")
+	scope := fs.String("scope", "", "space-separated scopes of the token")
+	user := fs.String("user", "", "user the token is issued for, the sub claim")
+	ttl := fs.Duration("ttl", 0, "lifetime of the token (default jwt.access_token_expires_in)")
+	_ = fs.Parse(args)
+
+	if *clientID == "" {
+		return errors.New("--client-id is required")
+	}
+
+	cfg, err := loadConfig(*configFiles)
+	if err != nil {
+		return err
+	}
+
+	a, err := newApp(cfg)
+	if err != nil {
+		return err
+	}
+
+	ti, err := a.manager.IssueAccessToken(context.Background(), &oauth2.TokenGenerateRequest{
+		ClientID:       *clientID,
+		UserID:         *user,
+		Scope:          *scope,
+		AccessTokenExp: *ttl,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to issue token to client %q", *clientID)
+	}
+
+	return printJSON(map[string]interface{}{
+		"access_token": ti.GetAccess(),
+		"token_type":   "Bearer",
+		"expires_in":   int64(ti.GetAccessExpiresIn() / time.Second),
+		"scope":        ti.GetScope(),
+	})
+}
+
+// tokenDecode prints the header and the claims of a token without verifying it.
+func tokenDecode(args []string) error {
+	fs := flag.NewFlagSet("token decode", flag.ExitOnError)
+	_ = fs.Parse(args)
+
+	raw, err := tokenArg(fs)
+	if err != nil {
+		return err
+	}
+
+	claims := jwt.MapClaims{}
+	token, _, err := new(jwt.Parser).ParseUnverified(raw, claims)
+	if err != nil {
+		return errors.Wrap(errors.WithStack(err), "failed to decode token")
+	}
+
+	return printJSON(map[string]interface{}{
+		"header": token.Header,
+		"claims": claims,
+	})
+}
+
+// tokenVerify verifies the signature and the claims of an access token, the way the resource servers do,
+// and prints its claims.
+//
+// The token is verified with the signing key of the config, or with the keys of a JWKS URL or file.
+func tokenVerify(args []string) error {
+	fs := flag.NewFlagSet("token verify", flag.ExitOnError)
+	configFiles := configFlag(fs)
+	jwks := fs.String("jwks", "", "JWKS URL or file verifying the token, instead of the signing key of the config")
+	issuer := fs.String("issuer", "", "required iss claim, with --jwks")
+	audience := fs.String("audience", "", "required aud claim, with --jwks")
+	_ = fs.Parse(args)
+
+	raw, err := tokenArg(fs)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var verifier *resource.Verifier
+	if *jwks != "" {
+		jwksCfg := resource.JWKSConfig{File: *jwks}
+		if strings.HasPrefix(*jwks, "http://") || strings.HasPrefix(*jwks, "https://") {
+			jwksCfg = resource.JWKSConfig{URL: *jwks}
+		}
+
+		keys, err := resource.NewJWKS(ctx, jwksCfg)
+		if err != nil {
+			return err
+		}
+
+		verifier = &resource.Verifier{Keys: keys, Issuer: *issuer, Audience: *audience}
+	} else {
+		cfg, err := loadConfig(*configFiles)
+		if err != nil {
+			return err
+		}
+
+		a, err := newApp(cfg)
+		if err != nil {
+			return err
+		}
+
+		verifier = a.manager.Verifier()
+	}
+
+	claims, err := verifier.Verify(ctx, raw)
+	if err != nil {
+		return err
+	}
+
+	return printJSON(claims)
+}
+
+// tokenArg returns the token of the first argument or, without arguments, of the first line of stdin.
+func tokenArg(fs *flag.FlagSet) (string, error) {
+	if fs.NArg() > 0 {
+		return strings.TrimSpace(fs.Arg(0)), nil
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", errors.Wrap(errors.WithStack(err), "failed to read token from stdin")
+	}
+
+	if line = strings.TrimSpace(line); line == "" {
+		return "", errors.New("token is missing, pass it as argument or on stdin")
+	}
+
+	return line, nil
+}
+
+// printJSON prints v as indented JSON.
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	return errors.WithStack(enc.Encode(v))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTokenIssueAndVerify(t *testing.T) {
+	tests := []struct {
+		name        string
+		prepare     func(t *testing.T, dir, path, token string) (args []string)
+		expectError bool
+	}{
+		{
+			name: "Token verified with the key of the config",
+			prepare: func(t *testing.T, dir, path, token string) []string {
+				return []string{"--config", path, token}
+			},
+		},
+		{
+			name: "Token verified with the exported JWKS",
+			prepare: func(t *testing.T, dir, path, token string) []string {
+				if _, err := runCommand(t, keysExportJWKS, "--config", path, "--out", dir+"/jwks.json"); err != nil {
+					t.Fatalf("could not export JWKS: %v\n", err)
+				}
+
+				return []string{"--jwks", dir + "/jwks.json", token}
+			},
+		},
+		{
+			name: "Token verified after a rotation with the previous key",
+			prepare: func(t *testing.T, dir, path, token string) []string {
+				if _, err := runCommand(t, keysRotate, "--config", path); err != nil {
+					t.Fatalf("could not rotate key: %v\n", err)
+				}
+
+				return []string{"--config", path, token}
+			},
+		},
+		{
+			name: "Token signed with another key is rejected",
+			prepare: func(t *testing.T, dir, path, token string) []string {
+				return []string{"--config", writeTestConfig(t, t.TempDir(), "RS256", "clients: []\n"), token}
+			},
+			expectError: true,
+		},
+		{
+			name: "Tampered token is rejected",
+			prepare: func(t *testing.T, dir, path, token string) []string {
+				return []string{"--config", path, token[:len(token)-4] + "AAAA"}
+			},
+			expectError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := writeTestConfig(t, dir, "RS256", "clients:\n  - id: svc\n    secret: svc_secret\n")
+
+			out, err := runCommand(t, tokenIssue, "--config", path, "--client-id", "svc", "--scope", "read", "--user", "alice")
+			if err != nil {
+				t.Fatalf("could not issue token: %v\n", err)
+			}
+
+			var resp struct {
+				AccessToken string `json:"access_token"`
+				TokenType   string `json:"token_type"`
+				Scope       string `json:"scope"`
+			}
+			if err := json.Unmarshal([]byte(out), &resp); err != nil {
+				t.Fatalf("could not decode token response %q: %v\n", out, err)
+			}
+
+			if resp.TokenType != "Bearer" || resp.Scope != "read" {
+				t.Errorf("got token type %q and scope %q but wanted Bearer and read\n", resp.TokenType, resp.Scope)
+			}
+
+			out, err = runCommand(t, tokenVerify, tt.prepare(t, dir, path, resp.AccessToken)...)
+			if tt.expectError != (err != nil) {
+				t.Fatalf("got error %v but wanted error %t\n", err, tt.expectError)
+			}
+
+			if tt.expectError {
+				return
+			}
+
+			var claims struct {
+				Subject string `json:"sub"`
+				Scope   string `json:"scope"`
+			}
+			if err := json.Unmarshal([]byte(out), &claims); err != nil {
+				t.Fatalf("could not decode claims %q: %v\n", out, err)
+			}
+
+			if claims.Subject != "alice" || claims.Scope != "read" {
+				t.Errorf("got claims %+v but wanted the subject alice and the scope read\n", claims)
+			}
+		})
+	}
+}
+
+func TestTokenIssueUnknownClient(t *testing.T) {
+	path := writeTestConfig(t, t.TempDir(), "RS256", "clients: []\n")
+
+	if _, err := runCommand(t, tokenIssue, "--config", path, "--client-id", "unknown"); err == nil {
+		t.Errorf("got no error but wanted the unknown client refused\n")
+	}
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"io"
 	golog "log"
 	"net/http"
@@ -12,7 +12,8 @@ import (
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 
-	"oauth2/internal/logger"
+	"github.com/laonix/oauth2/internal/logger"
+	"github.com/laonix/oauth2/pkg/client"
 )
 
 func main() {
@@ -48,45 +49,32 @@ func main() {
 		}
 	}
 
-	log.Info().Msg("1. Get access token")
-	req, err := http.NewRequest("POST", "http://localhost:3000/token?grant_type=client_credentials", nil)
-	if err != nil {
-		log.Fatal().Err(errors.WithStack(err)).Msg("failed to create request for retrieving access token")
+	clientCfg := &client.Config{
+		TokenURL:     "http://localhost:3000/token",
+		ClientID:     "client_id",
+		ClientSecret: "client_secret",
 	}
-	req.SetBasicAuth("client_id", "client_secret")
 
-	log.Info().Msg("Sending request to retrieve access token")
-	tokenRes, err := http.DefaultClient.Do(req)
+	log.Info().Msg("1. Get access token")
+	token, err := clientCfg.TokenSource(context.Background()).Token()
 	if err != nil {
-		log.Fatal().Err(errors.WithStack(err)).Msg("failed to retrieve access token")
-	}
-	defer tokenRes.Body.Close()
-
-	log.Info().Msg("Decoding access token response")
-	var tokenResp struct {
-		AccessToken string `json:"access_token"`
-		ExpiresIn   int    `json:"expires_in"`
-		TokenType   string `json:"token_type"`
-	}
-	if err := json.NewDecoder(tokenRes.Body).Decode(&tokenResp); err != nil {
-		log.Fatal().Err(errors.WithStack(err)).Msg("failed to decode access token response")
+		log.Fatal().Err(err).Msg("failed to retrieve access token")
 	}
 
 	log.Info().
-		Any("access_token", tokenResp.AccessToken).
-		Any("expires_in", tokenResp.ExpiresIn).
-		Any("token_type", tokenResp.TokenType).
+		Any("access_token", token.AccessToken).
+		Any("expiry", token.Expiry).
+		Any("token_type", token.TokenType).
 		Msg("access token retrieved")
 
 	log.Info().Msg("2. Validate access token")
-	req, err = http.NewRequest("POST", "http://localhost:3000/secure", nil)
+	req, err := http.NewRequest("POST", "http://localhost:3000/secure", nil)
 	if err != nil {
 		log.Fatal().Err(errors.WithStack(err)).Msg("failed to create request for validating access token")
 	}
-	req.Header.Set("Authorization", "Bearer "+tokenResp.AccessToken)
 
-	log.Info().Msg("Sending request to validate access token")
-	secureRes, err := http.DefaultClient.Do(req)
+	log.Info().Msg("Sending request to validate access token, with the token of the client")
+	secureRes, err := clientCfg.Client(context.Background()).Do(req)
 	if err != nil {
 		log.Fatal().Err(errors.WithStack(err)).Msg("failed to validate access token")
 	}
@@ -14,7 +14,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 
-	"oauth2/internal/logger"
+	"github.com/laonix/oauth2/internal/logger"
 )
 
 func main() {
@@ -1,54 +1,285 @@
 package config
 
 import (
-	"path/filepath"
-	"runtime"
-	"strings"
 	"time"
 
-	"github.com/pkg/errors"
-	"github.com/spf13/viper"
+	"github.com/laonix/oauth2/internal/keys"
 )
 
+// Modes of the server, see Config.Mode.
+const (
+	ModeDev  = "dev"
+	ModeProd = "prod"
+)
+
+// PreviousKeySuffix suffixes jwt.secret_file to name the file of the key replaced by the last rotation.
+const PreviousKeySuffix = ".previous"
+
+// Config is the config of the server.
+//
+// In Mode prod, the default, the config is refused if it has the development signing key or client secret
+// of config.yaml, or a signing key too weak for its algorithm.
 type Config struct {
+	Mode string `mapstructure:"mode"`
+
 	HTTP HTTP `mapstructure:"http"`
 	JWT  JWT  `mapstructure:"jwt"`
 	Log  Log  `mapstructure:"log"`
+
+	Tracing Tracing `mapstructure:"tracing"`
+	Admin   Admin   `mapstructure:"admin"`
+	Reload  Reload  `mapstructure:"reload"`
+
+	Clients     []Client `mapstructure:"clients"`
+	ClientsFile string   `mapstructure:"clients_file"`
+	Grants      Grants   `mapstructure:"grants"`
+
+	// sources are the sources of the values by key, see Sources.
+	sources map[string]string
+	// fileClients is the number of the last Clients, read from ClientsFile.
+	fileClients int
 }
 
+// Reload configures the reload of the config and clients files once changed, checked every Interval.
+//
+// The clients, token lifetimes and log level are reloaded, the other changes require a restart.
+// There are no rate limits to reload, the server has no rate limiter.
+// Without Interval the files are only reloaded on SIGHUP.
+type Reload struct {
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+// HTTP configures the http server.
+//
+// With TrustRequestID the request ID is taken from the X-Request-ID or traceparent header of the request, if well-formed.
+//
+// On shutdown the server reports not ready for PreStopDelay, for the traffic to stop, then waits up to DrainTimeout
+// for the in-flight requests to complete.
 type HTTP struct {
-	Port    string        `mapstructure:"port"`
-	Timeout time.Duration `mapstructure:"timeout"`
+	Port           string        `mapstructure:"port"`
+	Timeout        time.Duration `mapstructure:"timeout"`
+	TrustRequestID bool          `mapstructure:"trust_request_id"`
+	PreStopDelay   time.Duration `mapstructure:"pre_stop_delay"`
+	DrainTimeout   time.Duration `mapstructure:"drain_timeout"`
+	TLS            TLS           `mapstructure:"tls"`
+}
+
+// TLS configures the TLS of the http server.
+//
+// The certificate and key files are reloaded once changed, checked every ReloadInterval. MinVersion is 1.2 or 1.3.
+// CipherSuites are names of crypto/tls, applying to TLS 1.2 only; empty means the Go defaults.
+//
+// With PlainPort a plain-HTTP listener refuses the requests carrying credentials and, in PlainHTTP mode redirect,
+// redirects the other GET requests to HTTPS, or refuses them in mode refuse.
+type TLS struct {
+	Enabled        bool          `mapstructure:"enabled"`
+	CertFile       string        `mapstructure:"cert_file"`
+	KeyFile        string        `mapstructure:"key_file"`
+	MinVersion     string        `mapstructure:"min_version"`
+	CipherSuites   []string      `mapstructure:"cipher_suites"`
+	HTTP2          bool          `mapstructure:"http2"`
+	ReloadInterval time.Duration `mapstructure:"reload_interval"`
+	PlainPort      string        `mapstructure:"plain_port"`
+	PlainHTTP      string        `mapstructure:"plain_http"`
 }
 
+// JWT configures the access tokens.
+//
+// Algorithm is the JWS algorithm signing the tokens, HS256 by default. Secret is the HMAC secret of the HS* algorithms
+// or the PEM encoded private key of the others, read from SecretFile if set. Issuer is the iss claim of the tokens, if set.
+//
+// PreviousSecret is the private key replaced by the last rotation, read from PreviousSecretFile if set, else from the
+// SecretFile suffixed with PreviousKeySuffix if it exists and Algorithm isn't HMAC. The tokens it signed are verified until they expire.
 type JWT struct {
-	Secret               string        `mapstructure:"secret"`
-	AccessTokenExpiresIn time.Duration `mapstructure:"access_token_expires_in"`
+	Algorithm               string        `mapstructure:"algorithm"`
+	Issuer                  string        `mapstructure:"issuer"`
+	SecretFile              string        `mapstructure:"secret_file"`
+	Secret                  string        `mapstructure:"secret"`
+	PreviousSecretFile      string        `mapstructure:"previous_secret_file"`
+	PreviousSecret          string        `mapstructure:"previous_secret"`
+	AccessTokenExpiresIn    time.Duration `mapstructure:"access_token_expires_in"`
+	RefreshTokenExpiresIn   time.Duration `mapstructure:"refresh_token_expires_in"`
+	RefreshTokenMaxLifetime time.Duration `mapstructure:"refresh_token_max_lifetime"`
 }
 
+// Log configures the logs.
+//
+// Format is console or json. Output is stdout, stderr or the path of a file rotated once it reaches MaxSizeMB,
+// keeping MaxBackups rotated files. Fields are added to every log line.
 type Log struct {
-	Level int `mapstructure:"level"`
+	Level      int               `mapstructure:"level"`
+	Format     string            `mapstructure:"format"`
+	Output     string            `mapstructure:"output"`
+	MaxSizeMB  int               `mapstructure:"max_size_mb"`
+	MaxBackups int               `mapstructure:"max_backups"`
+	Fields     map[string]string `mapstructure:"fields"`
+	Access     AccessLog         `mapstructure:"access"`
+}
+
+// AccessLog configures the access log lines of the served requests.
+//
+// Headers are the request headers added to the access log. The values of the query parameters in RedactQuery
+// and of the headers in RedactHeaders are redacted, in addition to the credentials that are always redacted.
+type AccessLog struct {
+	Headers       []string `mapstructure:"headers"`
+	RedactQuery   []string `mapstructure:"redact_query"`
+	RedactHeaders []string `mapstructure:"redact_headers"`
+}
+
+// Admin configures the admin listener, which serves the metrics, pprof and the admin endpoints
+// on Address (host:port), apart from the listener facing the clients.
+//
+// The listener is disabled without Address, the admin endpoints are disabled without Token, read from TokenFile if set.
+type Admin struct {
+	Address   string `mapstructure:"address"`
+	Token     string `mapstructure:"token"`
+	TokenFile string `mapstructure:"token_file"`
+}
+
+// Tracing configures the export of the OpenTelemetry spans.
+//
+// Exporter is none, stdout or otlp. The otlp exporter sends the spans over HTTP to Endpoint (host:port).
+// SampleRatio is the ratio of the traces started by the server that are sampled.
+type Tracing struct {
+	Exporter    string  `mapstructure:"exporter"`
+	Endpoint    string  `mapstructure:"endpoint"`
+	Insecure    bool    `mapstructure:"insecure"`
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+}
+
+// Client is a client registered with the server.
+//
+// Public clients have no secret and identify themselves by their id. Refresh tokens are only issued
+// to clients with RefreshTokens enabled. The authorization code grant is only available to clients
+// with RedirectURIs, which are matched exactly. The secret is read from SecretFile if set, else resolved from
+// SecretRef, a secret reference of the form <scheme>:<ref>, see SecretProvider. The clients of the clients file
+// can't reference exec secrets. The Secret itself is always taken as is.
+//
+// Audience is the aud claim of the tokens issued to the client, the resource server they are meant for.
+// Without Audience it is the id of the client.
+type Client struct {
+	ID            string   `mapstructure:"id"`
+	Secret        string   `mapstructure:"secret"`
+	SecretFile    string   `mapstructure:"secret_file"`
+	SecretRef     string   `mapstructure:"secret_ref"`
+	Public        bool     `mapstructure:"public"`
+	RefreshTokens bool     `mapstructure:"refresh_tokens"`
+	RedirectURIs  []string `mapstructure:"redirect_uris"`
+	Audience      string   `mapstructure:"audience"`
+}
+
+// Grants holds the settings of the extension grants served by the token endpoint.
+type Grants struct {
+	AuthorizationCode AuthorizationCode `mapstructure:"authorization_code"`
+	DeviceCode        DeviceCode        `mapstructure:"device_code"`
+	JWTBearer         JWTBearer         `mapstructure:"jwt_bearer"`
+	TokenExchange     TokenExchange     `mapstructure:"token_exchange"`
+}
+
+// AuthorizationCode configures the authorization code grant.
+//
+// Users are authenticated by the proxy in front of the /authorize endpoint, which passes the id of the user
+// in UserHeader. Without UserHeader every authorization request is denied.
+type AuthorizationCode struct {
+	CodeExpiresIn time.Duration `mapstructure:"code_expires_in"`
+	UserHeader    string        `mapstructure:"user_header"`
+}
+
+// DeviceCode configures the device authorization grant (RFC 8628).
+//
+// VerificationURI is the absolute URL of the /device endpoint, where users approve the user codes shown by their devices.
+type DeviceCode struct {
+	VerificationURI string        `mapstructure:"verification_uri"`
+	ExpiresIn       time.Duration `mapstructure:"expires_in"`
+	Interval        time.Duration `mapstructure:"interval"`
+}
+
+// JWTBearer configures the JWT bearer assertion grant (RFC 7523 section 2.1).
+type JWTBearer struct {
+	Issuers []TrustedIssuer `mapstructure:"issuers"`
+}
+
+// TrustedIssuer is an issuer whose signed JWTs are accepted as authorization grants.
+//
+// Its keys are taken from PublicKeys (PEM encoded) and from the JWKS file, if any.
+// An assertion is exchanged for a token of the client mapped to the value of its SubjectClaim.
+type TrustedIssuer struct {
+	Issuer       string          `mapstructure:"issuer"`
+	Audience     string          `mapstructure:"audience"`
+	PublicKeys   []string        `mapstructure:"public_keys"`
+	JWKSFile     string          `mapstructure:"jwks_file"`
+	SubjectClaim string          `mapstructure:"subject_claim"`
+	Clients      []SubjectClient `mapstructure:"clients"`
+}
+
+// SubjectClient maps the subject of an assertion to a client.
+type SubjectClient struct {
+	Subject  string `mapstructure:"subject"`
+	ClientID string `mapstructure:"client_id"`
+}
+
+// TokenExchange configures the token exchange grant (RFC 8693).
+//
+// Only the clients listed in Policies may exchange tokens.
+type TokenExchange struct {
+	Policies []ExchangePolicy `mapstructure:"policies"`
+}
+
+// ExchangePolicy restricts the tokens a client may obtain by token exchange.
+//
+// Audiences and Scopes list what may be requested. A client allowed to impersonate gets
+// tokens without the act claim when it doesn't present an actor token.
+type ExchangePolicy struct {
+	ClientID      string   `mapstructure:"client_id"`
+	Audiences     []string `mapstructure:"audiences"`
+	Scopes        []string `mapstructure:"scopes"`
+	Impersonation bool     `mapstructure:"impersonation"`
 }
 
-func LoadConfig() (*Config, error) {
-	_, path, _, _ := runtime.Caller(0)
-	root := filepath.Join(filepath.Dir(path), "../..")
+// RedactedSecret is the value of the secrets without fingerprint in a redacted config.
+const RedactedSecret = "REDACTED"
 
-	viper.AddConfigPath(root)
-	viper.SetConfigName("config")
-	viper.SetConfigType("yaml")
+// Redacted returns a copy of the config with the secrets replaced by their fingerprints.
+//
+// The signing key is replaced by its key ID, or by RedactedSecret for an HMAC secret, see keys.SigningKeyFingerprint.
+// The other secrets are replaced by their fingerprint keyed by the signing key, see keys.SecretFingerprint.
+func (c *Config) Redacted() *Config {
+	redacted := *c
 
-	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-	viper.AutomaticEnv()
+	redacted.JWT.Secret = ""
+	if c.JWT.Secret != "" {
+		redacted.JWT.Secret = RedactedSecret
+		if fingerprint, ok := keys.SigningKeyFingerprint(c.JWT.Algorithm, []byte(c.JWT.Secret)); ok {
+			redacted.JWT.Secret = fingerprint
+		}
+	}
 
-	if err := viper.ReadInConfig(); err != nil {
-		return nil, errors.Wrap(errors.WithStack(err), "failed to read config")
+	if c.JWT.PreviousSecret != "" {
+		redacted.JWT.PreviousSecret = RedactedSecret
+		if fingerprint, ok := keys.SigningKeyFingerprint(c.JWT.Algorithm, []byte(c.JWT.PreviousSecret)); ok {
+			redacted.JWT.PreviousSecret = fingerprint
+		}
 	}
 
-	var config Config
-	if err := viper.Unmarshal(&config); err != nil {
-		return nil, errors.Wrap(errors.WithStack(err), "failed to unmarshal config")
+	redacted.Admin.Token = c.redact(c.Admin.Token)
+
+	redacted.Clients = make([]Client, len(c.Clients))
+	for i, cli := range c.Clients {
+		cli.Secret = c.redact(cli.Secret)
+		redacted.Clients[i] = cli
 	}
 
-	return &config, nil
+	return &redacted
+}
+
+// redact returns the fingerprint of the secret, keyed by the signing key.
+func (c *Config) redact(secret string) string {
+	switch {
+	case secret == "":
+		return ""
+	case c.JWT.Secret == "":
+		return RedactedSecret
+	default:
+		return keys.SecretFingerprint(keys.FingerprintKey([]byte(c.JWT.Secret)), []byte(secret))
+	}
 }
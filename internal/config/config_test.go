@@ -0,0 +1,71 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/laonix/oauth2/internal/keys"
+)
+
+func TestRedacted(t *testing.T) {
+	rsaKey, err := keys.GenerateSigningKey("RS256")
+	if err != nil {
+		t.Fatalf("could not generate key: %v\n", err)
+	}
+
+	tests := []struct {
+		name                 string
+		algorithm            string
+		secret               string
+		expectedSecretPrefix string
+	}{
+		{
+			name:                 "Key with a public key is replaced by its key ID",
+			algorithm:            "RS256",
+			secret:               string(rsaKey),
+			expectedSecretPrefix: "kid:",
+		},
+		{
+			name:                 "HMAC secret has no fingerprint",
+			algorithm:            "HS256",
+			secret:               testSecret,
+			expectedSecretPrefix: RedactedSecret,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				JWT:     JWT{Algorithm: tt.algorithm, Secret: tt.secret},
+				Admin:   Admin{Token: "admin"},
+				Clients: []Client{{ID: "a", Secret: "client_secret"}, {ID: "b", Public: true}},
+			}
+
+			redacted := cfg.Redacted()
+
+			if !strings.HasPrefix(redacted.JWT.Secret, tt.expectedSecretPrefix) {
+				t.Errorf("got signing key %q but wanted prefix %q\n", redacted.JWT.Secret, tt.expectedSecretPrefix)
+			}
+
+			fingerprintKey := keys.FingerprintKey([]byte(tt.secret))
+			if expected := keys.SecretFingerprint(fingerprintKey, []byte("client_secret")); redacted.Clients[0].Secret != expected {
+				t.Errorf("got client secret %q but wanted %q\n", redacted.Clients[0].Secret, expected)
+			}
+
+			// the fingerprint depends on the signing key, it isn't a plain hash of the secret
+			otherKey := keys.FingerprintKey([]byte(tt.secret + "other"))
+			if redacted.Admin.Token == keys.SecretFingerprint(otherKey, []byte("admin")) || !strings.HasPrefix(redacted.Admin.Token, "hmac-sha256:") {
+				t.Errorf("got admin token %q but wanted a fingerprint keyed by the signing key\n", redacted.Admin.Token)
+			}
+
+			if redacted.Clients[1].Secret != "" || cfg.Clients[0].Secret != "client_secret" {
+				t.Errorf("got secrets %q and %q but wanted the public client without secret and the config untouched\n",
+					redacted.Clients[1].Secret, cfg.Clients[0].Secret)
+			}
+		})
+	}
+
+	cfg := &Config{Admin: Admin{Token: "admin"}}
+	if token := cfg.Redacted().Admin.Token; token != RedactedSecret {
+		t.Errorf("without signing key: got admin token %q but wanted %q\n", token, RedactedSecret)
+	}
+}
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Sources of the config values.
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+)
+
+// Formats of the effective config.
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+)
+
+// Effective is the effective config, as the server runs with it, along with the source of its values.
+type Effective struct {
+	Config  map[string]interface{} `json:"config"`
+	Sources map[string]string      `json:"sources"`
+}
+
+// Sources returns the source of the value of every key, e.g. "env JWT_SECRET" or "file config.yaml".
+//
+// The keys of the clients list are reported as a whole, under the clients key. The source of a secret read from
+// a file or resolved by a secret provider is reported under its own key, e.g. clients[0].secret.
+func (c *Config) Sources() map[string]string {
+	sources := make(map[string]string, len(c.sources))
+	for key, source := range c.sources {
+		sources[key] = source
+	}
+
+	return sources
+}
+
+// Dump returns the effective config in the format, yaml or json, with its secrets redacted.
+//
+// The YAML format annotates every value with its source as a line comment. The JSON format
+// is an Effective, its sources being the ones of Sources.
+func (c *Config) Dump(format string) ([]byte, error) {
+	redacted := reflect.ValueOf(c.Redacted()).Elem()
+
+	switch format {
+	case FormatYAML:
+		node := yamlNode(redacted, "", c.sources)
+
+		var b strings.Builder
+		enc := yaml.NewEncoder(&b)
+		enc.SetIndent(2)
+		if err := enc.Encode(node); err != nil {
+			return nil, errors.Wrap(errors.WithStack(err), "failed to encode config")
+		}
+
+		return []byte(b.String()), nil
+	case FormatJSON:
+		data, err := json.MarshalIndent(&Effective{
+			Config:  jsonValue(redacted).(map[string]interface{}),
+			Sources: c.Sources(),
+		}, "", "  ")
+		if err != nil {
+			return nil, errors.Wrap(errors.WithStack(err), "failed to encode config")
+		}
+
+		return data, nil
+	default:
+		return nil, errors.Errorf("unsupported format %q, expected yaml or json", format)
+	}
+}
+
+// configFields calls fn with the key and value of every field of the config struct v, in order.
+func configFields(v reflect.Value, fn func(key string, value reflect.Value)) {
+	for i := 0; i < v.NumField(); i++ {
+		if key := v.Type().Field(i).Tag.Get("mapstructure"); key != "" {
+			fn(key, v.Field(i))
+		}
+	}
+}
+
+// jsonValue returns v as a value marshaled to JSON with the config keys.
+func jsonValue(v reflect.Value) interface{} {
+	if d, ok := v.Interface().(time.Duration); ok {
+		return d.String()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		m := make(map[string]interface{})
+		configFields(v, func(key string, value reflect.Value) {
+			m[key] = jsonValue(value)
+		})
+
+		return m
+	case reflect.Slice:
+		s := make([]interface{}, v.Len())
+		for i := range s {
+			s[i] = jsonValue(v.Index(i))
+		}
+
+		return s
+	default:
+		return v.Interface()
+	}
+}
+
+// yamlNode returns v as a YAML node with the config keys, annotated with the sources of the values.
+func yamlNode(v reflect.Value, path string, sources map[string]string) *yaml.Node {
+	if d, ok := v.Interface().(time.Duration); ok {
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: d.String()}
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		node := &yaml.Node{Kind: yaml.MappingNode}
+		configFields(v, func(key string, value reflect.Value) {
+			if path != "" {
+				key = path + "." + key
+			}
+
+			keyNode := &yaml.Node{Kind: yaml.ScalarNode, Value: key[strings.LastIndex(key, ".")+1:]}
+			valueNode := yamlNode(value, key, sources)
+
+			// the comment of a block value goes on its key, the value spanning several lines
+			if source, ok := sources[key]; ok {
+				if valueNode.Kind == yaml.ScalarNode || valueNode.Style == yaml.FlowStyle || len(valueNode.Content) == 0 {
+					valueNode.LineComment = source
+				} else {
+					keyNode.LineComment = source
+				}
+			}
+
+			node.Content = append(node.Content, keyNode, valueNode)
+		})
+
+		return node
+	case reflect.Slice:
+		node := &yaml.Node{Kind: yaml.SequenceNode}
+		if v.Type().Elem().Kind() != reflect.Struct {
+			node.Style = yaml.FlowStyle
+		}
+
+		for i := 0; i < v.Len(); i++ {
+			node.Content = append(node.Content, yamlNode(v.Index(i), fmt.Sprintf("%s[%d]", path, i), sources))
+		}
+
+		return node
+	default:
+		node := &yaml.Node{}
+		if err := node.Encode(v.Interface()); err != nil {
+			return &yaml.Node{Kind: yaml.ScalarNode, Value: fmt.Sprint(v.Interface())}
+		}
+
+		return node
+	}
+}
@@ -0,0 +1,298 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// EnvConfigFiles is the environment variable listing the config files, separated by commas, when no file is given by flag.
+const EnvConfigFiles = "OAUTH2_CONFIG"
+
+// SearchPaths are the directories searched, in order, for a config.yaml file when no file is given by flag or env.
+var SearchPaths = []string{".", "/etc/oauth2"}
+
+// defaults are the values of the keys missing from the config files.
+//
+// Every key is listed, as viper only overrides the known keys by environment variables.
+// The secrets, jwt.secret and admin.token, and the clients have no default. The mode is prod unless set to dev.
+var defaults = map[string]interface{}{
+	"mode": ModeProd,
+
+	"log.level":                 1,
+	"log.format":                "console",
+	"log.output":                "stdout",
+	"log.max_size_mb":           100,
+	"log.max_backups":           3,
+	"log.fields":                map[string]string{},
+	"log.access.headers":        []string{"X-Forwarded-For", "Referer"},
+	"log.access.redact_query":   []string{},
+	"log.access.redact_headers": []string{},
+
+	"http.port":                "3000",
+	"http.timeout":             "2m",
+	"http.trust_request_id":    false,
+	"http.pre_stop_delay":      "5s",
+	"http.drain_timeout":       "20s",
+	"http.tls.enabled":         false,
+	"http.tls.cert_file":       "/etc/oauth2/tls/tls.crt",
+	"http.tls.key_file":        "/etc/oauth2/tls/tls.key",
+	"http.tls.min_version":     "1.2",
+	"http.tls.cipher_suites":   []string{},
+	"http.tls.http2":           true,
+	"http.tls.reload_interval": "10s",
+	"http.tls.plain_port":      "",
+	"http.tls.plain_http":      "redirect",
+
+	"admin.address":    "127.0.0.1:9090",
+	"admin.token":      "",
+	"admin.token_file": "",
+
+	"tracing.exporter":     "none",
+	"tracing.endpoint":     "localhost:4318",
+	"tracing.insecure":     false,
+	"tracing.sample_ratio": 1,
+
+	"reload.interval": "10s",
+
+	"clients":      []interface{}{},
+	"clients_file": "",
+
+	"grants.authorization_code.code_expires_in": "1m",
+	"grants.authorization_code.user_header":     "",
+	"grants.device_code.verification_uri":       "http://localhost:3000/device",
+	"grants.device_code.expires_in":             "10m",
+	"grants.device_code.interval":               "5s",
+	"grants.jwt_bearer.issuers":                 []interface{}{},
+	"grants.token_exchange.policies":            []interface{}{},
+
+	"jwt.algorithm":                  "HS256",
+	"jwt.issuer":                     "",
+	"jwt.secret":                     "",
+	"jwt.secret_file":                "",
+	"jwt.previous_secret":            "",
+	"jwt.previous_secret_file":       "",
+	"jwt.access_token_expires_in":    "2h",
+	"jwt.refresh_token_expires_in":   "24h",
+	"jwt.refresh_token_max_lifetime": "720h",
+}
+
+// Locate returns the config files to load.
+//
+// They are the files given, else the files of the OAUTH2_CONFIG environment variable, else the first config.yaml
+// found in SearchPaths. Without any, no file is returned and the config comes from the defaults and env alone.
+func Locate(files []string) []string {
+	if len(files) > 0 {
+		return files
+	}
+
+	if env := os.Getenv(EnvConfigFiles); env != "" {
+		for _, file := range strings.Split(env, ",") {
+			if file = strings.TrimSpace(file); file != "" {
+				files = append(files, file)
+			}
+		}
+
+		return files
+	}
+
+	for _, dir := range SearchPaths {
+		file := filepath.Join(dir, "config.yaml")
+		if _, err := os.Stat(file); err == nil {
+			return []string{file}
+		}
+	}
+
+	return nil
+}
+
+// LoadConfig loads the config from the files, in order, over the defaults.
+//
+// The clients of the clients file, if any, are added to the clients of the config.
+//
+// Every file after the first one is an overlay: its keys override the keys of the files before it, e.g. base.yaml
+// then prod.yaml. Maps are merged key by key, lists are replaced. Environment variables override the files,
+// a key such as jwt.secret being read from JWT_SECRET. The secrets are then resolved, see SecretProvider.
+func LoadConfig(files ...string) (*Config, error) {
+	v := viper.New()
+	for key, value := range defaults {
+		v.SetDefault(key, value)
+	}
+
+	v.SetConfigType("yaml")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+
+	// every file is also read on its own, to find the file the value of a key comes from
+	fileVipers := make([]*viper.Viper, len(files))
+	for i, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(errors.WithStack(err), "failed to open config file")
+		}
+
+		if err := v.MergeConfig(bytes.NewReader(data)); err != nil {
+			return nil, errors.Wrapf(errors.WithStack(err), "failed to read config file %s", file)
+		}
+
+		fileVipers[i] = viper.New()
+		fileVipers[i].SetConfigType("yaml")
+		_ = fileVipers[i].ReadConfig(bytes.NewReader(data))
+	}
+
+	var config Config
+	problems, err := unmarshal(v, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	config.sources = sourcesOf(v, files, fileVipers)
+
+	if config.ClientsFile != "" {
+		clients, clientsProblems, err := loadClientsFile(config.ClientsFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Clients = append(config.Clients, clients...)
+		config.fileClients = len(clients)
+		problems = append(problems, clientsProblems...)
+
+		config.sources["clients"] += ", " + SourceFile + " " + config.ClientsFile
+	}
+
+	vd := &validator{problems: problems}
+	config.resolveSecrets(context.Background(), vd)
+	config.validate(vd)
+	if err := vd.err(); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// sourcesOf returns the source of the value of every key of v: the environment variable, else the last file
+// setting it, else the defaults.
+func sourcesOf(v *viper.Viper, files []string, fileVipers []*viper.Viper) map[string]string {
+	replacer := strings.NewReplacer(".", "_")
+
+	sources := make(map[string]string)
+	for _, key := range v.AllKeys() {
+		sources[key] = SourceDefault
+
+		if env := strings.ToUpper(replacer.Replace(key)); os.Getenv(env) != "" {
+			sources[key] = SourceEnv + " " + env
+
+			continue
+		}
+
+		for i := len(files) - 1; i >= 0; i-- {
+			if fileVipers[i].InConfig(key) {
+				sources[key] = SourceFile + " " + files[i]
+
+				break
+			}
+		}
+	}
+
+	return sources
+}
+
+// loadClientsFile loads the clients of the clients file, a YAML file with a clients list like the one of the config.
+//
+// Its problems are reported at the clients_file path.
+func loadClientsFile(file string) ([]Client, []Problem, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	v.SetConfigType("yaml")
+
+	if err := v.ReadInConfig(); err != nil {
+		return nil, nil, errors.Wrapf(errors.WithStack(err), "failed to read clients file %s", file)
+	}
+
+	var clients struct {
+		Clients []Client `mapstructure:"clients"`
+	}
+
+	err := v.Unmarshal(&clients, func(dc *mapstructure.DecoderConfig) {
+		dc.ErrorUnused = true
+	})
+
+	if err == nil {
+		return clients.Clients, nil, nil
+	}
+
+	var decodeErr *mapstructure.Error
+	if !errors.As(err, &decodeErr) {
+		return nil, nil, errors.Wrap(errors.WithStack(err), "failed to unmarshal clients file")
+	}
+
+	var problems []Problem
+	for _, msg := range decodeErr.Errors {
+		for _, p := range decodeProblems(msg) {
+			problems = append(problems, Problem{Path: "clients_file", Message: p.String()})
+		}
+	}
+
+	return clients.Clients, problems, nil
+}
+
+// unmarshal decodes the config, reporting the unknown keys and the values of the wrong type as problems.
+func unmarshal(v *viper.Viper, config *Config) ([]Problem, error) {
+	err := v.Unmarshal(config, func(dc *mapstructure.DecoderConfig) {
+		dc.ErrorUnused = true
+	})
+
+	if err == nil {
+		return nil, nil
+	}
+
+	var decodeErr *mapstructure.Error
+	if !errors.As(err, &decodeErr) {
+		return nil, errors.Wrap(errors.WithStack(err), "failed to unmarshal config")
+	}
+
+	var problems []Problem
+	for _, msg := range decodeErr.Errors {
+		problems = append(problems, decodeProblems(msg)...)
+	}
+
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Path < problems[j].Path })
+
+	return problems, nil
+}
+
+// decodeProblems turns a mapstructure error message, e.g. "'http' has invalid keys: prot" or
+// "error decoding 'http.timeout': time: invalid duration", into problems.
+func decodeProblems(msg string) []Problem {
+	if start := strings.Index(msg, "'"); start >= 0 {
+		if end := strings.Index(msg[start+1:], "'"); end >= 0 {
+			path := msg[start+1 : start+1+end]
+			rest := strings.TrimPrefix(strings.TrimSpace(msg[start+end+2:]), ": ")
+
+			if unknown, ok := strings.CutPrefix(rest, "has invalid keys: "); ok {
+				var problems []Problem
+				for _, key := range strings.Split(unknown, ", ") {
+					if path != "" {
+						key = path + "." + key
+					}
+
+					problems = append(problems, Problem{Path: key, Message: "unknown key"})
+				}
+
+				return problems
+			}
+
+			return []Problem{{Path: path, Message: rest}}
+		}
+	}
+
+	return []Problem{{Message: msg}}
+}
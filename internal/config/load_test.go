@@ -0,0 +1,164 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testSecret is an HS256 secret strong enough for prod mode.
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+// writeFile writes the file in dir and returns its path.
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("could not write %s: %v\n", name, err)
+	}
+
+	return path
+}
+
+func TestLocate(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "config.yaml", "mode: dev\n")
+
+	tests := []struct {
+		name          string
+		files         []string
+		env           string
+		searchPaths   []string
+		expectedFiles []string
+	}{
+		{
+			name:          "Flag takes precedence over env and search paths",
+			files:         []string{"flag.yaml"},
+			env:           "env.yaml",
+			searchPaths:   []string{dir},
+			expectedFiles: []string{"flag.yaml"},
+		},
+		{
+			name:          "Env takes precedence over search paths",
+			env:           " base.yaml, ,prod.yaml ",
+			searchPaths:   []string{dir},
+			expectedFiles: []string{"base.yaml", "prod.yaml"},
+		},
+		{
+			name:          "First config.yaml of the search paths",
+			searchPaths:   []string{t.TempDir(), dir},
+			expectedFiles: []string{filepath.Join(dir, "config.yaml")},
+		},
+		{
+			name:          "No config file",
+			searchPaths:   []string{t.TempDir()},
+			expectedFiles: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(EnvConfigFiles, tt.env)
+
+			searchPaths := SearchPaths
+			SearchPaths = tt.searchPaths
+			defer func() { SearchPaths = searchPaths }()
+
+			if files := Locate(tt.files); !slices.Equal(files, tt.expectedFiles) {
+				t.Errorf("got files %q but wanted %q\n", files, tt.expectedFiles)
+			}
+		})
+	}
+}
+
+func TestLoadConfigOverlays(t *testing.T) {
+	dir := t.TempDir()
+
+	base := writeFile(t, dir, "base.yaml", `
+mode: dev
+http:
+  port: "3000"
+  timeout: 1m
+log:
+  fields:
+    team: identity
+    region: eu
+clients:
+  - id: base
+    secret: base_secret
+jwt:
+  secret: `+testSecret+`
+`)
+
+	overlay := writeFile(t, dir, "prod.yaml", `
+http:
+  port: "4000"
+log:
+  fields:
+    region: us
+clients:
+  - id: prod
+    secret: prod_secret
+`)
+
+	cfg, err := LoadConfig(base, overlay)
+	if err != nil {
+		t.Fatalf("could not load config: %v\n", err)
+	}
+
+	if cfg.HTTP.Port != "4000" || cfg.HTTP.Timeout.String() != "1m0s" {
+		t.Errorf("got port %q and timeout %s but wanted the port of the overlay and the timeout of the base\n",
+			cfg.HTTP.Port, cfg.HTTP.Timeout)
+	}
+
+	if cfg.Log.Fields["team"] != "identity" || cfg.Log.Fields["region"] != "us" {
+		t.Errorf("got log fields %v but wanted the maps merged key by key\n", cfg.Log.Fields)
+	}
+
+	if len(cfg.Clients) != 1 || cfg.Clients[0].ID != "prod" {
+		t.Errorf("got clients %+v but wanted the list of the overlay\n", cfg.Clients)
+	}
+
+	sources := cfg.Sources()
+	for key, source := range map[string]string{
+		"http.port":    SourceFile + " " + overlay,
+		"http.timeout": SourceFile + " " + base,
+		"log.format":   SourceDefault,
+	} {
+		if sources[key] != source {
+			t.Errorf("got source %q of %s but wanted %q\n", sources[key], key, source)
+		}
+	}
+}
+
+func TestLoadConfigDefaultsAndEnv(t *testing.T) {
+	t.Setenv("MODE", ModeDev)
+	t.Setenv("JWT_SECRET", testSecret)
+	t.Setenv("HTTP_PORT", "8080")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("could not load config: %v\n", err)
+	}
+
+	if cfg.HTTP.Port != "8080" || cfg.JWT.Secret != testSecret || cfg.Mode != ModeDev {
+		t.Errorf("got port %q, secret %q and mode %q but wanted the values of the env\n", cfg.HTTP.Port, cfg.JWT.Secret, cfg.Mode)
+	}
+
+	if cfg.JWT.Algorithm != "HS256" || cfg.HTTP.TLS.MinVersion != "1.2" || len(cfg.Clients) != 0 {
+		t.Errorf("got algorithm %q, min TLS version %q and clients %v but wanted the defaults\n",
+			cfg.JWT.Algorithm, cfg.HTTP.TLS.MinVersion, cfg.Clients)
+	}
+
+	sources := cfg.Sources()
+	if !strings.HasPrefix(sources["http.port"], SourceEnv) || sources["jwt.algorithm"] != SourceDefault {
+		t.Errorf("got sources %q and %q but wanted env and default\n", sources["http.port"], sources["jwt.algorithm"])
+	}
+
+	// without env, the defaults alone lack the signing key
+	t.Setenv("JWT_SECRET", "")
+
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "jwt.secret: must be set") {
+		t.Errorf("got error %v but wanted jwt.secret to be required\n", err)
+	}
+}
@@ -0,0 +1,218 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// execTimeout bounds the run of the command of an exec secret reference.
+const execTimeout = 10 * time.Second
+
+// SecretProvider resolves the secret references of a scheme.
+//
+// A secret value of the form <scheme>:<ref>, e.g. file:/etc/oauth2/jwt.key, is resolved by the provider
+// registered for the scheme, with ref as argument.
+type SecretProvider interface {
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+// SecretProviderFunc is a function resolving secret references.
+type SecretProviderFunc func(ctx context.Context, ref string) (string, error)
+
+func (f SecretProviderFunc) Resolve(ctx context.Context, ref string) (string, error) {
+	return f(ctx, ref)
+}
+
+var (
+	secretProvidersMu sync.RWMutex
+	secretProviders   = map[string]SecretProvider{
+		"env":  SecretProviderFunc(envSecret),
+		"file": SecretProviderFunc(fileSecret),
+		"exec": SecretProviderFunc(execSecret),
+	}
+)
+
+// RegisterSecretProvider registers the provider of the secret references of the scheme, replacing any other.
+func RegisterSecretProvider(scheme string, provider SecretProvider) {
+	secretProvidersMu.Lock()
+	defer secretProvidersMu.Unlock()
+
+	secretProviders[scheme] = provider
+}
+
+// secretProvider returns the provider registered for the scheme.
+func secretProvider(scheme string) (SecretProvider, bool) {
+	secretProvidersMu.RLock()
+	defer secretProvidersMu.RUnlock()
+
+	provider, ok := secretProviders[scheme]
+
+	return provider, ok
+}
+
+// envSecret reads the secret from the environment variable named ref.
+func envSecret(_ context.Context, ref string) (string, error) {
+	secret, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", errors.Errorf("environment variable %s is not set", ref)
+	}
+
+	return secret, nil
+}
+
+// fileSecret reads the secret from the file at ref, without its trailing newline.
+func fileSecret(_ context.Context, ref string) (string, error) {
+	data, err := os.ReadFile(ref)
+	if err != nil {
+		return "", errors.Wrap(errors.WithStack(err), "failed to read secret file")
+	}
+
+	return trimNewline(string(data)), nil
+}
+
+// execSecret runs the command of ref, split on spaces and without shell, and reads the secret from its output,
+// without its trailing newline.
+func execSecret(ctx context.Context, ref string) (string, error) {
+	args := strings.Fields(ref)
+	if len(args) == 0 {
+		return "", errors.New("no command")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, execTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(errors.WithStack(err), "command %s failed: %s", args[0], strings.TrimSpace(stderr.String()))
+	}
+
+	return trimNewline(string(out)), nil
+}
+
+func trimNewline(s string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(s, "\n"), "\r")
+}
+
+// resolveSecrets resolves every secret of the config, from its *_file key or its secret reference.
+//
+// The secret references of the clients are their secret_ref, never their secret: a client secret is taken as is,
+// whatever its prefix, and the clients file, written at runtime, can't run commands.
+func (c *Config) resolveSecrets(ctx context.Context, v *validator) {
+	c.secret(ctx, v, "jwt.secret", &c.JWT.Secret, c.JWT.SecretFile)
+
+	// the key kept by oauth2 keys rotate is picked up next to the signing key, HMAC secrets have none
+	if c.JWT.PreviousSecretFile == "" && c.JWT.SecretFile != "" && !strings.HasPrefix(c.JWT.Algorithm, "HS") {
+		if _, err := os.Stat(c.JWT.SecretFile + PreviousKeySuffix); err == nil {
+			c.JWT.PreviousSecretFile = c.JWT.SecretFile + PreviousKeySuffix
+		}
+	}
+
+	c.secret(ctx, v, "jwt.previous_secret", &c.JWT.PreviousSecret, c.JWT.PreviousSecretFile)
+	c.secret(ctx, v, "admin.token", &c.Admin.Token, c.Admin.TokenFile)
+
+	for i := range c.Clients {
+		cli := &c.Clients[i]
+		path := fmt.Sprintf("clients[%d].secret", i)
+
+		switch {
+		case cli.SecretFile != "":
+			c.secretFile(v, path, &cli.Secret, cli.SecretFile)
+		case cli.SecretRef != "":
+			c.clientSecretRef(ctx, v, path, cli, i >= len(c.Clients)-c.fileClients)
+		}
+	}
+}
+
+// secret resolves the secret at path: it is read from file, if any, else resolved by the provider of its scheme.
+// Secrets without a registered scheme are kept as they are.
+//
+// The file takes precedence over the secret, so that JWT_SECRET_FILE overrides the secret of a config file.
+func (c *Config) secret(ctx context.Context, v *validator, path string, secret *string, file string) {
+	if file != "" {
+		c.secretFile(v, path, secret, file)
+
+		return
+	}
+
+	scheme, _, ok := strings.Cut(*secret, ":")
+	if !ok {
+		return
+	}
+
+	if _, ok := secretProvider(scheme); !ok {
+		return
+	}
+
+	c.resolveSecret(ctx, v, path, path, *secret, secret)
+}
+
+// clientSecretRef resolves the secret_ref of the client at path into its secret.
+//
+// Its scheme must be registered, and the clients of the clients file can't reference exec secrets.
+func (c *Config) clientSecretRef(ctx context.Context, v *validator, path string, cli *Client, fromFile bool) {
+	refPath := path + "_ref"
+
+	if cli.Secret != "" {
+		v.addf(refPath, "must be empty with a secret")
+
+		return
+	}
+
+	scheme, _, _ := strings.Cut(cli.SecretRef, ":")
+
+	switch _, ok := secretProvider(scheme); {
+	case !ok:
+		v.addf(refPath, "unknown secret provider %q", scheme)
+	case scheme == "exec" && fromFile:
+		v.addf(refPath, "exec secrets can't be referenced by the clients of clients_file")
+	default:
+		c.resolveSecret(ctx, v, path, refPath, cli.SecretRef, &cli.Secret)
+	}
+}
+
+// secretFile reads the secret at path from file.
+func (c *Config) secretFile(v *validator, path string, secret *string, file string) {
+	resolved, err := fileSecret(context.Background(), file)
+	if err != nil {
+		v.addf(path+"_file", "%s", err)
+
+		return
+	}
+
+	*secret = resolved
+	c.sources[path] = SourceFile + " " + file
+}
+
+// resolveSecret resolves the secret at path from its reference, <scheme>:<ref>, with the registered provider
+// of its scheme, reporting the problems at refPath.
+func (c *Config) resolveSecret(ctx context.Context, v *validator, path, refPath, reference string, secret *string) {
+	scheme, ref, _ := strings.Cut(reference, ":")
+	provider, _ := secretProvider(scheme)
+
+	resolved, err := provider.Resolve(ctx, ref)
+	if err != nil {
+		v.addf(refPath, "failed to resolve %s secret: %s", scheme, err)
+
+		return
+	}
+
+	*secret = resolved
+
+	if source := c.sources[path]; source != "" {
+		c.sources[path] = source + ", " + scheme + " provider"
+	} else {
+		c.sources[path] = scheme + " provider"
+	}
+}
@@ -0,0 +1,363 @@
+package config
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/laonix/oauth2/internal/keys"
+)
+
+func TestResolveSecrets(t *testing.T) {
+	RegisterSecretProvider("vault", SecretProviderFunc(func(ctx context.Context, ref string) (string, error) {
+		if ref != "secret/oauth2#jwt" {
+			return "", errors.Errorf("no secret at %s", ref)
+		}
+
+		return testSecret + "-vault", nil
+	}))
+
+	tests := []struct {
+		name            string
+		prepare         func(t *testing.T, dir string) (secret, secretFile string)
+		expectedSecret  string
+		expectedSource  string
+		expectedProblem string
+	}{
+		{
+			name: "Plain secret",
+			prepare: func(t *testing.T, dir string) (string, string) {
+				return testSecret, ""
+			},
+			expectedSecret: testSecret,
+			expectedSource: SourceEnv + " JWT_SECRET",
+		},
+		{
+			name: "Secret file takes precedence over the secret",
+			prepare: func(t *testing.T, dir string) (string, string) {
+				return "env:UNSET_SECRET", writeFile(t, dir, "jwt.key", testSecret+"-file\n")
+			},
+			expectedSecret: testSecret + "-file",
+			expectedSource: SourceFile + " ",
+		},
+		{
+			name: "Missing secret file",
+			prepare: func(t *testing.T, dir string) (string, string) {
+				return testSecret, dir + "/missing.key"
+			},
+			expectedProblem: "jwt.secret_file: failed to read secret file",
+		},
+		{
+			name: "env provider",
+			prepare: func(t *testing.T, dir string) (string, string) {
+				t.Setenv("OAUTH2_TEST_SECRET", testSecret+"-env")
+
+				return "env:OAUTH2_TEST_SECRET", ""
+			},
+			expectedSecret: testSecret + "-env",
+			expectedSource: "env provider",
+		},
+		{
+			name: "env provider with an unset variable",
+			prepare: func(t *testing.T, dir string) (string, string) {
+				return "env:OAUTH2_TEST_UNSET", ""
+			},
+			expectedProblem: "jwt.secret: failed to resolve env secret: environment variable OAUTH2_TEST_UNSET is not set",
+		},
+		{
+			name: "file provider trims a trailing CRLF",
+			prepare: func(t *testing.T, dir string) (string, string) {
+				return "file:" + writeFile(t, dir, "jwt.key", testSecret+"-crlf\r\n"), ""
+			},
+			expectedSecret: testSecret + "-crlf",
+			expectedSource: "file provider",
+		},
+		{
+			name: "file provider keeps the inner newlines",
+			prepare: func(t *testing.T, dir string) (string, string) {
+				return "file:" + writeFile(t, dir, "jwt.key", testSecret+"\n-lines\n\n"), ""
+			},
+			expectedSecret: testSecret + "\n-lines\n",
+			expectedSource: "file provider",
+		},
+		{
+			name: "exec provider",
+			prepare: func(t *testing.T, dir string) (string, string) {
+				return "exec:echo " + testSecret + "-exec", ""
+			},
+			expectedSecret: testSecret + "-exec",
+			expectedSource: "exec provider",
+		},
+		{
+			name: "exec provider with a failing command",
+			prepare: func(t *testing.T, dir string) (string, string) {
+				return "exec:cat " + dir + "/missing.key", ""
+			},
+			expectedProblem: "jwt.secret: failed to resolve exec secret: command cat failed: cat: ",
+		},
+		{
+			name: "Registered provider",
+			prepare: func(t *testing.T, dir string) (string, string) {
+				return "vault:secret/oauth2#jwt", ""
+			},
+			expectedSecret: testSecret + "-vault",
+			expectedSource: "vault provider",
+		},
+		{
+			name: "Unknown scheme is kept as is",
+			prepare: func(t *testing.T, dir string) (string, string) {
+				return "unknown:" + testSecret, ""
+			},
+			expectedSecret: "unknown:" + testSecret,
+			expectedSource: SourceEnv + " JWT_SECRET",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			secret, secretFile := tt.prepare(t, dir)
+
+			t.Setenv("JWT_SECRET", secret)
+			t.Setenv("JWT_SECRET_FILE", secretFile)
+
+			path := writeFile(t, dir, "config.yaml", "mode: dev\njwt:\n  secret: placeholder\n")
+
+			cfg, err := LoadConfig(path)
+			if tt.expectedProblem != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedProblem) {
+					t.Errorf("got error %v but wanted problem %q\n", err, tt.expectedProblem)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("could not load config: %v\n", err)
+			}
+
+			if cfg.JWT.Secret != tt.expectedSecret {
+				t.Errorf("got secret %q but wanted %q\n", cfg.JWT.Secret, tt.expectedSecret)
+			}
+
+			if source := cfg.Sources()["jwt.secret"]; !strings.Contains(source, tt.expectedSource) {
+				t.Errorf("got source %q but wanted it to contain %q\n", source, tt.expectedSource)
+			}
+		})
+	}
+}
+
+func TestResolveSecretsOfEveryKey(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Setenv("OAUTH2_TEST_ADMIN_TOKEN", "admin-token")
+
+	path := writeFile(t, dir, "config.yaml", `
+mode: dev
+jwt:
+  secret: `+testSecret+`
+admin:
+  token: env:OAUTH2_TEST_ADMIN_TOKEN
+clients:
+  - id: a
+    secret_ref: file:`+writeFile(t, dir, "a.secret", "client-a\n")+`
+  - id: b
+    secret: ignored
+    secret_file: `+writeFile(t, dir, "b.secret", "client-b\n")+`
+  - id: c
+    secret_ref: env:OAUTH2_TEST_UNSET
+`)
+
+	_, err := LoadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "clients[2].secret_ref: failed to resolve env secret") {
+		t.Fatalf("got error %v but wanted the problem of clients[2].secret_ref\n", err)
+	}
+
+	t.Setenv("OAUTH2_TEST_UNSET", "client-c")
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("could not load config: %v\n", err)
+	}
+
+	if cfg.Admin.Token != "admin-token" {
+		t.Errorf("got admin token %q but wanted %q\n", cfg.Admin.Token, "admin-token")
+	}
+
+	for i, expected := range []string{"client-a", "client-b", "client-c"} {
+		if cfg.Clients[i].Secret != expected {
+			t.Errorf("got secret %q of clients[%d] but wanted %q\n", cfg.Clients[i].Secret, i, expected)
+		}
+	}
+}
+
+func TestResolveClientSecretRef(t *testing.T) {
+	tests := []struct {
+		name            string
+		client          string
+		inClientsFile   bool
+		expectedSecret  string
+		expectedProblem string
+	}{
+		{
+			name:           "Secret with a scheme prefix is taken as is",
+			client:         "secret: exec:echo client-exec",
+			expectedSecret: "exec:echo client-exec",
+		},
+		{
+			name:           "Secret with a scheme prefix of the clients file is taken as is",
+			client:         "secret: env:OAUTH2_TEST_CLIENT_SECRET",
+			inClientsFile:  true,
+			expectedSecret: "env:OAUTH2_TEST_CLIENT_SECRET",
+		},
+		{
+			name:           "exec reference of the config",
+			client:         "secret_ref: exec:echo client-exec",
+			expectedSecret: "client-exec",
+		},
+		{
+			name:           "env reference of the clients file",
+			client:         "secret_ref: env:OAUTH2_TEST_CLIENT_SECRET",
+			inClientsFile:  true,
+			expectedSecret: "client-env",
+		},
+		{
+			name:            "exec reference of the clients file",
+			client:          "secret_ref: exec:echo client-exec",
+			inClientsFile:   true,
+			expectedProblem: "clients[0].secret_ref: exec secrets can't be referenced by the clients of clients_file",
+		},
+		{
+			name:            "Reference of an unknown scheme",
+			client:          "secret_ref: unknown:client",
+			expectedProblem: `clients[0].secret_ref: unknown secret provider "unknown"`,
+		},
+		{
+			name:            "Reference along with a secret",
+			client:          "secret: client_secret\n    secret_ref: env:OAUTH2_TEST_CLIENT_SECRET",
+			expectedProblem: "clients[0].secret_ref: must be empty with a secret",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			t.Setenv("OAUTH2_TEST_CLIENT_SECRET", "client-env")
+
+			clients := "clients:\n  - id: svc\n    " + tt.client + "\n"
+
+			config := "mode: dev\njwt:\n  secret: " + testSecret + "\n"
+			if tt.inClientsFile {
+				config += "clients: []\nclients_file: " + writeFile(t, dir, "clients.yaml", clients) + "\n"
+			} else {
+				config += clients
+			}
+
+			cfg, err := LoadConfig(writeFile(t, dir, "config.yaml", config))
+			if tt.expectedProblem != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedProblem) {
+					t.Errorf("got error %v but wanted problem %q\n", err, tt.expectedProblem)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("could not load config: %v\n", err)
+			}
+
+			if cfg.Clients[0].Secret != tt.expectedSecret {
+				t.Errorf("got secret %q but wanted %q\n", cfg.Clients[0].Secret, tt.expectedSecret)
+			}
+		})
+	}
+}
+
+func TestResolvePreviousSecret(t *testing.T) {
+	generate := func(alg string) string {
+		key, err := keys.GenerateSigningKey(alg)
+		if err != nil {
+			t.Fatalf("could not generate %s key: %v\n", alg, err)
+		}
+
+		return string(key)
+	}
+
+	previousKey := generate("RS256")
+	secrets := map[string]string{"HS256": testSecret, "RS256": generate("RS256"), "ES256": generate("ES256")}
+
+	tests := []struct {
+		name             string
+		algorithm        string
+		previousFile     string
+		previousEnv      string
+		expectedPrevious string
+		expectedProblem  string
+	}{
+		{
+			name:             "Previous key next to the secret file",
+			algorithm:        "RS256",
+			previousFile:     previousKey,
+			expectedPrevious: strings.TrimSuffix(previousKey, "\n"),
+		},
+		{
+			name:             "Previous key of the env",
+			algorithm:        "RS256",
+			previousEnv:      previousKey,
+			expectedPrevious: previousKey,
+		},
+		{
+			name:      "No previous key",
+			algorithm: "RS256",
+		},
+		{
+			name:         "HMAC secret ignores the file next to it",
+			algorithm:    "HS256",
+			previousFile: testSecret,
+		},
+		{
+			name:            "Previous HMAC secret",
+			algorithm:       "HS256",
+			previousEnv:     testSecret,
+			expectedProblem: "jwt.previous_secret: must be empty for HS256, HMAC secrets are rotated with a cutover",
+		},
+		{
+			name:            "Previous key of another algorithm",
+			algorithm:       "ES256",
+			previousEnv:     previousKey,
+			expectedProblem: "jwt.previous_secret: invalid key for ES256: ES256 requires an ECDSA key on curve P-256",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			secretFile := writeFile(t, dir, "jwt.key", secrets[tt.algorithm])
+			if tt.previousFile != "" {
+				writeFile(t, dir, "jwt.key"+PreviousKeySuffix, tt.previousFile)
+			}
+
+			t.Setenv("JWT_ALGORITHM", tt.algorithm)
+			t.Setenv("JWT_SECRET_FILE", secretFile)
+			t.Setenv("JWT_PREVIOUS_SECRET", tt.previousEnv)
+
+			cfg, err := LoadConfig(writeFile(t, dir, "config.yaml", "mode: dev\n"))
+			if tt.expectedProblem != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedProblem) {
+					t.Errorf("got error %v but wanted problem %q\n", err, tt.expectedProblem)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("could not load config: %v\n", err)
+			}
+
+			if cfg.JWT.PreviousSecret != tt.expectedPrevious {
+				t.Errorf("got previous secret %q but wanted %q\n", cfg.JWT.PreviousSecret, tt.expectedPrevious)
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package config
+
+import (
+	"crypto"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/laonix/oauth2/internal/keys"
+)
+
+// Problem is an invalid value of the config, at its path, e.g. clients[0].secret.
+type Problem struct {
+	Path    string
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Path == "" {
+		return p.Message
+	}
+
+	return p.Path + ": " + p.Message
+}
+
+// ValidationError lists every problem found in the config.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		lines[i] = p.String()
+	}
+
+	return fmt.Sprintf("invalid config, %d problem(s):\n  %s", len(e.Problems), strings.Join(lines, "\n  "))
+}
+
+// validator collects the problems of a config.
+type validator struct {
+	problems []Problem
+}
+
+// addf adds a problem, unless the path already has one, e.g. a value of the wrong type.
+func (v *validator) addf(path, format string, args ...interface{}) {
+	for _, p := range v.problems {
+		if path != "" && p.Path == path {
+			return
+		}
+	}
+
+	v.problems = append(v.problems, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+
+	return &ValidationError{Problems: v.problems}
+}
+
+// Validate checks the config, returning a *ValidationError listing every problem found, or nil.
+func (c *Config) Validate() error {
+	v := &validator{}
+	c.validate(v)
+
+	return v.err()
+}
+
+// devKeyIDs are the key IDs of the development signing keys committed in config.yaml, refused in prod mode.
+var devKeyIDs = map[string]bool{
+	// RS256 key generated by oauth2 keys generate
+	"TzTqMiZLXD4nDuLUEGNTozUTG1kE79l6OYqSboDVdiA": true,
+	// RSA key of the first versions, used as an HS256 secret
+	"wDr7iBzQpNELfaUbQ_HVp8WNYVuGfSv6K_JjuPABcLY": true,
+}
+
+// devClientSecret is the secret of the development client of config.yaml, refused in prod mode.
+const devClientSecret = "client_secret"
+
+func (c *Config) validate(v *validator) {
+	if v.oneOf("mode", c.Mode, ModeDev, ModeProd) && c.Mode == ModeProd {
+		c.validateProd(v)
+	}
+
+	c.HTTP.validate(v)
+	c.JWT.validate(v)
+	c.Log.validate(v)
+	c.Tracing.validate(v)
+
+	if c.Admin.Address != "" {
+		v.address("admin.address", c.Admin.Address)
+	}
+
+	clients := make(map[string]bool, len(c.Clients))
+	for i, cli := range c.Clients {
+		path := fmt.Sprintf("clients[%d]", i)
+
+		switch {
+		case cli.ID == "":
+			v.addf(path+".id", "must be set")
+		case clients[cli.ID]:
+			v.addf(path+".id", "client %q is registered twice", cli.ID)
+		}
+		clients[cli.ID] = true
+
+		if cli.Public && cli.Secret != "" {
+			v.addf(path+".secret", "must be empty for a public client")
+		}
+
+		if !cli.Public && cli.Secret == "" {
+			v.addf(path+".secret", "must be set for a confidential client")
+		}
+
+		for j, uri := range cli.RedirectURIs {
+			v.absoluteURL(fmt.Sprintf("%s.redirect_uris[%d]", path, j), uri)
+		}
+	}
+
+	c.Grants.validate(v, clients)
+}
+
+// validateProd refuses the development secrets of config.yaml and the weak signing keys.
+func (c *Config) validateProd(v *validator) {
+	// a PEM key is recognized by its public key, whatever its encoding or algorithm, HMAC included
+	if signer, err := keys.ParsePrivateKeyPEM([]byte(c.JWT.Secret)); err == nil {
+		if keyID, err := keys.KeyID(signer.Public()); err == nil && devKeyIDs[keyID] {
+			v.addf("jwt.secret", "is the development key of config.yaml (kid %s), refused in prod mode; generate one with oauth2 keys generate", keyID)
+		}
+	}
+
+	if key, err := keys.ParseSigningKey(c.JWT.Algorithm, []byte(c.JWT.Secret)); err == nil {
+		if err := keys.CheckKeyStrength(c.JWT.Algorithm, key); err != nil {
+			v.addf("jwt.secret", "%s, refused in prod mode", err)
+		}
+	}
+
+	for i, cli := range c.Clients {
+		if cli.Secret == devClientSecret {
+			v.addf(fmt.Sprintf("clients[%d].secret", i), "is the development secret of config.yaml, refused in prod mode")
+		}
+	}
+}
+
+func (c *HTTP) validate(v *validator) {
+	v.port("http.port", c.Port)
+	v.positive("http.timeout", c.Timeout)
+	v.notNegative("http.pre_stop_delay", c.PreStopDelay)
+	v.positive("http.drain_timeout", c.DrainTimeout)
+
+	if !c.TLS.Enabled {
+		return
+	}
+
+	if c.TLS.CertFile == "" {
+		v.addf("http.tls.cert_file", "must be set when TLS is enabled")
+	}
+
+	if c.TLS.KeyFile == "" {
+		v.addf("http.tls.key_file", "must be set when TLS is enabled")
+	}
+
+	v.oneOf("http.tls.min_version", c.TLS.MinVersion, "1.2", "1.3")
+
+	suites := make(map[string]bool)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = true
+	}
+
+	for i, name := range c.TLS.CipherSuites {
+		if !suites[name] {
+			v.addf(fmt.Sprintf("http.tls.cipher_suites[%d]", i), "unsupported or insecure cipher suite %q", name)
+		}
+	}
+
+	v.notNegative("http.tls.reload_interval", c.TLS.ReloadInterval)
+
+	if c.TLS.PlainPort != "" {
+		v.port("http.tls.plain_port", c.TLS.PlainPort)
+		v.oneOf("http.tls.plain_http", c.TLS.PlainHTTP, "redirect", "refuse")
+
+		if c.TLS.PlainPort == c.Port {
+			v.addf("http.tls.plain_port", "must differ from http.port")
+		}
+	}
+}
+
+func (c *JWT) validate(v *validator) {
+	if !v.oneOf("jwt.algorithm", c.Algorithm, keys.SigningAlgorithms...) {
+		return
+	}
+
+	if c.Secret == "" {
+		v.addf("jwt.secret", "must be set, e.g. with JWT_SECRET")
+	} else if _, err := keys.ParseSigningKey(c.Algorithm, []byte(c.Secret)); err != nil {
+		v.addf("jwt.secret", "invalid key for %s: %s", c.Algorithm, err)
+	}
+
+	// HMAC secrets have no key ID telling the tokens of either secret apart, so they are rotated with a cutover
+	if c.PreviousSecret != "" {
+		if key, err := keys.ParseSigningKey(c.Algorithm, []byte(c.PreviousSecret)); err != nil {
+			v.addf("jwt.previous_secret", "invalid key for %s: %s", c.Algorithm, err)
+		} else if _, ok := key.(crypto.Signer); !ok {
+			v.addf("jwt.previous_secret", "must be empty for %s, HMAC secrets are rotated with a cutover", c.Algorithm)
+		}
+	}
+
+	v.positive("jwt.access_token_expires_in", c.AccessTokenExpiresIn)
+	v.positive("jwt.refresh_token_expires_in", c.RefreshTokenExpiresIn)
+
+	if c.RefreshTokenMaxLifetime < c.RefreshTokenExpiresIn {
+		v.addf("jwt.refresh_token_max_lifetime", "must be at least jwt.refresh_token_expires_in (%s)", c.RefreshTokenExpiresIn)
+	}
+}
+
+func (c *Log) validate(v *validator) {
+	if c.Level < -1 || c.Level > 7 {
+		v.addf("log.level", "must be between -1 (trace) and 7 (disabled), got %d", c.Level)
+	}
+
+	v.oneOf("log.format", c.Format, "console", "json")
+
+	switch c.Output {
+	case "":
+		v.addf("log.output", "must be stdout, stderr or a file path")
+	case "stdout", "stderr":
+	default:
+		if c.MaxSizeMB <= 0 {
+			v.addf("log.max_size_mb", "must be positive, got %d", c.MaxSizeMB)
+		}
+
+		if c.MaxBackups < 0 {
+			v.addf("log.max_backups", "must not be negative, got %d", c.MaxBackups)
+		}
+	}
+}
+
+func (c *Tracing) validate(v *validator) {
+	if v.oneOf("tracing.exporter", c.Exporter, "none", "stdout", "otlp") && c.Exporter == "otlp" {
+		v.address("tracing.endpoint", c.Endpoint)
+	}
+
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		v.addf("tracing.sample_ratio", "must be between 0 and 1, got %g", c.SampleRatio)
+	}
+}
+
+func (c *Grants) validate(v *validator, clients map[string]bool) {
+	v.positive("grants.authorization_code.code_expires_in", c.AuthorizationCode.CodeExpiresIn)
+
+	v.absoluteURL("grants.device_code.verification_uri", c.DeviceCode.VerificationURI)
+	v.positive("grants.device_code.expires_in", c.DeviceCode.ExpiresIn)
+	v.positive("grants.device_code.interval", c.DeviceCode.Interval)
+
+	issuers := make(map[string]bool, len(c.JWTBearer.Issuers))
+	for i, ic := range c.JWTBearer.Issuers {
+		path := fmt.Sprintf("grants.jwt_bearer.issuers[%d]", i)
+
+		switch {
+		case ic.Issuer == "":
+			v.addf(path+".issuer", "must be set")
+		case issuers[ic.Issuer]:
+			v.addf(path+".issuer", "issuer %q is configured twice", ic.Issuer)
+		}
+		issuers[ic.Issuer] = true
+
+		if ic.Audience == "" {
+			v.addf(path+".audience", "must be set")
+		}
+
+		if ic.JWKSFile == "" && len(ic.PublicKeys) == 0 {
+			v.addf(path, "must have public_keys or a jwks_file")
+		}
+
+		if len(ic.PublicKeys) > 1 {
+			v.addf(path+".public_keys", "must have at most one key, PEM keys have no key id")
+		}
+
+		for j, p := range ic.PublicKeys {
+			if _, err := keys.ParsePublicKeyPEM([]byte(p)); err != nil {
+				v.addf(fmt.Sprintf("%s.public_keys[%d]", path, j), "invalid public key: %s", err)
+			}
+		}
+
+		for j, sc := range ic.Clients {
+			if !clients[sc.ClientID] {
+				v.addf(fmt.Sprintf("%s.clients[%d].client_id", path, j), "unknown client %q", sc.ClientID)
+			}
+		}
+	}
+
+	for i, pc := range c.TokenExchange.Policies {
+		if !clients[pc.ClientID] {
+			v.addf(fmt.Sprintf("grants.token_exchange.policies[%d].client_id", i), "unknown client %q", pc.ClientID)
+		}
+	}
+}
+
+func (v *validator) port(path, port string) {
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		v.addf(path, "must be a port between 1 and 65535, got %q", port)
+	}
+}
+
+func (v *validator) address(path, address string) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		v.addf(path, "must be host:port, got %q", address)
+
+		return
+	}
+
+	v.port(path, port)
+}
+
+func (v *validator) absoluteURL(path, rawURL string) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		v.addf(path, "must be an absolute URL, got %q", rawURL)
+	}
+}
+
+func (v *validator) positive(path string, d time.Duration) {
+	if d <= 0 {
+		v.addf(path, "must be positive, got %s", d)
+	}
+}
+
+func (v *validator) notNegative(path string, d time.Duration) {
+	if d < 0 {
+		v.addf(path, "must not be negative, got %s", d)
+	}
+}
+
+func (v *validator) oneOf(path, value string, allowed ...string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+
+	v.addf(path, "must be one of %s, got %q", strings.Join(allowed, ", "), value)
+
+	return false
+}
@@ -0,0 +1,280 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/laonix/oauth2/internal/keys"
+)
+
+// loadProblems loads the config file content and returns its problems, "path: message" each.
+func loadProblems(t *testing.T, content string) []string {
+	path := writeFile(t, t.TempDir(), "config.yaml", content)
+
+	_, err := LoadConfig(path)
+	if err == nil {
+		return nil
+	}
+
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("got error %v but wanted a validation error\n", err)
+	}
+
+	problems := make([]string, len(validationErr.Problems))
+	for i, p := range validationErr.Problems {
+		problems[i] = p.String()
+	}
+
+	return problems
+}
+
+func TestDecodeProblems(t *testing.T) {
+	tests := []struct {
+		name             string
+		content          string
+		expectedProblems []string
+	}{
+		{
+			name:             "Valid config",
+			content:          "mode: dev\njwt:\n  secret: " + testSecret + "\n",
+			expectedProblems: nil,
+		},
+		{
+			name:             "Unknown nested key",
+			content:          "mode: dev\nhttp:\n  prot: \"3000\"\n  tls:\n    enabld: true\njwt:\n  secret: " + testSecret + "\n",
+			expectedProblems: []string{"http.prot: unknown key", "http.tls.enabld: unknown key"},
+		},
+		{
+			name: "Unknown key of a list item",
+			content: "mode: dev\njwt:\n  secret: " + testSecret + "\nclients:\n  - id: a\n    secret: s\n    scret: s\n" +
+				"grants:\n  jwt_bearer:\n    issuers:\n      - issuer: i\n        audience: a\n        jwks_file: f\n        audiance: a\n",
+			expectedProblems: []string{"clients[0].scret: unknown key", "grants.jwt_bearer.issuers[0].audiance: unknown key"},
+		},
+		{
+			name:             "Unknown top-level key",
+			content:          "mode: dev\njwt:\n  secret: " + testSecret + "\nclient: []\n",
+			expectedProblems: []string{"client: unknown key"},
+		},
+		{
+			name:             "Bad duration",
+			content:          "mode: dev\njwt:\n  secret: " + testSecret + "\nhttp:\n  timeout: 2x\n",
+			expectedProblems: []string{`http.timeout: time: unknown unit "x" in duration "2x"`},
+		},
+		{
+			name:             "Negative duration",
+			content:          "mode: dev\njwt:\n  secret: " + testSecret + "\n  access_token_expires_in: -1h\n",
+			expectedProblems: []string{"jwt.access_token_expires_in: must be positive, got -1h0m0s"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := loadProblems(t, tt.content)
+
+			if strings.Join(problems, "\n") != strings.Join(tt.expectedProblems, "\n") {
+				t.Errorf("got problems %q but wanted %q\n", problems, tt.expectedProblems)
+			}
+		})
+	}
+}
+
+func TestSigningKeyAlgorithm(t *testing.T) {
+	generate := func(alg string) string {
+		key, err := keys.GenerateSigningKey(alg)
+		if err != nil {
+			t.Fatalf("could not generate %s key: %v\n", alg, err)
+		}
+
+		return string(key)
+	}
+
+	rsaKey, ecKey, ec384Key, edKey := generate("RS256"), generate("ES256"), generate("ES384"), generate("EdDSA")
+
+	tests := []struct {
+		name            string
+		algorithm       string
+		secret          string
+		expectedProblem string
+	}{
+		{name: "HMAC secret", algorithm: "HS256", secret: testSecret},
+		{name: "PEM key as HMAC secret", algorithm: "HS512", secret: rsaKey},
+		{name: "RSA key", algorithm: "RS256", secret: rsaKey},
+		{name: "RSA-PSS key", algorithm: "PS384", secret: rsaKey},
+		{name: "ECDSA key", algorithm: "ES256", secret: ecKey},
+		{name: "Ed25519 key", algorithm: "EdDSA", secret: edKey},
+		{
+			name:            "HMAC secret for RSA",
+			algorithm:       "RS256",
+			secret:          testSecret,
+			expectedProblem: "jwt.secret: invalid key for RS256: no PEM block found",
+		},
+		{
+			name:            "ECDSA key for RSA",
+			algorithm:       "RS512",
+			secret:          ecKey,
+			expectedProblem: "jwt.secret: invalid key for RS512: RS512 requires an RSA key",
+		},
+		{
+			name:            "Ed25519 key for RSA-PSS",
+			algorithm:       "PS256",
+			secret:          edKey,
+			expectedProblem: "jwt.secret: invalid key for PS256: PS256 requires an RSA key",
+		},
+		{
+			name:            "RSA key for ECDSA",
+			algorithm:       "ES256",
+			secret:          rsaKey,
+			expectedProblem: "jwt.secret: invalid key for ES256: ES256 requires an ECDSA key on curve P-256",
+		},
+		{
+			name:            "ECDSA key on another curve",
+			algorithm:       "ES256",
+			secret:          ec384Key,
+			expectedProblem: "jwt.secret: invalid key for ES256: ES256 requires an ECDSA key on curve P-256",
+		},
+		{
+			name:            "ECDSA key for EdDSA",
+			algorithm:       "EdDSA",
+			secret:          ecKey,
+			expectedProblem: "jwt.secret: invalid key for EdDSA: EdDSA requires an Ed25519 key",
+		},
+		{
+			name:            "Unknown algorithm",
+			algorithm:       "none",
+			secret:          testSecret,
+			expectedProblem: `jwt.algorithm: must be one of ` + strings.Join(keys.SigningAlgorithms, ", ") + `, got "none"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("JWT_ALGORITHM", tt.algorithm)
+			t.Setenv("JWT_SECRET", tt.secret)
+
+			problems := loadProblems(t, "mode: dev\n")
+
+			if strings.Join(problems, "\n") != tt.expectedProblem {
+				t.Errorf("got problems %q but wanted %q\n", problems, tt.expectedProblem)
+			}
+		})
+	}
+}
+
+func TestValidationErrorListsAllProblems(t *testing.T) {
+	problems := loadProblems(t, `
+mode: staging
+http:
+  port: "70000"
+  prot: "3000"
+  timeout: 2x
+log:
+  level: 9
+  format: xml
+clients:
+  - id: a
+    secret: s
+  - id: a
+  - id: b
+    public: true
+    secret: s
+    redirect_uris: [/callback]
+grants:
+  token_exchange:
+    policies:
+      - client_id: c
+`)
+
+	expectedProblems := []string{
+		"http.prot: unknown key",
+		`http.timeout: time: unknown unit "x" in duration "2x"`,
+		`mode: must be one of dev, prod, got "staging"`,
+		`http.port: must be a port between 1 and 65535, got "70000"`,
+		"jwt.secret: must be set, e.g. with JWT_SECRET",
+		"log.level: must be between -1 (trace) and 7 (disabled), got 9",
+		`log.format: must be one of console, json, got "xml"`,
+		`clients[1].id: client "a" is registered twice`,
+		"clients[1].secret: must be set for a confidential client",
+		"clients[2].secret: must be empty for a public client",
+		`clients[2].redirect_uris[0]: must be an absolute URL, got "/callback"`,
+		`grants.token_exchange.policies[0].client_id: unknown client "c"`,
+	}
+
+	if strings.Join(problems, "\n") != strings.Join(expectedProblems, "\n") {
+		t.Errorf("got problems\n%s\nbut wanted\n%s\n", strings.Join(problems, "\n"), strings.Join(expectedProblems, "\n"))
+	}
+
+	err := &ValidationError{Problems: []Problem{{Path: "http.port", Message: "must be set"}, {Message: "no path"}}}
+	if expected := "invalid config, 2 problem(s):\n  http.port: must be set\n  no path"; err.Error() != expected {
+		t.Errorf("got error %q but wanted %q\n", err.Error(), expected)
+	}
+}
+
+func TestValidateProd(t *testing.T) {
+	cfg, err := LoadConfig("../../config.yaml")
+	if err != nil {
+		t.Fatalf("could not load config: %v\n", err)
+	}
+
+	prodKey, err := keys.GenerateSigningKey("RS256")
+	if err != nil {
+		t.Fatalf("could not generate key: %v\n", err)
+	}
+
+	tests := []struct {
+		name             string
+		prepareConfig    func(cfg *Config)
+		expectedProblems []string
+	}{
+		{
+			name:             "Dev mode accepts the development secrets",
+			prepareConfig:    func(cfg *Config) {},
+			expectedProblems: nil,
+		},
+		{
+			name: "Development key and client secret",
+			prepareConfig: func(cfg *Config) {
+				cfg.Mode = ModeProd
+			},
+			expectedProblems: []string{"jwt.secret", "clients[0].secret"},
+		},
+		{
+			name: "Generated key and client secret",
+			prepareConfig: func(cfg *Config) {
+				cfg.Mode = ModeProd
+				cfg.JWT.Secret = string(prodKey)
+				cfg.Clients[0].Secret = uuid.NewString()
+			},
+			expectedProblems: nil,
+		},
+		{
+			name: "Weak HMAC secret",
+			prepareConfig: func(cfg *Config) {
+				cfg.Mode = ModeProd
+				cfg.JWT.Algorithm = "HS256"
+				cfg.JWT.Secret = "secret"
+				cfg.Clients[0].Secret = uuid.NewString()
+			},
+			expectedProblems: []string{"jwt.secret"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := *cfg
+			c.Clients = append([]Client(nil), cfg.Clients...)
+			tt.prepareConfig(&c)
+
+			var problems []string
+			if err := c.Validate(); err != nil {
+				for _, p := range err.(*ValidationError).Problems {
+					problems = append(problems, p.Path)
+				}
+			}
+
+			if strings.Join(problems, ",") != strings.Join(tt.expectedProblems, ",") {
+				t.Errorf("got problems %v but wanted %v\n", problems, tt.expectedProblems)
+			}
+		})
+	}
+}
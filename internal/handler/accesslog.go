@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"github.com/laonix/oauth2/internal/config"
+)
+
+const redacted = "REDACTED"
+
+// defaultRedactQuery are the query parameters carrying credentials, which are always redacted.
+var defaultRedactQuery = []string{
+	"access_token", "actor_token", "assertion", "client_assertion", "client_secret", "code", "code_verifier",
+	"device_code", "password", "refresh_token", "subject_token", "token", "user_code",
+}
+
+// defaultRedactHeaders are the headers carrying credentials, which are always redacted.
+var defaultRedactHeaders = []string{
+	"Authorization", "Cookie", "Proxy-Authorization", "Set-Cookie", "X-Api-Key",
+}
+
+// WithAccessLog configures the access log lines of the served requests.
+func WithAccessLog(cfg config.AccessLog) Option {
+	return func(h *Handler) {
+		h.accessLog = newAccessLog(cfg)
+	}
+}
+
+// accessLog redacts the sensitive parts of the requests in the logs.
+type accessLog struct {
+	headers       []string
+	redactQuery   map[string]bool
+	redactHeaders map[string]bool
+}
+
+type accessLogKey struct{}
+
+// accessLogEntry collects the fields of the access log line known only to the inner handlers.
+type accessLogEntry struct {
+	clientID string
+}
+
+func newAccessLog(cfg config.AccessLog) *accessLog {
+	a := &accessLog{
+		headers:       cfg.Headers,
+		redactQuery:   make(map[string]bool),
+		redactHeaders: make(map[string]bool),
+	}
+
+	for _, name := range append(defaultRedactQuery, cfg.RedactQuery...) {
+		a.redactQuery[strings.ToLower(name)] = true
+	}
+
+	for _, name := range append(defaultRedactHeaders, cfg.RedactHeaders...) {
+		a.redactHeaders[http.CanonicalHeaderKey(name)] = true
+	}
+
+	return a
+}
+
+// redactURI returns the request URI with the values of the sensitive query parameters redacted.
+//
+// The order and the encoding of the other parameters are kept.
+func (a *accessLog) redactURI(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.RequestURI()
+	}
+
+	params := strings.Split(u.RawQuery, "&")
+	for i, param := range params {
+		key, _, ok := strings.Cut(param, "=")
+		if !ok {
+			continue
+		}
+
+		name, err := url.QueryUnescape(key)
+		if err != nil || a.redactQuery[strings.ToLower(name)] {
+			params[i] = key + "=" + redacted
+		}
+	}
+
+	redactedURL := *u
+	redactedURL.RawQuery = strings.Join(params, "&")
+
+	return redactedURL.RequestURI()
+}
+
+// headersOf returns the configured headers of the request, with the values of the sensitive ones redacted.
+func (a *accessLog) headersOf(r *http.Request) *zerolog.Event {
+	dict := zerolog.Dict()
+
+	for _, name := range a.headers {
+		value := r.Header.Get(name)
+		if value == "" {
+			continue
+		}
+
+		if a.redactHeaders[http.CanonicalHeaderKey(name)] {
+			value = redacted
+		}
+
+		dict = dict.Str(name, value)
+	}
+
+	return dict
+}
+
+// clientIDOf returns the client of the request: the client of the validated access token, the client
+// of Basic Authentication or the client_id parameter of a public client.
+func (e *accessLogEntry) clientIDOf(r *http.Request) string {
+	if e.clientID != "" {
+		return e.clientID
+	}
+
+	if clientID, _, ok := r.BasicAuth(); ok {
+		return clientID
+	}
+
+	if r.Form != nil {
+		return r.Form.Get("client_id")
+	}
+
+	return ""
+}
+
+// remoteIP returns the IP address of the remote end of the connection.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
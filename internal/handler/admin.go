@@ -0,0 +1,250 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+
+	"github.com/laonix/oauth2/internal/config"
+	"github.com/laonix/oauth2/internal/logger"
+	"github.com/laonix/oauth2/internal/metrics"
+)
+
+const (
+	defaultOverrideTTL = 10 * time.Minute
+	maxOverrideTTL     = 24 * time.Hour
+)
+
+// LogLevelRequest is a request for the log level method.
+type LogLevelRequest struct {
+	Level string `json:"level"`
+}
+
+// LogLevelOverrideRequest is a request for the log level override method.
+//
+// Exactly one of ClientID and RequestID must be set. TTL defaults to 10 minutes.
+type LogLevelOverrideRequest struct {
+	ClientID  string `json:"client_id"`
+	RequestID string `json:"request_id"`
+	Level     string `json:"level"`
+	TTL       string `json:"ttl"`
+}
+
+// LogLevelResponse is a response for the log level methods.
+type LogLevelResponse struct {
+	Level     zerolog.Level     `json:"level"`
+	Overrides []logger.Override `json:"overrides"`
+}
+
+// WithAdminToken enables the admin endpoints, authenticated by the token as a bearer token.
+func WithAdminToken(token string) Option {
+	return func(h *Handler) {
+		h.adminToken = token
+	}
+}
+
+// WithConfig sets the config returned, redacted, by the config dump endpoint.
+func WithConfig(cfg *config.Config) Option {
+	return func(h *Handler) {
+		h.cfg.Store(cfg)
+	}
+}
+
+// SetConfig replaces the config returned by the config dump endpoint, once the config is reloaded.
+func (h *Handler) SetConfig(cfg *config.Config) {
+	h.cfg.Store(cfg)
+}
+
+// AdminRoutes returns the HTTP handler for the admin listener, which must not be reachable by the clients.
+//
+// It includes the following routes:
+//
+// - GET /metrics exposes the metrics of the server in the Prometheus format
+//
+// - GET /debug/pprof/ serves the runtime profiling data of net/http/pprof
+//
+// - GET /admin/config returns the effective config with its secrets redacted and the sources of its values,
+// as JSON or, with format=yaml, YAML, if the admin token is set
+//
+// - GET, PUT /admin/log/level returns or sets the log level, if the admin token is set
+//
+// - POST /admin/log/overrides sets a temporary log level for a client or a request id, if the admin token is set
+func (h *Handler) AdminRoutes() http.Handler {
+	r := mux.NewRouter()
+
+	r.Handle("/metrics", metrics.Handler()).Methods(http.MethodGet)
+
+	r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	r.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	r.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+
+	if h.adminToken != "" {
+		adminSub := r.PathPrefix("/admin").Subrouter()
+		adminSub.HandleFunc("/config", h.configDump).Methods(http.MethodGet)
+		adminSub.HandleFunc("/log/level", h.logLevel).Methods(http.MethodGet, http.MethodPut)
+		adminSub.HandleFunc("/log/overrides", h.logLevelOverride).Methods(http.MethodPost)
+		adminSub.Use(h.trackMiddleware, h.loggingMiddleware, recoveryMiddleware, h.adminMiddleware)
+	}
+
+	return r
+}
+
+// adminMiddleware authenticates the requests to the admin endpoints by the admin token.
+func (h *Handler) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) != 1 {
+			log := logger.WithRequestId(r)
+			log.Warn().Str("remote_addr", r.RemoteAddr).Msg("admin request rejected")
+
+			handleError(w, http.StatusUnauthorized, "invalid admin token")
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// configDump returns the effective config with its secrets redacted and the sources of its values,
+// in the format of the format parameter, json by default or yaml.
+func (h *Handler) configDump(w http.ResponseWriter, r *http.Request) {
+	cfg := h.cfg.Load()
+	if cfg == nil {
+		handleError(w, http.StatusNotFound, "config is not available")
+
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = config.FormatJSON
+	}
+
+	if format != config.FormatJSON && format != config.FormatYAML {
+		handleError(w, http.StatusBadRequest, "format must be json or yaml")
+
+		return
+	}
+
+	resp, err := cfg.Dump(format)
+	if err != nil {
+		log := logger.WithRequestId(r)
+		log.Error().Err(err).Msg("failed to dump config")
+
+		handleError(w, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	contentType := contentTypeJSON
+	if format == config.FormatYAML {
+		contentType = contentTypeYAML
+	}
+
+	w.Header().Set(contentTypeHeader, contentType)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resp)
+}
+
+// logLevel returns the log level and, on PUT, sets it first.
+func (h *Handler) logLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var req LogLevelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			handleError(w, http.StatusBadRequest, "invalid request body")
+
+			return
+		}
+
+		level, err := zerolog.ParseLevel(req.Level)
+		if err != nil || req.Level == "" {
+			handleError(w, http.StatusBadRequest, "invalid level")
+
+			return
+		}
+
+		log := logger.WithRequestId(r)
+		log.Info().Str("from", logger.Level().String()).Str("to", level.String()).Msg("log level changed")
+
+		logger.SetLogLevel(int(level))
+	}
+
+	writeJSON(w, r, http.StatusOK, &LogLevelResponse{
+		Level:     logger.Level(),
+		Overrides: logger.Overrides(),
+	})
+}
+
+// logLevelOverride sets a temporary log level for the requests of a client or of a request id.
+func (h *Handler) logLevelOverride(w http.ResponseWriter, r *http.Request) {
+	var req LogLevelOverrideRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, http.StatusBadRequest, "invalid request body")
+
+		return
+	}
+
+	field, value := logger.OverrideClientID, req.ClientID
+	if req.RequestID != "" {
+		field, value = logger.OverrideRequestID, req.RequestID
+	}
+
+	if value == "" || (req.ClientID != "" && req.RequestID != "") {
+		handleError(w, http.StatusBadRequest, "exactly one of client_id and request_id is required")
+
+		return
+	}
+
+	level, err := zerolog.ParseLevel(req.Level)
+	if err != nil || req.Level == "" {
+		handleError(w, http.StatusBadRequest, "invalid level")
+
+		return
+	}
+
+	ttl := defaultOverrideTTL
+	if req.TTL != "" {
+		ttl, err = time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 || ttl > maxOverrideTTL {
+			handleError(w, http.StatusBadRequest, "ttl must be a duration up to 24h")
+
+			return
+		}
+	}
+
+	o := logger.SetOverride(field, value, level, ttl)
+
+	log := logger.WithRequestId(r)
+	log.Info().Str("field", field).Str("value", value).Str("level", level.String()).Time("expires_at", o.ExpiresAt).Msg("log level override set")
+
+	writeJSON(w, r, http.StatusOK, &LogLevelResponse{
+		Level:     logger.Level(),
+		Overrides: logger.Overrides(),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	resp, err := json.Marshal(v)
+	if err != nil {
+		log := logger.WithRequestId(r)
+		log.Error().Err(errors.WithStack(err)).Msg("failed to marshal response")
+
+		handleError(w, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	w.Header().Set(contentTypeHeader, contentTypeJSON)
+	w.WriteHeader(status)
+	_, _ = w.Write(resp)
+}
@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+
+	oerrors "github.com/go-oauth2/oauth2/v4/errors"
+	"github.com/pkg/errors"
+
+	"github.com/laonix/oauth2/internal/logger"
+)
+
+// deviceCSRFCookie holds the CSRF token of the device confirmation form, which the form posts back (double submit).
+const deviceCSRFCookie = "device_csrf"
+
+// deviceConfirmationPage asks the user to confirm the user code shown by the device, or to enter it.
+//
+// The user code of verification_uri_complete only fills in the form: following a link never approves a device,
+// see RFC 8628 section 5.4.
+var deviceConfirmationPage = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Connect a device</title></head>
+<body>
+<form method="post" action="">
+{{- if .UserCode}}
+<p>Only confirm if your device shows the code <strong>{{.UserCode}}</strong>. Never confirm a code you received from someone else.</p>
+<input type="hidden" name="user_code" value="{{.UserCode}}">
+{{- else}}
+<p>Enter the code shown by your device.</p>
+<input type="text" name="user_code" autocomplete="off" autofocus required>
+{{- end}}
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<button type="submit">Connect the device</button>
+</form>
+</body>
+</html>
+`))
+
+// confirmDeviceAuthorization shows the authenticated user the form approving the device authorization of a user code.
+func (h *Handler) confirmDeviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	if h.authenticate == nil {
+		handleError(w, http.StatusForbidden, oerrors.ErrAccessDenied.Error())
+
+		return
+	}
+
+	userID, err := h.authenticate(w, r)
+	if err != nil {
+		handleError(w, http.StatusForbidden, oerrors.ErrAccessDenied.Error())
+
+		return
+	} else if userID == "" {
+		return
+	}
+
+	csrfToken, err := newCSRFToken()
+	if err != nil {
+		log := logger.WithRequestId(r)
+		log.Error().Err(err).Msg("failed to generate CSRF token")
+
+		handleError(w, http.StatusInternalServerError, somethingWentWrongMsg)
+
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     deviceCSRFCookie,
+		Value:    csrfToken,
+		Path:     r.URL.Path,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	// the page can't be framed, so that a user can't be tricked into clicking its button
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; form-action 'self'; frame-ancestors 'none'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set(contentTypeHeader, "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	_ = deviceConfirmationPage.Execute(w, struct {
+		UserCode  string
+		CSRFToken string
+	}{
+		UserCode:  r.URL.Query().Get("user_code"),
+		CSRFToken: csrfToken,
+	})
+}
+
+// validCSRFToken tells whether the form of the request carries the CSRF token of its cookie.
+func validCSRFToken(r *http.Request) bool {
+	cookie, err := r.Cookie(deviceCSRFCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(r.PostFormValue("csrf_token"))) == 1
+}
+
+func newCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -1,29 +1,144 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
+	"slices"
+	"sync/atomic"
 
 	"github.com/go-oauth2/oauth2/v4"
+	oerrors "github.com/go-oauth2/oauth2/v4/errors"
 	"github.com/go-oauth2/oauth2/v4/server"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
-	"oauth2/internal/handler/response"
-	"oauth2/internal/logger"
+	"github.com/laonix/oauth2/internal/config"
+	"github.com/laonix/oauth2/internal/handler/response"
+	"github.com/laonix/oauth2/internal/keys"
+	"github.com/laonix/oauth2/internal/logger"
+	"github.com/laonix/oauth2/internal/metrics"
+	"github.com/laonix/oauth2/internal/tracing"
+	"github.com/laonix/oauth2/pkg/resource"
 )
 
 // OAuth2Handler is an interface for handling access token generation and validation.
 //
 // server.Server implements this interface.
 type OAuth2Handler interface {
+	HandleAuthorizeRequest(w http.ResponseWriter, r *http.Request) error
 	HandleTokenRequest(w http.ResponseWriter, r *http.Request) error
+	ValidationTokenRequest(r *http.Request) (oauth2.GrantType, *oauth2.TokenGenerateRequest, error)
+	GetAccessToken(ctx context.Context, gt oauth2.GrantType, tgr *oauth2.TokenGenerateRequest) (oauth2.TokenInfo, error)
 	ValidationBearerToken(r *http.Request) (oauth2.TokenInfo, error)
+	CheckGrantType(gt oauth2.GrantType) bool
+	GetTokenData(ti oauth2.TokenInfo) map[string]interface{}
+	GetErrorData(err error) (map[string]interface{}, int, http.Header)
+}
+
+// TokenVerifier is implemented by the managers verifying their access tokens locally, the way the resource servers do,
+// and publishing the public keys verifying them.
+//
+// auth.Manager implements this interface.
+type TokenVerifier interface {
+	Verifier() *resource.Verifier
+	JWKS() keys.JWKS
+}
+
+// GrantHandler issues an access token for an extension grant (RFC 6749 section 4.5).
+//
+// server.Server only knows the grant types defined by RFC 6749, so extension grants are served by the Handler itself.
+// The returned error is reported to the client by its cause, which must be one of the oauth2 errors.
+type GrantHandler func(r *http.Request) (oauth2.TokenInfo, error)
+
+// ExtensionFields is implemented by the token information of extension grants
+// that add parameters to the token response.
+type ExtensionFields interface {
+	ExtensionFields() map[string]interface{}
+}
+
+// RedirectURIs is implemented by the clients allowed to use the authorization code grant.
+//
+// The redirect URI of an authorization request must match one of the registered URIs exactly.
+type RedirectURIs interface {
+	GetRedirectURIs() []string
+}
+
+// UserAuthenticator authenticates the user of an authorization request.
+//
+// It returns an empty user id, and no error, when it has responded itself, e.g. with a redirect to a login page.
+type UserAuthenticator func(w http.ResponseWriter, r *http.Request) (userID string, err error)
+
+// DeviceAuthorizationHandler starts a device authorization (RFC 8628 section 3.1) and returns the response parameters.
+type DeviceAuthorizationHandler func(r *http.Request) (map[string]interface{}, error)
+
+// DeviceApprovalHandler approves the device authorization of the user code on behalf of the user.
+type DeviceApprovalHandler func(ctx context.Context, userCode, userID string) error
+
+// Option configures a Handler.
+type Option func(h *Handler)
+
+// WithGrant registers the handler of an extension grant type.
+func WithGrant(gt oauth2.GrantType, grant GrantHandler) Option {
+	return func(h *Handler) {
+		h.grants[gt] = grant
+	}
+}
+
+// WithUserAuthenticator sets the authenticator of the users of authorization requests.
+//
+// Without it every authorization request is denied.
+func WithUserAuthenticator(authenticate UserAuthenticator) Option {
+	return func(h *Handler) {
+		h.authenticate = authenticate
+	}
+}
+
+// WithDeviceAuthorization enables the device authorization endpoints.
+//
+// The device_code grant itself is registered with WithGrant.
+func WithDeviceAuthorization(authorize DeviceAuthorizationHandler, approve DeviceApprovalHandler) Option {
+	return func(h *Handler) {
+		h.authorizeDevice = authorize
+		h.approveDevice = approve
+	}
+}
+
+// WithTrustedRequestID takes the request ID from the X-Request-ID or traceparent header of the request, if any.
+//
+// The header must be set by a trusted proxy or client, as the request ID ends up in the logs.
+func WithTrustedRequestID(trust bool) Option {
+	return func(h *Handler) {
+		h.trustRequestID = trust
+	}
 }
 
 // Handler provides routing and requests handling for OAuth2 HTTP server.
 type Handler struct {
-	srv OAuth2Handler
+	srv             OAuth2Handler
+	manager         oauth2.Manager
+	grants          map[oauth2.GrantType]GrantHandler
+	authenticate    UserAuthenticator
+	authorizeDevice DeviceAuthorizationHandler
+	approveDevice   DeviceApprovalHandler
+	adminToken      string
+	cfg             atomic.Pointer[config.Config]
+	accessLog       *accessLog
+	trustRequestID  bool
+	readinessChecks map[string]ReadinessCheck
+	verifier        *resource.Verifier
+	jwks            func() keys.JWKS
+	draining        atomic.Bool
+	inFlight        atomic.Int64
+}
+
+// DeviceResponse is a response for device approval method.
+type DeviceResponse struct {
+	Message string `json:"message"`
 }
 
 // SecureResponse is a response for secure method.
@@ -32,19 +147,45 @@ type SecureResponse struct {
 }
 
 // New creates a new instance of Handler.
-func New(manager oauth2.Manager) *Handler {
+func New(manager oauth2.Manager, opts ...Option) *Handler {
+	h := &Handler{
+		manager:         manager,
+		grants:          make(map[oauth2.GrantType]GrantHandler),
+		accessLog:       newAccessLog(config.AccessLog{}),
+		readinessChecks: make(map[string]ReadinessCheck),
+	}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	if tv, ok := manager.(TokenVerifier); ok {
+		h.verifier, h.jwks = tv.Verifier(), tv.JWKS
+	}
+
+	// authorization codes are only issued for S256 PKCE challenges
 	srvCfg := server.Config{
-		TokenType:            "Bearer",
-		AllowedResponseTypes: []oauth2.ResponseType{oauth2.Token},
-		AllowedGrantTypes:    []oauth2.GrantType{oauth2.ClientCredentials},
+		TokenType:                   "Bearer",
+		AllowedResponseTypes:        []oauth2.ResponseType{oauth2.Code},
+		AllowedGrantTypes:           []oauth2.GrantType{oauth2.ClientCredentials, oauth2.AuthorizationCode},
+		AllowedCodeChallengeMethods: []oauth2.CodeChallengeMethod{oauth2.CodeChallengeS256},
+		ForcePKCE:                   true,
+	}
+
+	for gt := range h.grants {
+		srvCfg.AllowedGrantTypes = append(srvCfg.AllowedGrantTypes, gt)
 	}
 
 	srv := server.NewServer(&srvCfg, manager)
+	srv.SetExtensionFieldsHandler(extensionFields)
+	srv.SetClientInfoHandler(clientInfo)
 
-	h := &Handler{
-		srv: srv,
+	if h.authenticate != nil {
+		srv.SetUserAuthorizationHandler(server.UserAuthorizationHandler(h.authenticate))
 	}
 
+	h.srv = srv
+
 	return h
 }
 
@@ -52,37 +193,309 @@ func New(manager oauth2.Manager) *Handler {
 //
 // It includes the following routes:
 //
+// - GET, POST /authorize issues an authorization code to the authenticated user
+//
 // - POST /token generates an access token
 //
+// - POST /device_authorization issues a device code and a user code, if device authorization is enabled
+//
+// - GET /device asks the authenticated user to confirm a user code, and POST /device approves its device authorization,
+// if device authorization is enabled
+//
 // - POST /secure validates the access token
 //
-// - GET /health returns the health status of the server
+// - GET /.well-known/jwks.json returns the public keys verifying the access tokens, if the manager is a TokenVerifier
+//
+// - GET /livez, /health returns the liveness of the server
+//
+// - GET /readyz returns the readiness of the server, failing while it shuts down or if one of its checks fails
+//
+// The probes aren't counted as requests in flight, see InFlight. The operational endpoints are served by AdminRoutes.
 func (h *Handler) Routes() http.Handler {
 	r := mux.NewRouter()
 
+	authorizeSub := r.PathPrefix("/authorize").Subrouter()
+	authorizeSub.Methods(http.MethodGet, http.MethodPost).HandlerFunc(h.authorize)
+	authorizeSub.Use(tracingMiddleware, h.trackMiddleware, metricsMiddleware, h.loggingMiddleware, recoveryMiddleware)
+
 	tokenSub := r.PathPrefix("/token").Subrouter()
 	tokenSub.Methods(http.MethodPost).HandlerFunc(h.generateToken)
-	tokenSub.Use(trackMiddleware, loggingMiddleware, recoveryMiddleware)
+	tokenSub.Use(tracingMiddleware, h.trackMiddleware, metricsMiddleware, h.loggingMiddleware, recoveryMiddleware)
+
+	if h.authorizeDevice != nil {
+		deviceAuthorizationSub := r.PathPrefix("/device_authorization").Subrouter()
+		deviceAuthorizationSub.Methods(http.MethodPost).HandlerFunc(h.deviceAuthorization)
+		deviceAuthorizationSub.Use(tracingMiddleware, h.trackMiddleware, metricsMiddleware, h.loggingMiddleware, recoveryMiddleware)
+
+		deviceSub := r.PathPrefix("/device").Subrouter()
+		deviceSub.Methods(http.MethodGet).HandlerFunc(h.confirmDeviceAuthorization)
+		deviceSub.Methods(http.MethodPost).HandlerFunc(h.approveDeviceAuthorization)
+		deviceSub.Use(tracingMiddleware, h.trackMiddleware, metricsMiddleware, h.loggingMiddleware, recoveryMiddleware)
+	}
 
 	secureSub := r.PathPrefix("/secure").Subrouter()
 	secureSub.Methods(http.MethodPost).HandlerFunc(h.secure)
-	secureSub.Use(trackMiddleware, loggingMiddleware, recoveryMiddleware, h.validateTokenMiddleware)
+	secureSub.Use(tracingMiddleware, h.trackMiddleware, metricsMiddleware, h.loggingMiddleware, recoveryMiddleware, h.validateTokenMiddleware)
+
+	if h.verifier != nil {
+		jwksSub := r.PathPrefix("/.well-known/jwks.json").Subrouter()
+		jwksSub.Methods(http.MethodGet).HandlerFunc(h.keySet)
+		jwksSub.Use(tracingMiddleware, h.trackMiddleware, metricsMiddleware, h.loggingMiddleware, recoveryMiddleware)
+	}
+
+	r.HandleFunc("/livez", h.livez).Methods(http.MethodGet)
+	r.HandleFunc("/health", h.livez).Methods(http.MethodGet)
+
+	readyzSub := r.PathPrefix("/readyz").Subrouter()
+	readyzSub.Methods(http.MethodGet).HandlerFunc(h.readyz)
+	readyzSub.Use(h.trackMiddleware)
+
+	// the probes keep coming during the drain of the shutdown, which they mustn't hold
+	routes := http.NewServeMux()
+	routes.Handle("/livez", r)
+	routes.Handle("/health", r)
+	routes.Handle("/readyz", r)
+	routes.Handle("/", h.inFlightMiddleware(r))
+
+	return routes
+}
+
+// authorize serves the authorization request (RFC 6749 section 4.1.1).
+//
+// Errors are only redirected to the client once its redirect URI is verified, see RFC 6749 section 4.1.2.1.
+func (h *Handler) authorize(w http.ResponseWriter, r *http.Request) {
+	if err := h.checkRedirectURI(r); err != nil {
+		log := logger.WithRequestId(r)
+		log.Warn().Err(err).Msg("authorization request rejected")
+
+		data, status, header := h.srv.GetErrorData(errors.Cause(err))
+		writeTokenResponse(w, r, data, header, status)
+
+		return
+	}
+
+	err := h.srv.HandleAuthorizeRequest(w, r)
+	if err == nil {
+		return
+	}
+
+	// server.Server returns the errors of invalid requests instead of redirecting them
+	if _, ok := oerrors.Descriptions[err]; ok {
+		log := logger.WithRequestId(r)
+		log.Warn().Err(err).Msg("authorization request rejected")
+
+		h.redirectError(w, r, err)
+
+		return
+	}
+
+	log := logger.WithRequestId(r)
+	log.Error().Err(errors.WithStack(err)).Msg("failed to handle authorization request")
+
+	handleError(w, http.StatusInternalServerError, err.Error())
+}
+
+// redirectError redirects the error of an authorization request to the verified redirect URI of the request.
+func (h *Handler) redirectError(w http.ResponseWriter, r *http.Request, err error) {
+	redirectURI, _ := url.Parse(r.FormValue("redirect_uri"))
+
+	data, _, _ := h.srv.GetErrorData(err)
+
+	query := redirectURI.Query()
+	for k, v := range data {
+		query.Set(k, fmt.Sprint(v))
+	}
+
+	if state := r.FormValue("state"); state != "" {
+		query.Set("state", state)
+	}
+
+	redirectURI.RawQuery = query.Encode()
+
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// checkRedirectURI checks that the redirect URI of the authorization request is registered for its client.
+//
+// A client with a single registered redirect URI may omit it from the request.
+func (h *Handler) checkRedirectURI(r *http.Request) error {
+	cli, err := h.manager.GetClient(r.Context(), r.FormValue("client_id"))
+	if err != nil {
+		return errors.Wrap(oerrors.ErrInvalidClient, "unknown client")
+	}
+
+	registered, ok := cli.(RedirectURIs)
+	if !ok || len(registered.GetRedirectURIs()) == 0 {
+		return errors.Wrap(oerrors.ErrUnauthorizedClient, "client has no redirect URIs")
+	}
+
+	uris := registered.GetRedirectURIs()
 
-	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("OK"))
-	}).Methods(http.MethodGet)
+	redirectURI := r.FormValue("redirect_uri")
+	if redirectURI == "" && len(uris) == 1 {
+		r.Form.Set("redirect_uri", uris[0])
 
-	return r
+		return nil
+	}
+
+	if !slices.Contains(uris, redirectURI) {
+		return errors.Wrapf(oerrors.ErrInvalidRequest, "redirect URI %q is not registered", redirectURI)
+	}
+
+	if _, err := url.Parse(redirectURI); err != nil {
+		return errors.Wrapf(oerrors.ErrInvalidRequest, "redirect URI %q is invalid", redirectURI)
+	}
+
+	return nil
 }
 
 func (h *Handler) generateToken(w http.ResponseWriter, r *http.Request) {
-	if err := h.srv.HandleTokenRequest(w, r); err != nil {
+	gt := oauth2.GrantType(r.FormValue("grant_type"))
+
+	ti, err := h.issueToken(r, gt)
+	if err != nil {
+		h.tokenError(w, r, gt, err)
+
+		return
+	}
+
+	metrics.TokensIssued.WithLabelValues(ti.GetClientID(), string(gt)).Inc()
+
+	writeTokenResponse(w, r, h.srv.GetTokenData(ti), nil, http.StatusOK)
+}
+
+// issueToken issues the access token of a token request.
+//
+// Extension grants are served by their GrantHandler, the standard ones the same way server.Server serves them.
+func (h *Handler) issueToken(r *http.Request, gt oauth2.GrantType) (ti oauth2.TokenInfo, err error) {
+	ctx, span := tracing.Tracer().Start(r.Context(), "HandleTokenRequest",
+		trace.WithAttributes(attribute.String("oauth2.grant_type", string(gt))),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	r = r.WithContext(ctx)
+
+	if grant, ok := h.grants[gt]; ok {
+		if !h.srv.CheckGrantType(gt) {
+			return nil, oerrors.ErrUnauthorizedClient
+		}
+
+		return grant(r)
+	}
+
+	gt, tgr, err := h.srv.ValidationTokenRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.srv.GetAccessToken(r.Context(), gt, tgr)
+}
+
+// tokenError reports a rejected token request to the client by the cause of the error.
+func (h *Handler) tokenError(w http.ResponseWriter, r *http.Request, gt oauth2.GrantType, err error) {
+	log := logger.WithRequestId(r)
+	log.Warn().Err(err).Str("grant_type", string(gt)).Msg("token request rejected")
+
+	h.countClientAuthFailure(r, err)
+
+	data, status, header := h.srv.GetErrorData(errors.Cause(err))
+	writeTokenResponse(w, r, data, header, status)
+}
+
+// countClientAuthFailure counts the failed client authentication by its reason, if err is one.
+func (h *Handler) countClientAuthFailure(r *http.Request, err error) {
+	if errors.Cause(err) != oerrors.ErrInvalidClient {
+		return
+	}
+
+	reason := metrics.AuthInvalidCredentials
+	if clientID, _, err := clientInfo(r); err != nil {
+		reason = metrics.AuthMissingCredentials
+	} else if _, err := h.manager.GetClient(r.Context(), clientID); err != nil {
+		reason = metrics.AuthUnknownClient
+	}
+
+	metrics.ClientAuthFailures.WithLabelValues(reason).Inc()
+}
+
+// deviceAuthorization serves the device authorization request (RFC 8628 section 3.1).
+func (h *Handler) deviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	data, err := h.authorizeDevice(r)
+	if err != nil {
+		log := logger.WithRequestId(r)
+		log.Warn().Err(err).Msg("device authorization request rejected")
+
+		h.countClientAuthFailure(r, err)
+
+		data, status, header := h.srv.GetErrorData(errors.Cause(err))
+		writeTokenResponse(w, r, data, header, status)
+
+		return
+	}
+
+	writeTokenResponse(w, r, data, nil, http.StatusOK)
+}
+
+// approveDeviceAuthorization lets the authenticated user approve the device authorization of a user code,
+// with the form of confirmDeviceAuthorization.
+func (h *Handler) approveDeviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	// the approval must come from the form, not from a link or a form of another site
+	if !validCSRFToken(r) {
+		handleError(w, http.StatusForbidden, "CSRF token is missing or invalid")
+
+		return
+	}
+
+	userCode := r.PostFormValue("user_code")
+	if userCode == "" {
+		handleError(w, http.StatusBadRequest, "user_code is missing")
+
+		return
+	}
+
+	if h.authenticate == nil {
+		handleError(w, http.StatusForbidden, oerrors.ErrAccessDenied.Error())
+
+		return
+	}
+
+	userID, err := h.authenticate(w, r)
+	if err != nil {
+		handleError(w, http.StatusForbidden, oerrors.ErrAccessDenied.Error())
+
+		return
+	} else if userID == "" {
+		return
+	}
+
+	if err := h.approveDevice(r.Context(), userCode, userID); err != nil {
+		log := logger.WithRequestId(r)
+		log.Warn().Err(err).Str("user_id", userID).Msg("device approval rejected")
+
+		data, status, header := h.srv.GetErrorData(errors.Cause(err))
+		writeTokenResponse(w, r, data, header, status)
+
+		return
+	}
+
+	// the form can't be posted again
+	http.SetCookie(w, &http.Cookie{Name: deviceCSRFCookie, Path: r.URL.Path, MaxAge: -1})
+
+	resp, err := json.Marshal(&DeviceResponse{
+		Message: "The device is authorized",
+	})
+	if err != nil {
 		log := logger.WithRequestId(r)
-		log.Error().Err(errors.WithStack(err)).Msg("failed to handle token request")
+		log.Error().Err(errors.WithStack(err)).Msg("failed to marshal device approval response")
 
 		handleError(w, http.StatusInternalServerError, err.Error())
+
+		return
 	}
+
+	w.Header().Set(contentTypeHeader, contentTypeJSON)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resp)
 }
 
 func (h *Handler) secure(w http.ResponseWriter, r *http.Request) {
@@ -103,6 +516,68 @@ func (h *Handler) secure(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(resp)
 }
 
+// keySet serves the JWKS of the public keys verifying the access tokens, see resource.JWKS.
+func (h *Handler) keySet(w http.ResponseWriter, r *http.Request) {
+	// the set changes once the previous key expires, so it's built on every request
+	set := h.jwks()
+	resp, err := json.Marshal(&set)
+	if err != nil {
+		log := logger.WithRequestId(r)
+		log.Error().Err(errors.WithStack(err)).Msg("failed to marshal JWKS")
+
+		handleError(w, http.StatusInternalServerError, somethingWentWrongMsg)
+
+		return
+	}
+
+	// the resource servers refetch it on their own once a token names an unknown key
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Set(contentTypeHeader, contentTypeJSON)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resp)
+}
+
+// clientInfo gets the client credentials from Basic Authentication.
+//
+// Public clients have no credentials and are identified by the client_id parameter instead.
+func clientInfo(r *http.Request) (string, string, error) {
+	if clientID, clientSecret, ok := r.BasicAuth(); ok {
+		return clientID, clientSecret, nil
+	}
+
+	if clientID := r.FormValue("client_id"); clientID != "" {
+		return clientID, "", nil
+	}
+
+	return "", "", oerrors.ErrInvalidClient
+}
+
+func extensionFields(ti oauth2.TokenInfo) map[string]interface{} {
+	if ef, ok := ti.(ExtensionFields); ok {
+		return ef.ExtensionFields()
+	}
+
+	return nil
+}
+
+// writeTokenResponse writes the token endpoint response (RFC 6749 section 5).
+func writeTokenResponse(w http.ResponseWriter, r *http.Request, data map[string]interface{}, header http.Header, status int) {
+	w.Header().Set(contentTypeHeader, contentTypeJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	for key := range header {
+		w.Header().Set(key, header.Get(key))
+	}
+
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log := logger.WithRequestId(r)
+		log.Error().Err(errors.WithStack(err)).Msg("failed to write token response")
+	}
+}
+
 func handleError(w http.ResponseWriter, status int, errMsg string) {
 	resp, err := response.NewErrorBody(errMsg)
 	if err != nil {
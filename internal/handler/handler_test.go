@@ -1,18 +1,38 @@
 package handler
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"github.com/gorilla/mux"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
-	"oauth2/internal/config"
-	"oauth2/internal/service/auth"
+	"github.com/laonix/oauth2/internal/config"
+	"github.com/laonix/oauth2/internal/logger"
+	"github.com/laonix/oauth2/internal/metrics"
+	"github.com/laonix/oauth2/internal/service/auth"
+	"github.com/laonix/oauth2/internal/tracing"
 
-	"github.com/go-oauth2/oauth2/v4/models"
+	"github.com/go-oauth2/oauth2/v4"
 	"github.com/go-oauth2/oauth2/v4/store"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 const (
@@ -24,26 +44,38 @@ type GenerateTokenResponse struct {
 	Token string `json:"access_token"`
 }
 
-func TestGenerateToken(t *testing.T) {
-	cfg, err := config.LoadConfig()
+// mockClient is the confidential client of the tests.
+var mockClient = config.Client{ID: mockClientID, Secret: mockClientSecret}
+
+// loadTestConfig loads the config.yaml of the repository, the development config.
+func loadTestConfig(t *testing.T) *config.Config {
+	cfg, err := config.LoadConfig("../../config.yaml")
 	if err != nil {
-		panic(err)
+		t.Fatalf("could not load config: %v\n", err)
 	}
 
+	return cfg
+}
+
+// newTestManager returns the manager of the config, with an empty memory token store and the clients.
+func newTestManager(t *testing.T, cfg *config.Config, clients ...config.Client) *auth.Manager {
 	tokenRepo, err := store.NewMemoryTokenStore()
 	if err != nil {
-		panic(err)
+		t.Fatalf("could not create token store: %v\n", err)
 	}
 
-	clientRepo := store.NewClientStore()
+	clientRepo, err := auth.NewClientStore(clients)
+	if err != nil {
+		t.Fatalf("could not create client store: %v\n", err)
+	}
 
-	// mock user
-	clientRepo.Set(mockClientID, &models.Client{
-		ID:     mockClientID,
-		Secret: mockClientSecret,
-	})
+	return auth.NewManager(cfg, tokenRepo, clientRepo)
+}
 
-	srv := auth.NewManager(cfg, tokenRepo, clientRepo)
+func TestGenerateToken(t *testing.T) {
+	cfg := loadTestConfig(t)
+
+	srv := newTestManager(t, cfg, mockClient)
 
 	httpHandler := New(srv)
 
@@ -114,26 +146,61 @@ func TestGenerateToken(t *testing.T) {
 	}
 }
 
-func TestValidateTokenMiddleware(t *testing.T) {
-	cfg, err := config.LoadConfig()
-	if err != nil {
-		panic(err)
-	}
+func TestTokenKeyID(t *testing.T) {
+	cfg := loadTestConfig(t)
 
-	tokenRepo, err := store.NewMemoryTokenStore()
-	if err != nil {
-		panic(err)
+	hmacCfg := *cfg
+	hmacCfg.JWT.Algorithm = "HS256"
+	hmacCfg.JWT.Secret = "secret"
+
+	tests := []struct {
+		name          string
+		cfg           *config.Config
+		expectedKeyID interface{}
+	}{
+		{
+			// the JWK thumbprint of the RS256 key of config.yaml, see keys.TestThumbprint
+			name:          "Asymmetric key, named by its JWK thumbprint",
+			cfg:           cfg,
+			expectedKeyID: "TzTqMiZLXD4nDuLUEGNTozUTG1kE79l6OYqSboDVdiA",
+		},
+		{
+			name:          "HMAC secret, unnamed",
+			cfg:           &hmacCfg,
+			expectedKeyID: nil,
+		},
 	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpHandler := New(newTestManager(t, tt.cfg, mockClient))
 
-	clientRepo := store.NewClientStore()
+			req := httptest.NewRequest(http.MethodPost, "/token?grant_type=client_credentials", nil)
+			req.SetBasicAuth(mockClientID, mockClientSecret)
 
-	// mock user
-	clientRepo.Set(mockClientID, &models.Client{
-		ID:     mockClientID,
-		Secret: mockClientSecret,
-	})
+			w := httptest.NewRecorder()
+			httpHandler.generateToken(w, req)
+
+			var resp GenerateTokenResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("could not decode response: %v\n", err)
+			}
+
+			token, _, err := new(jwt.Parser).ParseUnverified(resp.Token, jwt.MapClaims{})
+			if err != nil {
+				t.Fatalf("could not decode token: %v\n", err)
+			}
 
-	srv := auth.NewManager(cfg, tokenRepo, clientRepo)
+			if kid := token.Header["kid"]; kid != tt.expectedKeyID {
+				t.Errorf("got kid %v but wanted %v\n", kid, tt.expectedKeyID)
+			}
+		})
+	}
+}
+
+func TestValidateTokenMiddleware(t *testing.T) {
+	cfg := loadTestConfig(t)
+
+	srv := newTestManager(t, cfg, mockClient)
 
 	httpHandler := New(srv)
 
@@ -144,9 +211,7 @@ func TestValidateTokenMiddleware(t *testing.T) {
 	httpHandler.generateToken(w, req)
 
 	var resp GenerateTokenResponse
-
-	err = json.NewDecoder(w.Body).Decode(&resp)
-	if err != nil {
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
 		t.Fatalf("could not decode response: %v\n", err)
 	}
 
@@ -157,6 +222,7 @@ func TestValidateTokenMiddleware(t *testing.T) {
 		w                  *httptest.ResponseRecorder
 		prepareRequest     func() *http.Request
 		expectedStatusCode int
+		expectedChallenge  string
 	}{
 		{
 			name: "Without token",
@@ -165,6 +231,7 @@ func TestValidateTokenMiddleware(t *testing.T) {
 				return httptest.NewRequest(http.MethodPost, "/secure", nil)
 			},
 			expectedStatusCode: http.StatusUnauthorized,
+			expectedChallenge:  "Bearer",
 		},
 		{
 			name: "Invalid token",
@@ -176,6 +243,7 @@ func TestValidateTokenMiddleware(t *testing.T) {
 				return req
 			},
 			expectedStatusCode: http.StatusUnauthorized,
+			expectedChallenge:  `Bearer error="invalid_token"`,
 		},
 		{
 			name: "Valid token",
@@ -201,6 +269,10 @@ func TestValidateTokenMiddleware(t *testing.T) {
 			if tt.w.Code != tt.expectedStatusCode {
 				t.Errorf("got status %d but wanted %d\n", tt.w.Code, tt.expectedStatusCode)
 			}
+
+			if challenge := tt.w.Header().Get("WWW-Authenticate"); challenge != tt.expectedChallenge {
+				t.Errorf("got challenge %q but wanted %q\n", challenge, tt.expectedChallenge)
+			}
 		})
 	}
 }
@@ -253,3 +325,1335 @@ func TestRecoveryMiddleware(t *testing.T) {
 		})
 	}
 }
+
+func TestJWTBearerGrant(t *testing.T) {
+	cfg := loadTestConfig(t)
+
+	issuerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate issuer key: %v\n", err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&issuerKey.PublicKey)
+	if err != nil {
+		t.Fatalf("could not marshal issuer key: %v\n", err)
+	}
+
+	srv := newTestManager(t, cfg, mockClient)
+
+	grant, err := auth.NewJWTBearerGrant(config.JWTBearer{
+		Issuers: []config.TrustedIssuer{
+			{
+				Issuer:     "https://batch.example.com",
+				Audience:   "oauth2",
+				PublicKeys: []string{string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))},
+				Clients: []config.SubjectClient{
+					{Subject: "nightly-report", ClientID: mockClientID},
+				},
+			},
+		},
+	}, srv)
+	if err != nil {
+		t.Fatalf("could not create jwt bearer grant: %v\n", err)
+	}
+
+	httpHandler := New(srv, WithGrant(auth.JWTBearerGrantType, grant.HandleTokenRequest))
+
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss": "https://batch.example.com",
+			"sub": "nightly-report",
+			"aud": "oauth2",
+			"exp": time.Now().Add(time.Minute).Unix(),
+		}
+	}
+
+	sign := func(t *testing.T, claims jwt.MapClaims) string {
+		assertion, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(issuerKey)
+		if err != nil {
+			t.Fatalf("could not sign assertion: %v\n", err)
+		}
+
+		return assertion
+	}
+
+	tests := []struct {
+		name               string
+		assertion          func(t *testing.T) string
+		expectedStatusCode int
+		accessTokenExists  bool
+	}{
+		{
+			name:               "Without assertion",
+			assertion:          func(t *testing.T) string { return "" },
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "Valid assertion",
+			assertion:          func(t *testing.T) string { return sign(t, validClaims()) },
+			expectedStatusCode: http.StatusOK,
+			accessTokenExists:  true,
+		},
+		{
+			name: "Untrusted issuer",
+			assertion: func(t *testing.T) string {
+				claims := validClaims()
+				claims["iss"] = "https://evil.example.com"
+
+				return sign(t, claims)
+			},
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name: "Expired assertion",
+			assertion: func(t *testing.T) string {
+				claims := validClaims()
+				claims["exp"] = time.Now().Add(-time.Hour).Unix()
+
+				return sign(t, claims)
+			},
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name: "Wrong audience",
+			assertion: func(t *testing.T) string {
+				claims := validClaims()
+				claims["aud"] = "someone-else"
+
+				return sign(t, claims)
+			},
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name: "Unmapped subject",
+			assertion: func(t *testing.T) string {
+				claims := validClaims()
+				claims["sub"] = "unknown-job"
+
+				return sign(t, claims)
+			},
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name: "Symmetric signature",
+			assertion: func(t *testing.T) string {
+				assertion, err := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims()).SignedString([]byte("secret"))
+				if err != nil {
+					t.Fatalf("could not sign assertion: %v\n", err)
+				}
+
+				return assertion
+			},
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{
+				"grant_type": {string(auth.JWTBearerGrantType)},
+				"assertion":  {tt.assertion(t)},
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			w := httptest.NewRecorder()
+			httpHandler.generateToken(w, req)
+
+			if w.Code != tt.expectedStatusCode {
+				t.Errorf("got status %d but wanted %d\n", w.Code, tt.expectedStatusCode)
+			}
+
+			var resp GenerateTokenResponse
+
+			err := json.NewDecoder(w.Body).Decode(&resp)
+			if err != nil {
+				t.Fatalf("could not decode response: %v\n", err)
+			}
+
+			if tt.accessTokenExists && resp.Token == "" {
+				t.Errorf("the token must be in the response\n")
+			}
+
+			if !tt.accessTokenExists && resp.Token != "" {
+				t.Errorf("the token must not be in the response, token: %s\n", resp.Token)
+			}
+		})
+	}
+}
+
+func TestTokenExchangeGrant(t *testing.T) {
+	cfg := loadTestConfig(t)
+
+	srv := newTestManager(t, cfg, mockClient)
+
+	grant, err := auth.NewTokenExchangeGrant(config.TokenExchange{
+		Policies: []config.ExchangePolicy{
+			{
+				ClientID:  mockClientID,
+				Audiences: []string{"orders-api"},
+				Scopes:    []string{"orders.read"},
+			},
+		},
+	}, srv)
+	if err != nil {
+		t.Fatalf("could not create token exchange grant: %v\n", err)
+	}
+
+	httpHandler := New(srv, WithGrant(auth.TokenExchangeGrantType, grant.HandleTokenRequest))
+
+	req := httptest.NewRequest(http.MethodPost, "/token?grant_type=client_credentials&scope=orders.read+orders.write", nil)
+	req.SetBasicAuth(mockClientID, mockClientSecret)
+
+	w := httptest.NewRecorder()
+	httpHandler.generateToken(w, req)
+
+	var resp GenerateTokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("could not decode response: %v\n", err)
+	}
+
+	subjectToken := resp.Token
+
+	tests := []struct {
+		name               string
+		form               url.Values
+		withoutClientAuth  bool
+		expectedStatusCode int
+		expectedScope      string
+	}{
+		{
+			name:               "Without client authentication",
+			form:               url.Values{"subject_token": {subjectToken}, "subject_token_type": {auth.AccessTokenType}},
+			withoutClientAuth:  true,
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:               "Without subject token",
+			form:               url.Values{"audience": {"orders-api"}},
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "Unknown subject token",
+			form:               url.Values{"subject_token": {"mock_token"}, "subject_token_type": {auth.AccessTokenType}},
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name: "Audience not allowed",
+			form: url.Values{
+				"subject_token":      {subjectToken},
+				"subject_token_type": {auth.AccessTokenType},
+				"audience":           {"billing-api"},
+			},
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "Scope not allowed",
+			form: url.Values{
+				"subject_token":      {subjectToken},
+				"subject_token_type": {auth.AccessTokenType},
+				"scope":              {"orders.write"},
+			},
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "Down-scoped and re-audienced token",
+			form: url.Values{
+				"subject_token":      {subjectToken},
+				"subject_token_type": {auth.AccessTokenType},
+				"audience":           {"orders-api"},
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedScope:      "orders.read",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.form.Set("grant_type", string(auth.TokenExchangeGrantType))
+
+			req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(tt.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if !tt.withoutClientAuth {
+				req.SetBasicAuth(mockClientID, mockClientSecret)
+			}
+
+			w := httptest.NewRecorder()
+			httpHandler.generateToken(w, req)
+
+			if w.Code != tt.expectedStatusCode {
+				t.Errorf("got status %d but wanted %d\n", w.Code, tt.expectedStatusCode)
+			}
+
+			if tt.expectedStatusCode != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Token           string `json:"access_token"`
+				Scope           string `json:"scope"`
+				IssuedTokenType string `json:"issued_token_type"`
+			}
+
+			err := json.NewDecoder(w.Body).Decode(&resp)
+			if err != nil {
+				t.Fatalf("could not decode response: %v\n", err)
+			}
+
+			if resp.IssuedTokenType != auth.AccessTokenType {
+				t.Errorf("got issued token type %q but wanted %q\n", resp.IssuedTokenType, auth.AccessTokenType)
+			}
+
+			if resp.Scope != tt.expectedScope {
+				t.Errorf("got scope %q but wanted %q\n", resp.Scope, tt.expectedScope)
+			}
+
+			claims := &auth.AccessClaims{}
+			if _, _, err := new(jwt.Parser).ParseUnverified(resp.Token, claims); err != nil {
+				t.Fatalf("could not parse token: %v\n", err)
+			}
+
+			if claims.Audience != "orders-api" {
+				t.Errorf("got audience %q but wanted %q\n", claims.Audience, "orders-api")
+			}
+
+			if claims.Actor == nil || claims.Actor.Subject != mockClientID {
+				t.Errorf("the token must carry the act claim of the client\n")
+			}
+		})
+	}
+}
+
+func TestRefreshGrant(t *testing.T) {
+	cfg := loadTestConfig(t)
+
+	srv := newTestManager(t, cfg, config.Client{ID: mockClientID, Secret: mockClientSecret, RefreshTokens: true})
+
+	httpHandler := New(srv, WithGrant(oauth2.Refreshing, auth.NewRefreshGrant(cfg.JWT, srv).HandleTokenRequest))
+
+	type refreshTokenResponse struct {
+		Token        string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	requestToken := func(form url.Values) (int, refreshTokenResponse) {
+		req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(mockClientID, mockClientSecret)
+
+		w := httptest.NewRecorder()
+		httpHandler.generateToken(w, req)
+
+		var resp refreshTokenResponse
+
+		err := json.NewDecoder(w.Body).Decode(&resp)
+		if err != nil {
+			t.Fatalf("could not decode response: %v\n", err)
+		}
+
+		return w.Code, resp
+	}
+
+	refresh := func(refreshToken string) (int, refreshTokenResponse) {
+		return requestToken(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}})
+	}
+
+	status, issued := requestToken(url.Values{"grant_type": {"client_credentials"}})
+	if status != http.StatusOK || issued.RefreshToken == "" {
+		t.Fatalf("the refresh token must be issued, status: %d\n", status)
+	}
+
+	status, rotated := refresh(issued.RefreshToken)
+	if status != http.StatusOK {
+		t.Fatalf("got status %d but wanted %d\n", status, http.StatusOK)
+	}
+
+	if rotated.RefreshToken == "" || rotated.RefreshToken == issued.RefreshToken {
+		t.Errorf("the refresh token must be rotated\n")
+	}
+
+	if status, _ := refresh(issued.RefreshToken); status != http.StatusUnauthorized {
+		t.Errorf("reused refresh token: got status %d but wanted %d\n", status, http.StatusUnauthorized)
+	}
+
+	if status, _ := refresh(rotated.RefreshToken); status != http.StatusUnauthorized {
+		t.Errorf("refresh token of revoked family: got status %d but wanted %d\n", status, http.StatusUnauthorized)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/secure", nil)
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", rotated.Token))
+
+	w := httptest.NewRecorder()
+	httpHandler.validateTokenMiddleware(http.HandlerFunc(httpHandler.secure)).ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("access token of revoked family: got status %d but wanted %d\n", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAuthorizationCodeGrant(t *testing.T) {
+	const (
+		publicClientID = "cli"
+		redirectURI    = "http://127.0.0.1:8085/callback"
+		codeVerifier   = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+		codeChallenge  = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	)
+
+	cfg := loadTestConfig(t)
+
+	srv := newTestManager(t, cfg, config.Client{ID: publicClientID, Public: true, RedirectURIs: []string{redirectURI}})
+
+	httpHandler := New(srv, WithUserAuthenticator(func(w http.ResponseWriter, r *http.Request) (string, error) {
+		return "alice", nil
+	}))
+
+	authorize := func(query url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/authorize?"+query.Encode(), nil)
+
+		w := httptest.NewRecorder()
+		httpHandler.authorize(w, req)
+
+		return w
+	}
+
+	authorizeQuery := func() url.Values {
+		return url.Values{
+			"response_type":         {"code"},
+			"client_id":             {publicClientID},
+			"redirect_uri":          {redirectURI},
+			"state":                 {"xyz"},
+			"code_challenge":        {codeChallenge},
+			"code_challenge_method": {"S256"},
+		}
+	}
+
+	t.Run("Unregistered redirect URI", func(t *testing.T) {
+		query := authorizeQuery()
+		query.Set("redirect_uri", "http://127.0.0.1:8085/evil")
+
+		w := authorize(query)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("got status %d but wanted %d\n", w.Code, http.StatusBadRequest)
+		}
+
+		if location := w.Header().Get("Location"); location != "" {
+			t.Errorf("the error must not be redirected, location: %s\n", location)
+		}
+	})
+
+	t.Run("Plain code challenge", func(t *testing.T) {
+		query := authorizeQuery()
+		query.Set("code_challenge_method", "plain")
+
+		w := authorize(query)
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("could not parse location: %v\n", err)
+		}
+
+		if w.Code != http.StatusFound || location.Query().Get("error") != "invalid_request" {
+			t.Errorf("got status %d and location %s but wanted an invalid_request redirect\n", w.Code, location)
+		}
+	})
+
+	w := authorize(authorizeQuery())
+	if w.Code != http.StatusFound {
+		t.Fatalf("got status %d but wanted %d\n", w.Code, http.StatusFound)
+	}
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("could not parse location: %v\n", err)
+	}
+
+	if location.Query().Get("state") != "xyz" {
+		t.Errorf("the state must be passed back to the client\n")
+	}
+
+	code := location.Query().Get("code")
+
+	tests := []struct {
+		name               string
+		codeVerifier       string
+		expectedStatusCode int
+	}{
+		{
+			name:               "Wrong code verifier",
+			codeVerifier:       "wrong-verifier-wrong-verifier-wrong-verifier",
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:               "Valid code verifier",
+			codeVerifier:       codeVerifier,
+			expectedStatusCode: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the code is consumed by a failed exchange as well, so every exchange gets a new one
+			w := authorize(authorizeQuery())
+			location, _ := url.Parse(w.Header().Get("Location"))
+			code = location.Query().Get("code")
+
+			form := url.Values{
+				"grant_type":    {"authorization_code"},
+				"client_id":     {publicClientID},
+				"code":          {code},
+				"redirect_uri":  {redirectURI},
+				"code_verifier": {tt.codeVerifier},
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			w = httptest.NewRecorder()
+			httpHandler.generateToken(w, req)
+
+			if w.Code != tt.expectedStatusCode {
+				t.Errorf("got status %d but wanted %d\n", w.Code, tt.expectedStatusCode)
+			}
+
+			if tt.expectedStatusCode != http.StatusOK {
+				return
+			}
+
+			var resp GenerateTokenResponse
+
+			err := json.NewDecoder(w.Body).Decode(&resp)
+			if err != nil {
+				t.Fatalf("could not decode response: %v\n", err)
+			}
+
+			claims := &auth.AccessClaims{}
+			if _, _, err := new(jwt.Parser).ParseUnverified(resp.Token, claims); err != nil {
+				t.Fatalf("could not parse token: %v\n", err)
+			}
+
+			if claims.Subject != "alice" {
+				t.Errorf("got subject %q but wanted %q\n", claims.Subject, "alice")
+			}
+		})
+	}
+}
+
+func TestDeviceAuthorizationGrant(t *testing.T) {
+	const publicClientID = "cli"
+
+	cfg := loadTestConfig(t)
+
+	srv := newTestManager(t, cfg, config.Client{ID: publicClientID, Public: true})
+	device := auth.NewDeviceGrant(config.DeviceCode{
+		VerificationURI: "http://localhost:3000/device",
+		ExpiresIn:       time.Minute,
+		Interval:        time.Minute,
+	}, srv)
+
+	httpHandler := New(srv,
+		WithUserAuthenticator(func(w http.ResponseWriter, r *http.Request) (string, error) {
+			return "alice", nil
+		}),
+		WithDeviceAuthorization(device.HandleDeviceAuthorizationRequest, device.Approve),
+		WithGrant(auth.DeviceCodeGrantType, device.HandleTokenRequest),
+	)
+
+	post := func(handle http.HandlerFunc, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		w := httptest.NewRecorder()
+		handle(w, req)
+
+		return w
+	}
+
+	w := post(httpHandler.deviceAuthorization, url.Values{"client_id": {publicClientID}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d but wanted %d\n", w.Code, http.StatusOK)
+	}
+
+	var authorization struct {
+		DeviceCode string `json:"device_code"`
+		UserCode   string `json:"user_code"`
+	}
+
+	if err := json.NewDecoder(w.Body).Decode(&authorization); err != nil {
+		t.Fatalf("could not decode response: %v\n", err)
+	}
+
+	poll := func() (int, string, string) {
+		w := post(httpHandler.generateToken, url.Values{
+			"grant_type":  {string(auth.DeviceCodeGrantType)},
+			"client_id":   {publicClientID},
+			"device_code": {authorization.DeviceCode},
+		})
+
+		var resp struct {
+			Error string `json:"error"`
+			Token string `json:"access_token"`
+		}
+
+		err := json.NewDecoder(w.Body).Decode(&resp)
+		if err != nil {
+			t.Fatalf("could not decode response: %v\n", err)
+		}
+
+		return w.Code, resp.Error, resp.Token
+	}
+
+	if status, errCode, _ := poll(); status != http.StatusBadRequest || errCode != "authorization_pending" {
+		t.Errorf("got status %d and error %q but wanted authorization_pending\n", status, errCode)
+	}
+
+	if status, errCode, _ := poll(); status != http.StatusBadRequest || errCode != "slow_down" {
+		t.Errorf("got status %d and error %q but wanted slow_down\n", status, errCode)
+	}
+
+	// following verification_uri_complete only shows the confirmation form
+	req := httptest.NewRequest(http.MethodGet, "/device?"+url.Values{"user_code": {authorization.UserCode}}.Encode(), nil)
+	w = httptest.NewRecorder()
+	httpHandler.confirmDeviceAuthorization(w, req)
+
+	var csrfCookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == deviceCSRFCookie {
+			csrfCookie = c
+		}
+	}
+
+	if w.Code != http.StatusOK || csrfCookie == nil || !strings.Contains(w.Body.String(), csrfCookie.Value) ||
+		!strings.Contains(w.Body.String(), authorization.UserCode) {
+		t.Fatalf("confirmation: got status %d and body %q but wanted the form\n", w.Code, w.Body.String())
+	}
+
+	if status, errCode, _ := poll(); status != http.StatusBadRequest || errCode != "slow_down" {
+		t.Errorf("after confirmation page: got status %d and error %q but wanted the device still pending\n", status, errCode)
+	}
+
+	approve := func(form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/device", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+
+		w := httptest.NewRecorder()
+		httpHandler.approveDeviceAuthorization(w, req)
+
+		return w
+	}
+
+	userCode := strings.ToLower(authorization.UserCode)
+
+	if w = approve(url.Values{"user_code": {userCode}}, nil); w.Code != http.StatusForbidden {
+		t.Errorf("approval without CSRF token: got status %d but wanted %d\n", w.Code, http.StatusForbidden)
+	}
+
+	if w = approve(url.Values{"user_code": {userCode}, "csrf_token": {"forged"}}, csrfCookie); w.Code != http.StatusForbidden {
+		t.Errorf("approval with forged CSRF token: got status %d but wanted %d\n", w.Code, http.StatusForbidden)
+	}
+
+	w = approve(url.Values{"user_code": {userCode}, "csrf_token": {csrfCookie.Value}}, csrfCookie)
+	if w.Code != http.StatusOK {
+		t.Fatalf("approval: got status %d but wanted %d\n", w.Code, http.StatusOK)
+	}
+
+	status, _, token := poll()
+	if status != http.StatusOK || token == "" {
+		t.Fatalf("got status %d but wanted the token\n", status)
+	}
+
+	claims := &auth.AccessClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil {
+		t.Fatalf("could not parse token: %v\n", err)
+	}
+
+	if claims.Subject != "alice" {
+		t.Errorf("got subject %q but wanted %q\n", claims.Subject, "alice")
+	}
+
+	if status, errCode, _ := poll(); status != http.StatusBadRequest || errCode != "expired_token" {
+		t.Errorf("used device code: got status %d and error %q but wanted expired_token\n", status, errCode)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	cfg := loadTestConfig(t)
+
+	h := New(newTestManager(t, cfg, cfg.Clients...))
+	routes, adminRoutes := h.Routes(), h.AdminRoutes()
+
+	requests := metrics.HTTPRequests.WithLabelValues("/token", http.MethodPost, "401")
+	missing := metrics.ClientAuthFailures.WithLabelValues(metrics.AuthMissingCredentials)
+	unknown := metrics.ClientAuthFailures.WithLabelValues(metrics.AuthUnknownClient)
+	issued := metrics.TokensIssued.WithLabelValues(mockClientID, string(oauth2.ClientCredentials))
+	invalid := metrics.TokenValidations.WithLabelValues(metrics.ValidationInvalid)
+
+	before := []float64{
+		testutil.ToFloat64(requests),
+		testutil.ToFloat64(missing),
+		testutil.ToFloat64(unknown),
+		testutil.ToFloat64(issued),
+		testutil.ToFloat64(invalid),
+	}
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, req)
+
+		return w
+	}
+
+	serve(httptest.NewRequest(http.MethodPost, "/token?grant_type=client_credentials", nil))
+
+	req := httptest.NewRequest(http.MethodPost, "/token?grant_type=client_credentials", nil)
+	req.SetBasicAuth("unknown", mockClientSecret)
+	if w := serve(req); w.Code != http.StatusUnauthorized {
+		t.Errorf("unknown client: got status %d but wanted %d\n", w.Code, http.StatusUnauthorized)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/token?grant_type=client_credentials", nil)
+	req.SetBasicAuth(mockClientID, mockClientSecret)
+	serve(req)
+
+	req = httptest.NewRequest(http.MethodPost, "/secure", nil)
+	req.Header.Set("Authorization", "Bearer unknown")
+	serve(req)
+
+	after := []float64{
+		testutil.ToFloat64(requests),
+		testutil.ToFloat64(missing),
+		testutil.ToFloat64(unknown),
+		testutil.ToFloat64(issued),
+		testutil.ToFloat64(invalid),
+	}
+
+	names := []string{"http_requests_total", "missing_credentials", "unknown_client", "tokens_issued_total", "token_validations_total"}
+	wanted := []float64{2, 1, 1, 1, 1}
+	for i := range names {
+		if got := after[i] - before[i]; got != wanted[i] {
+			t.Errorf("%s: got %v more but wanted %v more\n", names[i], got, wanted[i])
+		}
+	}
+
+	if w := serve(httptest.NewRequest(http.MethodGet, "/metrics", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("public routes: got status %d but wanted %d\n", w.Code, http.StatusNotFound)
+	}
+
+	w := httptest.NewRecorder()
+	adminRoutes.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d but wanted %d\n", w.Code, http.StatusOK)
+	}
+
+	if !strings.Contains(w.Body.String(), `oauth2_http_requests_total{method="POST",route="/token",status="401"}`) {
+		t.Errorf("the metrics must contain the token requests\n")
+	}
+}
+
+func TestTracing(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	cfg := loadTestConfig(t)
+
+	if _, err := tracing.Init(config.Tracing{Exporter: tracing.ExporterNone}); err != nil {
+		t.Fatalf("could not init tracing: %v\n", err)
+	}
+
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	// the stores are instrumented, unlike the ones of newTestManager
+	tokenRepo, err := store.NewMemoryTokenStore()
+	if err != nil {
+		t.Fatalf("could not create token store: %v\n", err)
+	}
+
+	clientRepo, err := auth.NewClientStore(cfg.Clients)
+	if err != nil {
+		t.Fatalf("could not create client store: %v\n", err)
+	}
+
+	srv := auth.NewManager(cfg, tracing.InstrumentTokenStore(tokenRepo), tracing.InstrumentClientStore(clientRepo))
+	routes := New(srv).Routes()
+
+	req := httptest.NewRequest(http.MethodPost, "/token?grant_type=client_credentials", nil)
+	req.SetBasicAuth(mockClientID, mockClientSecret)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+
+	w := httptest.NewRecorder()
+	routes.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d but wanted %d\n", w.Code, http.StatusOK)
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+
+		if got := span.SpanContext().TraceID().String(); got != traceID {
+			t.Errorf("span %q: got trace id %s but wanted %s\n", span.Name(), got, traceID)
+		}
+	}
+
+	for _, name := range []string{"POST /token", "HandleTokenRequest", "ClientStore.GetByID", "GenerateAccessToken", "TokenStore.Create"} {
+		if _, ok := spans[name]; !ok {
+			t.Errorf("span %q must be recorded\n", name)
+		}
+	}
+
+	if server, ok := spans["POST /token"]; ok && server.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("the server span must continue the incoming trace\n")
+	}
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	const adminToken = "admin-token"
+
+	cfg := loadTestConfig(t)
+
+	routes := New(newTestManager(t, cfg, cfg.Clients...), WithConfig(cfg), WithAdminToken(adminToken)).AdminRoutes()
+
+	defer logger.SetLogLevel(int(logger.Level()))
+
+	tests := []struct {
+		name               string
+		method             string
+		path               string
+		token              string
+		body               string
+		expectedStatusCode int
+	}{
+		{
+			name:               "Without admin token",
+			method:             http.MethodPut,
+			path:               "/admin/log/level",
+			body:               `{"level":"warn"}`,
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:               "Invalid admin token",
+			method:             http.MethodPut,
+			path:               "/admin/log/level",
+			token:              "invalid",
+			body:               `{"level":"warn"}`,
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:               "Invalid level",
+			method:             http.MethodPut,
+			path:               "/admin/log/level",
+			token:              adminToken,
+			body:               `{"level":"loud"}`,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "The level should be set",
+			method:             http.MethodPut,
+			path:               "/admin/log/level",
+			token:              adminToken,
+			body:               `{"level":"warn"}`,
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Override without client_id and request_id",
+			method:             http.MethodPost,
+			path:               "/admin/log/overrides",
+			token:              adminToken,
+			body:               `{"level":"debug"}`,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "Override with a too long ttl",
+			method:             http.MethodPost,
+			path:               "/admin/log/overrides",
+			token:              adminToken,
+			body:               `{"client_id":"client_id","level":"debug","ttl":"48h"}`,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "The override should be set",
+			method:             http.MethodPost,
+			path:               "/admin/log/overrides",
+			token:              adminToken,
+			body:               `{"client_id":"client_id","level":"debug","ttl":"1m"}`,
+			expectedStatusCode: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			w := httptest.NewRecorder()
+			routes.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatusCode {
+				t.Errorf("got status %d but wanted %d\n", w.Code, tt.expectedStatusCode)
+			}
+		})
+	}
+
+	if logger.Level() != zerolog.WarnLevel {
+		t.Errorf("got level %s but wanted %s\n", logger.Level(), zerolog.WarnLevel)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/config", nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+
+	w := httptest.NewRecorder()
+	routes.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("config: got status %d but wanted %d\n", w.Code, http.StatusOK)
+	}
+
+	if strings.Contains(w.Body.String(), mockClientSecret) || strings.Contains(w.Body.String(), adminToken) {
+		t.Errorf("the config must not contain secrets\n")
+	}
+
+	var effective config.Effective
+	if err := json.Unmarshal(w.Body.Bytes(), &effective); err != nil {
+		t.Errorf("config: %v\n", err)
+	}
+
+	if source := effective.Sources["http.port"]; source != "file ../../config.yaml" {
+		t.Errorf("config: got source %q of http.port but wanted %q\n", source, "file ../../config.yaml")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/config?format=yaml", nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+
+	w = httptest.NewRecorder()
+	routes.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `port: "3000" # file ../../config.yaml`) {
+		t.Errorf("yaml config: got status %d and body %s\n", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/token", nil)
+	req.SetBasicAuth(mockClientID, mockClientSecret)
+	if level := enabledLevel(logger.WithRequestId(req)); level != zerolog.DebugLevel {
+		t.Errorf("overridden client: got level %s but wanted %s\n", level, zerolog.DebugLevel)
+	}
+
+	// the other clients log at the log level, filtered when written, see logger.TestLevelChanges
+	overrides := logger.Overrides()
+	if len(overrides) != 1 || overrides[0].Field != logger.OverrideClientID || overrides[0].Value != mockClientID {
+		t.Errorf("got overrides %+v but wanted the one of client %q\n", overrides, mockClientID)
+	}
+}
+
+// enabledLevel returns the lowest level the logger logs at.
+func enabledLevel(log zerolog.Logger) zerolog.Level {
+	for level := zerolog.TraceLevel; level < zerolog.NoLevel; level++ {
+		if e := log.WithLevel(level); e.Enabled() {
+			e.Discard()
+
+			return level
+		}
+	}
+
+	return zerolog.Disabled
+}
+
+func TestAccessLogRedaction(t *testing.T) {
+	a := newAccessLog(config.AccessLog{
+		Headers:       []string{"Authorization", "X-Forwarded-For", "X-Session"},
+		RedactQuery:   []string{"session"},
+		RedactHeaders: []string{"x-session"},
+	})
+
+	tests := []struct {
+		name        string
+		url         string
+		expectedURI string
+	}{
+		{
+			name:        "Without query",
+			url:         "/token",
+			expectedURI: "/token",
+		},
+		{
+			name:        "Credentials",
+			url:         "/token?grant_type=authorization_code&code=abc&code_verifier=xyz&redirect_uri=https%3A%2F%2Fapp",
+			expectedURI: "/token?grant_type=authorization_code&code=REDACTED&code_verifier=REDACTED&redirect_uri=https%3A%2F%2Fapp",
+		},
+		{
+			name:        "Case insensitive and escaped names",
+			url:         "/token?Client_Secret=abc&client%5Fsecret=abc",
+			expectedURI: "/token?Client_Secret=REDACTED&client%5Fsecret=REDACTED",
+		},
+		{
+			name:        "Configured parameter",
+			url:         "/secure?session=abc&page=2",
+			expectedURI: "/secure?session=REDACTED&page=2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.url, nil)
+
+			if uri := a.redactURI(req.URL); uri != tt.expectedURI {
+				t.Errorf("got %q but wanted %q\n", uri, tt.expectedURI)
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/secure", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	req.Header.Set("X-Session", "abc")
+
+	var buf strings.Builder
+	log := zerolog.New(&buf)
+	log.Info().Dict("headers", a.headersOf(req)).Send()
+
+	expected := `{"level":"info","headers":{"Authorization":"REDACTED","X-Forwarded-For":"10.0.0.1","X-Session":"REDACTED"}}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("got %s but wanted %s\n", buf.String(), expected)
+	}
+}
+
+func TestTrackMiddleware(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	tests := []struct {
+		name              string
+		trust             bool
+		headers           map[string]string
+		expectedRequestID string
+	}{
+		{
+			name:    "Without headers",
+			trust:   true,
+			headers: map[string]string{},
+		},
+		{
+			name:              "Trusted X-Request-ID",
+			trust:             true,
+			headers:           map[string]string{"X-Request-ID": "ingress-1234.abc"},
+			expectedRequestID: "ingress-1234.abc",
+		},
+		{
+			name:    "Untrusted X-Request-ID",
+			trust:   false,
+			headers: map[string]string{"X-Request-ID": "ingress-1234.abc"},
+		},
+		{
+			name:    "Malformed X-Request-ID",
+			trust:   true,
+			headers: map[string]string{"X-Request-ID": "id\nwith newline"},
+		},
+		{
+			name:    "Too long X-Request-ID",
+			trust:   true,
+			headers: map[string]string{"X-Request-ID": strings.Repeat("a", 129)},
+		},
+		{
+			name:              "Trace id of traceparent",
+			trust:             true,
+			headers:           map[string]string{"traceparent": "00-" + traceID + "-00f067aa0ba902b7-01"},
+			expectedRequestID: traceID,
+		},
+		{
+			name:    "Invalid trace id of traceparent",
+			trust:   true,
+			headers: map[string]string{"traceparent": "00-" + strings.Repeat("0", 32) + "-00f067aa0ba902b7-01"},
+		},
+		{
+			name:  "X-Request-ID before traceparent",
+			trust: true,
+			headers: map[string]string{
+				"X-Request-ID": "ingress-1234",
+				"traceparent":  "00-" + traceID + "-00f067aa0ba902b7-01",
+			},
+			expectedRequestID: "ingress-1234",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New(nil, WithTrustedRequestID(tt.trust))
+
+			var contextRequestID string
+			track := h.trackMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				contextRequestID, _ = logger.RequestIDFromContext(r.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/health", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			w := httptest.NewRecorder()
+			track.ServeHTTP(w, req)
+
+			requestID := w.Header().Get("X-Request-ID")
+			if requestID != contextRequestID {
+				t.Errorf("got request id %q in the header but %q in the context\n", requestID, contextRequestID)
+			}
+
+			if tt.expectedRequestID != "" && requestID != tt.expectedRequestID {
+				t.Errorf("got request id %q but wanted %q\n", requestID, tt.expectedRequestID)
+			}
+
+			if _, err := uuid.Parse(requestID); tt.expectedRequestID == "" && err != nil {
+				t.Errorf("got request id %q but wanted a new uuid\n", requestID)
+			}
+		})
+	}
+}
+
+func TestProbes(t *testing.T) {
+	cfg := loadTestConfig(t)
+
+	srv := newTestManager(t, cfg, cfg.Clients...)
+
+	noKeyCfg := *cfg
+	noKeyCfg.JWT.Secret = ""
+	noKeySrv := newTestManager(t, &noKeyCfg, cfg.Clients...)
+
+	ready := New(srv,
+		WithReadinessCheck("signing", srv.CheckSigning),
+		WithReadinessCheck("token_store", srv.CheckTokenStore),
+	)
+	draining := New(srv,
+		WithReadinessCheck("signing", srv.CheckSigning),
+	)
+	draining.Drain()
+	noKey := New(noKeySrv,
+		WithReadinessCheck("signing", noKeySrv.CheckSigning),
+	)
+
+	tests := []struct {
+		name               string
+		handler            *Handler
+		path               string
+		expectedStatusCode int
+		expectedChecks     map[string]string
+	}{
+		{
+			name:               "Alive",
+			handler:            draining,
+			path:               "/livez",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Ready",
+			handler:            ready,
+			path:               "/readyz",
+			expectedStatusCode: http.StatusOK,
+			expectedChecks:     map[string]string{"signing": "ok", "token_store": "ok"},
+		},
+		{
+			name:               "Shutting down",
+			handler:            draining,
+			path:               "/readyz",
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedChecks:     map[string]string{"signing": "ok", "shutdown": "server is shutting down"},
+		},
+		{
+			name:               "Signing key not loaded",
+			handler:            noKey,
+			path:               "/readyz",
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedChecks:     map[string]string{"signing": "signing key is not loaded"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.handler.Routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if w.Code != tt.expectedStatusCode {
+				t.Errorf("got status %d but wanted %d\n", w.Code, tt.expectedStatusCode)
+			}
+
+			if tt.expectedChecks == nil {
+				return
+			}
+
+			var resp ReadinessResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("could not decode response: %v\n", err)
+			}
+
+			if fmt.Sprint(resp.Checks) != fmt.Sprint(tt.expectedChecks) {
+				t.Errorf("got checks %v but wanted %v\n", resp.Checks, tt.expectedChecks)
+			}
+		})
+	}
+}
+
+func TestInFlightMiddleware(t *testing.T) {
+	h := New(nil)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	inFlight := h.inFlightMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			inFlight.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/token", nil))
+			done <- struct{}{}
+		}()
+	}
+
+	<-started
+	<-started
+
+	if got := h.InFlight(); got != 2 {
+		t.Errorf("got %d requests in flight but wanted 2\n", got)
+	}
+
+	close(release)
+	<-done
+	<-done
+
+	if got := h.InFlight(); got != 0 {
+		t.Errorf("got %d requests in flight but wanted 0\n", got)
+	}
+}
+
+func TestProbesAreNotInFlight(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	h := New(nil, WithReadinessCheck("slow", func(ctx context.Context) error {
+		started <- struct{}{}
+		<-release
+
+		return nil
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		h.Routes().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		done <- struct{}{}
+	}()
+
+	<-started
+
+	if got := h.InFlight(); got != 0 {
+		t.Errorf("got %d requests in flight during a readiness probe but wanted 0\n", got)
+	}
+
+	close(release)
+	<-done
+}
+
+func TestPlainHTTPRoutes(t *testing.T) {
+	h := New(nil)
+
+	tests := []struct {
+		name               string
+		mode               string
+		tlsPort            string
+		method             string
+		url                string
+		prepareRequest     func(r *http.Request)
+		expectedStatusCode int
+		expectedLocation   string
+	}{
+		{
+			name:               "Token request in redirect mode",
+			mode:               PlainHTTPRedirect,
+			tlsPort:            "3000",
+			method:             http.MethodPost,
+			url:                "http://oauth.example.com:8080/token?grant_type=client_credentials",
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "Device authorization request in redirect mode",
+			mode:               PlainHTTPRedirect,
+			tlsPort:            "3000",
+			method:             http.MethodPost,
+			url:                "http://oauth.example.com:8080/device_authorization",
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:    "Bearer token in redirect mode",
+			mode:    PlainHTTPRedirect,
+			tlsPort: "3000",
+			method:  http.MethodPost,
+			url:     "http://oauth.example.com:8080/secure",
+			prepareRequest: func(r *http.Request) {
+				r.Header.Set("Authorization", "Bearer token")
+			},
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "Authorization request in redirect mode",
+			mode:               PlainHTTPRedirect,
+			tlsPort:            "3000",
+			method:             http.MethodGet,
+			url:                "http://oauth.example.com:8080/authorize?client_id=cli",
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:    "Request with credentials in redirect mode",
+			mode:    PlainHTTPRedirect,
+			tlsPort: "3000",
+			method:  http.MethodGet,
+			url:     "http://oauth.example.com:8080/.well-known/jwks.json",
+			prepareRequest: func(r *http.Request) {
+				r.SetBasicAuth("cli", "secret")
+			},
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "Redirect",
+			mode:               PlainHTTPRedirect,
+			tlsPort:            "3000",
+			method:             http.MethodGet,
+			url:                "http://oauth.example.com:8080/.well-known/jwks.json?v=1",
+			expectedStatusCode: http.StatusPermanentRedirect,
+			expectedLocation:   "https://oauth.example.com:3000/.well-known/jwks.json?v=1",
+		},
+		{
+			name:               "Redirect to the default port",
+			mode:               PlainHTTPRedirect,
+			tlsPort:            "443",
+			method:             http.MethodGet,
+			url:                "http://oauth.example.com/livez",
+			expectedStatusCode: http.StatusPermanentRedirect,
+			expectedLocation:   "https://oauth.example.com/livez",
+		},
+		{
+			name:               "Refuse",
+			mode:               PlainHTTPRefuse,
+			tlsPort:            "3000",
+			method:             http.MethodGet,
+			url:                "http://oauth.example.com:8080/authorize?client_id=cli",
+			expectedStatusCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, nil)
+			if tt.prepareRequest != nil {
+				tt.prepareRequest(req)
+			}
+
+			w := httptest.NewRecorder()
+			h.PlainHTTPRoutes(tt.mode, tt.tlsPort).ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatusCode {
+				t.Errorf("got status %d but wanted %d\n", w.Code, tt.expectedStatusCode)
+			}
+
+			if location := w.Header().Get("Location"); location != tt.expectedLocation {
+				t.Errorf("got location %q but wanted %q\n", location, tt.expectedLocation)
+			}
+		})
+	}
+}
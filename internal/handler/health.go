@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/laonix/oauth2/internal/logger"
+	"github.com/laonix/oauth2/internal/metrics"
+)
+
+const readinessCheckTimeout = 2 * time.Second
+
+// ReadinessCheck checks a dependency the server needs to serve requests.
+type ReadinessCheck func(ctx context.Context) error
+
+// ReadinessResponse is a response for readiness method.
+type ReadinessResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// WithReadinessCheck adds a named check to the readiness of the server.
+func WithReadinessCheck(name string, check ReadinessCheck) Option {
+	return func(h *Handler) {
+		h.readinessChecks[name] = check
+	}
+}
+
+// Drain makes the server report not ready, so that no new traffic is routed to it before it shuts down.
+func (h *Handler) Drain() {
+	h.draining.Store(true)
+}
+
+// InFlight returns the number of requests being served.
+func (h *Handler) InFlight() int64 {
+	return h.inFlight.Load()
+}
+
+// inFlightMiddleware keeps track of the requests being served.
+func (h *Handler) inFlightMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.inFlight.Add(1)
+		metrics.HTTPRequestsInFlight.Inc()
+
+		defer func() {
+			h.inFlight.Add(-1)
+			metrics.HTTPRequestsInFlight.Dec()
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// livez reports that the server is alive, that is, it serves requests.
+func (h *Handler) livez(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("OK"))
+}
+
+// readyz reports whether the server is ready to serve requests: it isn't shutting down and all its checks pass.
+func (h *Handler) readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+	defer cancel()
+
+	resp := &ReadinessResponse{
+		Status: "ok",
+		Checks: make(map[string]string, len(h.readinessChecks)+1),
+	}
+
+	if h.draining.Load() {
+		resp.Status = "unavailable"
+		resp.Checks["shutdown"] = "server is shutting down"
+	}
+
+	names := make([]string, 0, len(h.readinessChecks))
+	for name := range h.readinessChecks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := h.readinessChecks[name](ctx); err != nil {
+			log := logger.WithRequestId(r)
+			log.Warn().Err(err).Str("check", name).Msg("readiness check failed")
+
+			resp.Status = "unavailable"
+			resp.Checks[name] = err.Error()
+
+			continue
+		}
+
+		resp.Checks[name] = "ok"
+	}
+
+	status := http.StatusOK
+	if resp.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, r, status, resp)
+}
@@ -4,32 +4,89 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
+	oerrors "github.com/go-oauth2/oauth2/v4/errors"
 	"github.com/google/uuid"
-
-	"oauth2/internal/logger"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/laonix/oauth2/internal/logger"
+	"github.com/laonix/oauth2/internal/metrics"
+	"github.com/laonix/oauth2/internal/tracing"
+	"github.com/laonix/oauth2/pkg/resource"
 )
 
 const (
+	requestIDHeader       = "X-Request-ID"
 	somethingWentWrongMsg = "Something went wrong"
 	contentTypeJSON       = "application/json;charset=UTF-8"
+	contentTypeYAML       = "application/yaml;charset=UTF-8"
 	contentTypeHeader     = "Content-Type"
 )
 
+var (
+	requestIDPattern   = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+	traceparentPattern = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-[0-9a-f]{16}-[0-9a-f]{2}$`)
+)
+
+// validateTokenMiddleware verifies the bearer token the way the resource servers do, with the resource.Verifier
+// of the manager if it has one, then checks that it is still in the token store, which it leaves once revoked.
+//
+// The claims of the token are put in the request context, see resource.ClaimsFromContext. A rejected token is
+// answered with resource.Unauthorized, with the WWW-Authenticate challenge of RFC 6750.
 func (h *Handler) validateTokenMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, err := h.srv.ValidationBearerToken(r)
+		if h.verifier != nil {
+			claims, err := h.verifier.Verify(r.Context(), resource.BearerToken(r))
+			if err != nil {
+				metrics.TokenValidations.WithLabelValues(validationOutcome(err)).Inc()
+				resource.Unauthorized(w, err)
+
+				return
+			}
+
+			r = r.WithContext(resource.WithClaims(r.Context(), claims))
+		}
+
+		ti, err := h.srv.ValidationBearerToken(r)
+		metrics.TokenValidations.WithLabelValues(validationOutcome(err)).Inc()
 		if err != nil {
-			handleError(w, http.StatusUnauthorized, err.Error())
+			resource.Unauthorized(w, err)
 
 			return
 		}
 
+		if entry, ok := r.Context().Value(accessLogKey{}).(*accessLogEntry); ok {
+			entry.clientID = ti.GetClientID()
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
 
+// validationOutcome returns the outcome of a bearer token validation for the token_validations_total metric.
+func validationOutcome(err error) string {
+	switch errors.Cause(err) {
+	case nil:
+		return metrics.ValidationValid
+	case oerrors.ErrInvalidAccessToken, resource.ErrMissingToken, resource.ErrInvalidToken:
+		return metrics.ValidationInvalid
+	case oerrors.ErrExpiredAccessToken, resource.ErrExpiredToken:
+		return metrics.ValidationExpired
+	default:
+		return metrics.ValidationError
+	}
+}
+
 func recoveryMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
@@ -47,39 +104,150 @@ func recoveryMiddleware(next http.Handler) http.Handler {
 }
 
 // trackMiddleware tracks the request by adding a unique request ID to the request context and response headers.
-func trackMiddleware(next http.Handler) http.Handler {
+//
+// With trusted request ids, the request ID is taken from a well-formed X-Request-ID header or, otherwise,
+// is the trace id of a well-formed traceparent header, so that the request can be tracked across services.
+func (h *Handler) trackMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		requestId := uuid.New().String()
+		requestId := ""
+		if h.trustRequestID {
+			requestId = incomingRequestID(r)
+		}
+
+		if requestId == "" {
+			requestId = uuid.New().String()
+		}
 
-		r = r.WithContext(context.WithValue(r.Context(), "X-Request-ID", requestId))
-		w.Header().Add("X-Request-ID", requestId)
+		r = r.WithContext(logger.ContextWithRequestID(r.Context(), requestId))
+		w.Header().Set(requestIDHeader, requestId)
 
 		next.ServeHTTP(w, r)
 	})
 }
 
-// loggingMiddleware logs the incoming request.
-func loggingMiddleware(next http.Handler) http.Handler {
+// incomingRequestID returns the request ID of the X-Request-ID or traceparent header, if well-formed.
+func incomingRequestID(r *http.Request) string {
+	if requestId := r.Header.Get(requestIDHeader); requestIDPattern.MatchString(requestId) {
+		return requestId
+	}
+
+	// version-trace_id-parent_id-flags, see https://www.w3.org/TR/trace-context/#traceparent-header
+	if m := traceparentPattern.FindStringSubmatch(r.Header.Get("traceparent")); m != nil && m[1] != strings.Repeat("0", 32) {
+		return m[1]
+	}
+
+	return ""
+}
+
+// loggingMiddleware logs the incoming request and, once served, its access log line.
+//
+// Sensitive query parameters and headers are redacted, see accessLog.
+func (h *Handler) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now().UTC()
 
 		log := logger.WithRequestId(r)
+		uri := h.accessLog.redactURI(r.URL)
 
 		log.
 			Info().
 			Str("method", r.Method).
-			Str("url", r.URL.RequestURI()).
+			Str("url", uri).
 			Msg("incoming request")
 
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		entry := &accessLogEntry{}
+		r = r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry))
+
 		defer func() {
 			log.
 				Info().
 				Str("method", r.Method).
-				Str("url", r.URL.RequestURI()).
+				Str("url", uri).
+				Int("status", rec.status).
+				Int("size", rec.size).
+				Str("remote_ip", remoteIP(r)).
+				Str("user_agent", r.UserAgent()).
+				Str("client_id", entry.clientIDOf(r)).
+				Dict("headers", h.accessLog.headersOf(r)).
 				Dur("elapsed_ms", time.Since(start)).
 				Msg("request served")
 		}()
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(rec, r)
 	})
 }
+
+// tracingMiddleware starts the server span of the request, continuing the trace of an incoming traceparent header.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		route := routeOf(r)
+		ctx, span := tracing.Tracer().Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+			),
+		)
+		defer span.End()
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// metricsMiddleware counts the request and observes its latency by route, method and status code.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		defer func() {
+			route := routeOf(r)
+			status := strconv.Itoa(rec.status)
+			metrics.HTTPRequests.WithLabelValues(route, r.Method, status).Inc()
+			metrics.HTTPRequestDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+		}()
+
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// routeOf returns the path template of the route matching the request.
+func routeOf(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if tpl, err := current.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+
+	return "unknown"
+}
+
+// responseRecorder records the status code and the size of the response written through it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(b)
+	rec.size += n
+
+	return n, err
+}
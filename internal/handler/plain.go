@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	oerrors "github.com/go-oauth2/oauth2/v4/errors"
+)
+
+// Modes of the plain-HTTP listener of a TLS server.
+const (
+	PlainHTTPRedirect = "redirect"
+	PlainHTTPRefuse   = "refuse"
+)
+
+// credentialRoutes are the path prefixes of the routes whose requests carry credentials: the client credentials,
+// the bearer tokens and the users authenticated by the proxy.
+var credentialRoutes = []string{"/token", "/device_authorization", "/secure", "/authorize", "/device"}
+
+// PlainHTTPRoutes returns the HTTP handler for the plain-HTTP listener of a server serving TLS on tlsPort.
+//
+// The requests that may carry credentials are always refused, as the credentials are already sent in clear text
+// and a redirect would have the client send them again over TLS, keeping it working. Only safe requests without
+// credentials are redirected to HTTPS in redirect mode, every request is refused otherwise.
+func (h *Handler) PlainHTTPRoutes(mode, tlsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if mode != PlainHTTPRedirect || !redirectable(r) {
+			writeTokenResponse(w, r, map[string]interface{}{
+				"error":             oerrors.ErrInvalidRequest.Error(),
+				"error_description": "TLS is required",
+			}, nil, http.StatusBadRequest)
+
+			return
+		}
+
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = hostname
+		}
+
+		if tlsPort != "443" {
+			host = net.JoinHostPort(host, tlsPort)
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
+
+// redirectable reports whether the request may be redirected to HTTPS: a GET or HEAD without credentials nor body.
+func redirectable(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if r.Header.Get("Authorization") != "" || r.ContentLength != 0 || len(r.TransferEncoding) > 0 {
+		return false
+	}
+
+	for _, prefix := range credentialRoutes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return false
+		}
+	}
+
+	return true
+}
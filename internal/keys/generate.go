@@ -0,0 +1,121 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+// rsaKeyBits is the size of the generated RSA keys.
+const rsaKeyBits = 2048
+
+// hmacSecretSizes are the sizes of the generated HMAC secrets, the size of the hash of the algorithm.
+var hmacSecretSizes = map[string]int{
+	"HS256": 32,
+	"HS384": 48,
+	"HS512": 64,
+}
+
+// GenerateSigningKey generates a signing key of the algorithm, in the form taken by jwt.secret:
+// a random base64url encoded secret for the HS* algorithms, a PEM encoded PKCS #8 private key for the others.
+func GenerateSigningKey(alg string) ([]byte, error) {
+	if size, ok := hmacSecretSizes[alg]; ok {
+		secret := make([]byte, size)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, errors.Wrap(errors.WithStack(err), "failed to generate HMAC secret")
+		}
+
+		return []byte(base64.RawURLEncoding.EncodeToString(secret)), nil
+	}
+
+	var key crypto.Signer
+	var err error
+
+	switch alg {
+	case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+		key, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case "ES256", "ES384", "ES512":
+		key, err = ecdsa.GenerateKey(curves[alg], rand.Reader)
+	case "EdDSA":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, errors.Errorf("unsupported signing algorithm %q", alg)
+	}
+
+	if err != nil {
+		return nil, errors.Wrapf(errors.WithStack(err), "failed to generate %s key", alg)
+	}
+
+	return EncodePrivateKeyPEM(key)
+}
+
+// EncodePrivateKeyPEM encodes a private key as a PEM encoded PKCS #8 private key.
+func EncodePrivateKeyPEM(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrap(errors.WithStack(err), "failed to encode private key")
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// EncodePublicKeyPEM encodes a public key as a PEM encoded PKIX public key.
+func EncodePublicKeyPEM(key crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, errors.Wrap(errors.WithStack(err), "failed to encode public key")
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// KeyID returns the key ID of a public key, its JWK thumbprint.
+//
+// It is derived from the key alone, so a rotated key gets a new key ID without any configuration.
+func KeyID(key crypto.PublicKey) (string, error) {
+	jwk, err := NewJWK(key, "", "")
+	if err != nil {
+		return "", err
+	}
+
+	return jwk.Thumbprint()
+}
+
+// NewJWK returns the JWK of a public key, used to verify signatures of the algorithm.
+func NewJWK(key crypto.PublicKey, keyID, alg string) (JWK, error) {
+	jwk := JWK{KeyID: keyID, Use: "sig", Algorithm: alg}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = encodeBigInt(k.N)
+		jwk.E = encodeBigInt(big.NewInt(int64(k.E)))
+	case *ecdsa.PublicKey:
+		jwk.KeyType = "EC"
+		jwk.Curve = k.Curve.Params().Name
+
+		size := (k.Curve.Params().BitSize + 7) / 8
+		jwk.X = base64.RawURLEncoding.EncodeToString(k.X.FillBytes(make([]byte, size)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(k.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(k)
+	default:
+		return JWK{}, errors.Errorf("unsupported public key type %T", key)
+	}
+
+	return jwk, nil
+}
+
+func encodeBigInt(n *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(n.Bytes())
+}
@@ -0,0 +1,58 @@
+package keys
+
+import (
+	"testing"
+)
+
+func TestThumbprint(t *testing.T) {
+	tests := []struct {
+		name               string
+		jwk                JWK
+		expectError        bool
+		expectedThumbprint string
+	}{
+		{
+			// the example of RFC 7638 section 3.1, with members that aren't part of the thumbprint
+			name: "RSA key of RFC 7638",
+			jwk: JWK{
+				KeyType:   "RSA",
+				KeyID:     "2011-04-29",
+				Algorithm: "RS256",
+				N:         "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+				E:         "AQAB",
+			},
+			expectedThumbprint: "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs",
+		},
+		{
+			name:        "Unsupported key type",
+			jwk:         JWK{KeyType: "oct"},
+			expectError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			thumbprint, err := tt.jwk.Thumbprint()
+			if tt.expectError != (err != nil) {
+				t.Fatalf("got error %v but wanted error %t\n", err, tt.expectError)
+			}
+
+			if thumbprint != tt.expectedThumbprint {
+				t.Errorf("got thumbprint %q but wanted %q\n", thumbprint, tt.expectedThumbprint)
+			}
+
+			if tt.expectError {
+				return
+			}
+
+			// the key ID of the tokens is the thumbprint of their public key
+			pub, err := tt.jwk.PublicKey()
+			if err != nil {
+				t.Fatalf("could not decode public key: %v\n", err)
+			}
+
+			if keyID, err := KeyID(pub); keyID != tt.expectedThumbprint {
+				t.Errorf("got key ID %q (error %v) but wanted %q\n", keyID, err, tt.expectedThumbprint)
+			}
+		})
+	}
+}
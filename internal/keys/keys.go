@@ -0,0 +1,46 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+
+	"github.com/pkg/errors"
+)
+
+// ParsePublicKeyPEM parses a PEM encoded public key.
+//
+// PKIX ("PUBLIC KEY") and PKCS #1 ("RSA PUBLIC KEY") blocks are supported, as well as certificates,
+// in which case the public key of the certificate is returned.
+func ParsePublicKeyPEM(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(errors.WithStack(err), "failed to parse PKIX public key")
+		}
+
+		return key, nil
+	case "RSA PUBLIC KEY":
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(errors.WithStack(err), "failed to parse PKCS #1 public key")
+		}
+
+		return key, nil
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(errors.WithStack(err), "failed to parse certificate")
+		}
+
+		return cert.PublicKey, nil
+	default:
+		return nil, errors.Errorf("unsupported PEM block type %q", block.Type)
+	}
+}
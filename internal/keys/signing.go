@@ -0,0 +1,195 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+
+	"github.com/pkg/errors"
+)
+
+// SigningAlgorithms are the JWS algorithms (RFC 7518) the access tokens can be signed with.
+var SigningAlgorithms = []string{
+	"HS256", "HS384", "HS512",
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"EdDSA",
+}
+
+// curves are the curves of the ECDSA algorithms.
+var curves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+// minRSAKeyBits is the size under which RSA keys are too weak, see CheckKeyStrength.
+const minRSAKeyBits = 2048
+
+// CheckKeyStrength checks that a signing key parsed by ParseSigningKey is strong enough for its algorithm:
+// HMAC secrets need at least the size of the hash of the algorithm, RSA keys at least 2048 bits.
+//
+// The EC and Ed25519 keys are strong enough, their curve is checked by ParseSigningKey.
+func CheckKeyStrength(alg string, key interface{}) error {
+	switch k := key.(type) {
+	case []byte:
+		if size := hmacSecretSizes[alg]; len(k) < size {
+			return errors.Errorf("HMAC secret of %d bytes is too weak for %s, it needs at least %d", len(k), alg, size)
+		}
+	case *rsa.PrivateKey:
+		if bits := k.N.BitLen(); bits < minRSAKeyBits {
+			return errors.Errorf("RSA key of %d bits is too weak, it needs at least %d", bits, minRSAKeyBits)
+		}
+	}
+
+	return nil
+}
+
+// ParseSigningKey parses the secret as the signing key of the algorithm.
+//
+// The HMAC algorithms use the secret itself as the key. The other algorithms take a PEM encoded private key
+// of their type: RSA for RS* and PS*, ECDSA on the matching curve for ES*, Ed25519 for EdDSA.
+func ParseSigningKey(alg string, secret []byte) (interface{}, error) {
+	switch alg {
+	case "HS256", "HS384", "HS512":
+		if len(secret) == 0 {
+			return nil, errors.New("HMAC secret is empty")
+		}
+
+		return secret, nil
+	case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+		key, err := ParsePrivateKeyPEM(secret)
+		if err != nil {
+			return nil, err
+		}
+
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.Errorf("%s requires an RSA key", alg)
+		}
+
+		return rsaKey, nil
+	case "ES256", "ES384", "ES512":
+		key, err := ParsePrivateKeyPEM(secret)
+		if err != nil {
+			return nil, err
+		}
+
+		ecKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok || ecKey.Curve != curves[alg] {
+			return nil, errors.Errorf("%s requires an ECDSA key on curve %s", alg, curves[alg].Params().Name)
+		}
+
+		return ecKey, nil
+	case "EdDSA":
+		key, err := ParsePrivateKeyPEM(secret)
+		if err != nil {
+			return nil, err
+		}
+
+		edKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("EdDSA requires an Ed25519 key")
+		}
+
+		return edKey, nil
+	default:
+		return nil, errors.Errorf("unsupported signing algorithm %q", alg)
+	}
+}
+
+// ParsePrivateKeyPEM parses a PEM encoded private key.
+//
+// PKCS #8 ("PRIVATE KEY"), PKCS #1 ("RSA PRIVATE KEY") and SEC 1 ("EC PRIVATE KEY") blocks are supported.
+func ParsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(errors.WithStack(err), "failed to parse PKCS #8 private key")
+		}
+
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.Errorf("unsupported private key type %T", key)
+		}
+
+		return signer, nil
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(errors.WithStack(err), "failed to parse PKCS #1 private key")
+		}
+
+		return key, nil
+	case "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(errors.WithStack(err), "failed to parse EC private key")
+		}
+
+		return key, nil
+	default:
+		return nil, errors.Errorf("unsupported PEM block type %q", block.Type)
+	}
+}
+
+// fingerprintKeyLabel separates the fingerprint key from any other use of the signing key.
+const fingerprintKeyLabel = "oauth2 secret fingerprint"
+
+// FingerprintKey derives the key of the secret fingerprints from the signing key, jwt.secret.
+//
+// Only the holders of the signing key, who can sign tokens anyway, can check a guess of a secret against its fingerprint.
+func FingerprintKey(signingSecret []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(fingerprintKeyLabel))
+	mac.Write(signingSecret)
+
+	return mac.Sum(nil)
+}
+
+// SecretFingerprint returns the fingerprint of a secret with the key of FingerprintKey, the first 8 bytes of their
+// HMAC-SHA256, e.g. hmac-sha256:9f86d081884c7d65.
+//
+// It tells whether two deployments with the same signing key use the same secret, without revealing it. Unlike a hash,
+// it can't be brute-forced offline without the key, so that the fingerprints of low-entropy secrets can be shown.
+func SecretFingerprint(key, secret []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(secret)
+
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// SigningKeyFingerprint returns the fingerprint of a signing key, kid:<key ID> for the keys with a public key.
+//
+// HMAC secrets have no fingerprint, false is returned: it would be keyed by the secret itself.
+func SigningKeyFingerprint(alg string, secret []byte) (string, bool) {
+	key, err := ParseSigningKey(alg, secret)
+	if err != nil {
+		return "", false
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return "", false
+	}
+
+	keyID, err := KeyID(signer.Public())
+	if err != nil {
+		return "", false
+	}
+
+	return "kid:" + keyID, true
+}
@@ -0,0 +1,154 @@
+package logger
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Fields an override of the log level applies to.
+const (
+	OverrideRequestID = "request_id"
+	OverrideClientID  = "client_id"
+)
+
+var logLevel atomic.Int32
+
+var overridesMu sync.Mutex
+var overrides = make(map[overrideKey]Override)
+
+type overrideKey struct {
+	field string
+	value string
+}
+
+// Override is a temporary log level for the requests with a given request id or client id.
+type Override struct {
+	Field     string        `json:"field"`
+	Value     string        `json:"value"`
+	Level     zerolog.Level `json:"level"`
+	ExpiresAt time.Time     `json:"expires_at"`
+}
+
+// SetLogLevel sets the log level to the input value.
+//
+// It can be called at any time, the loggers returned by Get, before or after, log at the new level.
+func SetLogLevel(level int) {
+	logLevel.Store(int32(level))
+
+	overridesMu.Lock()
+	updateGlobalLevel()
+	overridesMu.Unlock()
+}
+
+// Level returns the current log level.
+func Level() zerolog.Level {
+	return zerolog.Level(logLevel.Load())
+}
+
+// SetOverride sets the log level of the requests whose field, request_id or client_id, has the value.
+//
+// The override reverts to the current log level after the ttl.
+func SetOverride(field, value string, level zerolog.Level, ttl time.Duration) Override {
+	o := Override{
+		Field:     field,
+		Value:     value,
+		Level:     level,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+
+	overridesMu.Lock()
+	overrides[overrideKey{field: field, value: value}] = o
+	updateGlobalLevel()
+	overridesMu.Unlock()
+
+	return o
+}
+
+// Overrides returns the overrides that haven't expired yet, in order of expiry.
+func Overrides() []Override {
+	overridesMu.Lock()
+	defer overridesMu.Unlock()
+
+	now := time.Now()
+	list := make([]Override, 0, len(overrides))
+	for key, o := range overrides {
+		if o.ExpiresAt.Before(now) {
+			delete(overrides, key)
+			updateGlobalLevel()
+
+			continue
+		}
+
+		list = append(list, o)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ExpiresAt.Before(list[j].ExpiresAt) })
+
+	return list
+}
+
+// updateGlobalLevel sets the global level of zerolog to the most verbose of the log level and of the overrides,
+// so that the events no logger writes aren't built. The loggers at the log level are filtered by levelWriter.
+//
+// overridesMu must be held.
+func updateGlobalLevel() {
+	level := Level()
+	for _, o := range overrides {
+		if o.Level < level {
+			level = o.Level
+		}
+	}
+
+	zerolog.SetGlobalLevel(level)
+}
+
+// overrideLevel returns the level of the override of the request id or, otherwise, of the client id.
+func overrideLevel(requestID, clientID string) (zerolog.Level, bool) {
+	overridesMu.Lock()
+	defer overridesMu.Unlock()
+
+	if len(overrides) == 0 {
+		return 0, false
+	}
+
+	now := time.Now()
+	for _, key := range []overrideKey{{OverrideRequestID, requestID}, {OverrideClientID, clientID}} {
+		if key.value == "" {
+			continue
+		}
+
+		o, ok := overrides[key]
+		if !ok {
+			continue
+		}
+
+		if o.ExpiresAt.Before(now) {
+			delete(overrides, key)
+			updateGlobalLevel()
+
+			continue
+		}
+
+		return o.Level, true
+	}
+
+	return 0, false
+}
+
+// clientIDOf returns the client id of the request from Basic Authentication or from an already parsed form.
+func clientIDOf(r *http.Request) string {
+	if clientID, _, ok := r.BasicAuth(); ok {
+		return clientID
+	}
+
+	if r.Form != nil {
+		return r.Form.Get("client_id")
+	}
+
+	return ""
+}
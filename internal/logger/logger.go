@@ -1,61 +1,195 @@
 package logger
 
 import (
+	"context"
+	"io"
 	"net/http"
 	"os"
 	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/pkgerrors"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/laonix/oauth2/internal/config"
+)
+
+const (
+	FormatConsole = "console"
+	FormatJSON    = "json"
 )
 
 var setLogOnce sync.Once
 var log zerolog.Logger
 
-var setLogLevelOnce sync.Once
-var logLevel int
+// unfiltered is log without the filter of the current log level, for the overrides.
+var unfiltered zerolog.Logger
+
+var configureOnce sync.Once
+var format = FormatConsole
+var output io.Writer = os.Stdout
+var fields map[string]string
+
+// Configure sets the level, the format, the output and the static fields of the logs.
+//
+// The output is stdout, stderr or the path of a file, which is rotated once it reaches cfg.MaxSizeMB.
+// The static fields are added to every log line, along with the fields of cfg.
+// It must be called before the first Get, later calls are ignored.
+func Configure(cfg config.Log, static map[string]string) error {
+	var err error
+
+	configureOnce.Do(func() {
+		SetLogLevel(cfg.Level)
+
+		switch cfg.Format {
+		case "", FormatConsole:
+			format = FormatConsole
+		case FormatJSON:
+			format = FormatJSON
+		default:
+			err = errors.Errorf("unknown log format %q", cfg.Format)
+
+			return
+		}
+
+		switch cfg.Output {
+		case "", "stdout":
+			output = os.Stdout
+		case "stderr":
+			output = os.Stderr
+		default:
+			output = &lumberjack.Logger{
+				Filename:   cfg.Output,
+				MaxSize:    cfg.MaxSizeMB,
+				MaxBackups: cfg.MaxBackups,
+			}
+		}
 
-// SetLogLevel sets the log level to the input value.
-func SetLogLevel(level int) {
-	setLogLevelOnce.Do(func() {
-		logLevel = level
+		fields = make(map[string]string, len(static)+len(cfg.Fields))
+		for k, v := range static {
+			fields[k] = v
+		}
+		for k, v := range cfg.Fields {
+			fields[k] = v
+		}
 	})
+
+	return err
 }
 
 // Get returns a singleton instance of zerolog.Logger.
 //
-// It is configured to write logs to stdout in a colorized, human-friendly format.
+// It writes logs to the output set by Configure, by default stdout, either in a human-friendly format,
+// colorized on stdout and stderr, or as JSON lines. JSON lines carry the stack trace of logged errors.
 //
-// Logging is performed at the level specified by the LOG_LEVEL environment variable (see config.yaml file).
+// Logging is performed at the level specified by the LOG_LEVEL environment variable (see config.yaml file),
+// which can be changed at runtime with SetLogLevel. The level is looked up by the writer of every log line,
+// so that the loggers kept by long-running goroutines follow the changes too, see levelWriter. The events
+// under the level and the levels of the overrides aren't built at all, see updateGlobalLevel.
 func Get() zerolog.Logger {
 	setLogOnce.Do(func() {
 		zerolog.ErrorStackMarshaler = pkgerrors.MarshalStack
 		zerolog.TimeFieldFormat = time.RFC3339
 
-		output := zerolog.ConsoleWriter{
-			Out:        os.Stdout,
-			NoColor:    false,
-			TimeFormat: time.RFC3339,
+		out := output
+		if format == FormatConsole {
+			out = zerolog.ConsoleWriter{
+				Out:        output,
+				NoColor:    output != os.Stdout && output != os.Stderr,
+				TimeFormat: time.RFC3339,
+			}
 		}
 
-		log = zerolog.New(output).
-			Level(zerolog.Level(logLevel)).
+		logCtx := zerolog.New(out).
 			With().
-			Timestamp().
-			Logger()
+			Timestamp()
+
+		if format == FormatJSON {
+			logCtx = logCtx.Stack()
+		}
+
+		for k, v := range fields {
+			logCtx = logCtx.Str(k, v)
+		}
+
+		unfiltered = logCtx.Logger()
+		log = unfiltered.Output(levelWriter{out: out})
 	})
 
 	return log
 }
 
-// WithRequestId returns a logger with the request_id field set to the value of the X-Request-ID header from the input http request.
-// If the header is not present, the request_id field is set to "unknown".
+// levelWriter is the zerolog.LevelWriter dropping the log lines under the current log level, see SetLogLevel.
+//
+// Unlike the level of a zerolog.Logger, it follows the changes of the level after the logger is created.
+type levelWriter struct {
+	out io.Writer
+}
+
+func (w levelWriter) Write(p []byte) (int, error) {
+	return w.out.Write(p)
+}
+
+func (w levelWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	if level < Level() {
+		// dropped lines count as written, so that zerolog doesn't report them as failed writes
+		return len(p), nil
+	}
+
+	return w.out.Write(p)
+}
+
+type requestIDKey struct{}
+
+// ContextWithRequestID returns a copy of ctx carrying the request id.
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestIDFromContext returns the request id carried by ctx, if any.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	requestID, ok := ctx.Value(requestIDKey{}).(string)
+
+	return requestID, ok
+}
+
+// FromContext returns a logger with the request_id field set to the request id carried by ctx.
+// If ctx carries no request id, the request_id field is set to "unknown".
+//
+// The trace_id and span_id fields are set as well if ctx is traced.
+//
+// The logger is at the level of the override of the request id, if any.
+func FromContext(ctx context.Context) zerolog.Logger {
+	return fromContext(ctx, "")
+}
+
+// WithRequestId returns the logger of FromContext for the context of the request.
+//
+// The logger is at the level of the override of the request id or of the client of the request, if any.
 func WithRequestId(r *http.Request) zerolog.Logger {
-	requestId, ok := r.Context().Value("X-Request-ID").(string)
+	return fromContext(r.Context(), clientIDOf(r))
+}
+
+func fromContext(ctx context.Context, clientID string) zerolog.Logger {
+	requestId, ok := RequestIDFromContext(ctx)
 	if !ok {
 		requestId = "unknown"
 	}
 
-	return Get().With().Str("request_id", requestId).Logger()
+	l := Get()
+	if level, ok := overrideLevel(requestId, clientID); ok {
+		// the override replaces the current log level, be it more or less verbose
+		l = unfiltered.Level(level)
+	}
+
+	logCtx := l.With().Str("request_id", requestId)
+
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		logCtx = logCtx.Str("trace_id", sc.TraceID().String()).Str("span_id", sc.SpanID().String())
+	}
+
+	return logCtx.Logger()
 }
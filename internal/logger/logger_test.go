@@ -0,0 +1,256 @@
+package logger
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+
+	"github.com/laonix/oauth2/internal/config"
+)
+
+// resetLogger undoes Configure and Get, which only take effect once per process.
+func resetLogger(t *testing.T) {
+	reset := func() {
+		setLogOnce = sync.Once{}
+		configureOnce = sync.Once{}
+		format = FormatConsole
+		output = os.Stdout
+		fields = nil
+		SetLogLevel(int(zerolog.InfoLevel))
+	}
+
+	reset()
+	t.Cleanup(reset)
+}
+
+// readLines returns the lines of the log file, none if nothing was logged.
+func readLines(t *testing.T, path string) []string {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		t.Fatalf("could not open log file: %v\n", err)
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	return lines
+}
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		name           string
+		cfg            config.Log
+		static         map[string]string
+		expectedFields map[string]string
+		expectJSON     bool
+		expectStack    bool
+		expectError    bool
+	}{
+		{
+			name:           "JSON lines with the static fields and the fields of the config",
+			cfg:            config.Log{Format: FormatJSON, Fields: map[string]string{"env": "test", "service": "override"}},
+			static:         map[string]string{"service": "oauth2", "pod": "pod-1"},
+			expectedFields: map[string]string{"env": "test", "service": "override", "pod": "pod-1", "message": "hello"},
+			expectJSON:     true,
+			expectStack:    true,
+		},
+		{
+			name:           "Console lines without colors in a file",
+			cfg:            config.Log{Format: FormatConsole},
+			static:         map[string]string{"service": "oauth2"},
+			expectedFields: map[string]string{"service=": "oauth2", "hello": ""},
+		},
+		{
+			name:        "Unknown format",
+			cfg:         config.Log{Format: "xml"},
+			expectError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetLogger(t)
+
+			tt.cfg.Output = filepath.Join(t.TempDir(), "oauth2.log")
+			tt.cfg.MaxSizeMB = 1
+
+			err := Configure(tt.cfg, tt.static)
+			if tt.expectError != (err != nil) {
+				t.Fatalf("got error %v but wanted error %t\n", err, tt.expectError)
+			}
+			if tt.expectError {
+				return
+			}
+
+			log := Get()
+			log.Info().Msg("hello")
+			log.Error().Stack().Err(errors.New("failure")).Msg("failed")
+
+			lines := readLines(t, tt.cfg.Output)
+			if len(lines) != 2 {
+				t.Fatalf("got %d log lines but wanted 2: %q\n", len(lines), lines)
+			}
+
+			if !tt.expectJSON {
+				if strings.Contains(lines[0], "\x1b[") {
+					t.Errorf("got colors in %q\n", lines[0])
+				}
+
+				for k, v := range tt.expectedFields {
+					if !strings.Contains(lines[0], k+v) {
+						t.Errorf("got line %q but wanted it to contain %q\n", lines[0], k+v)
+					}
+				}
+
+				return
+			}
+
+			var line map[string]interface{}
+			if err := json.Unmarshal([]byte(lines[0]), &line); err != nil {
+				t.Fatalf("could not decode log line %q: %v\n", lines[0], err)
+			}
+
+			for k, v := range tt.expectedFields {
+				if line[k] != v {
+					t.Errorf("got %s %v but wanted %q\n", k, line[k], v)
+				}
+			}
+
+			if line["level"] != "info" || line["time"] == nil {
+				t.Errorf("got level %v and time %v but wanted info and a timestamp\n", line["level"], line["time"])
+			}
+
+			var errLine map[string]interface{}
+			if err := json.Unmarshal([]byte(lines[1]), &errLine); err != nil {
+				t.Fatalf("could not decode log line %q: %v\n", lines[1], err)
+			}
+
+			if _, ok := errLine["stack"]; ok != tt.expectStack {
+				t.Errorf("got stack %t but wanted %t in %q\n", ok, tt.expectStack, lines[1])
+			}
+		})
+	}
+}
+
+func TestLevelChanges(t *testing.T) {
+	tests := []struct {
+		name          string
+		initialLevel  zerolog.Level
+		changedLevel  zerolog.Level
+		override      *zerolog.Level
+		otherRequest  bool
+		unsampled     bool
+		expectedLines []string
+	}{
+		{
+			name:          "Captured logger follows a more verbose level",
+			initialLevel:  zerolog.InfoLevel,
+			changedLevel:  zerolog.DebugLevel,
+			expectedLines: []string{"info before", "debug after", "info after"},
+		},
+		{
+			name:          "Captured logger follows a less verbose level",
+			initialLevel:  zerolog.DebugLevel,
+			changedLevel:  zerolog.WarnLevel,
+			expectedLines: []string{"debug before", "info before"},
+		},
+		{
+			name:          "Override is more verbose than the level",
+			initialLevel:  zerolog.InfoLevel,
+			changedLevel:  zerolog.WarnLevel,
+			override:      levelPtr(zerolog.DebugLevel),
+			expectedLines: []string{"debug before", "info before", "debug after", "info after"},
+		},
+		{
+			name:          "Override is less verbose than the level",
+			initialLevel:  zerolog.DebugLevel,
+			changedLevel:  zerolog.DebugLevel,
+			override:      levelPtr(zerolog.WarnLevel),
+			expectedLines: nil,
+		},
+		{
+			name:          "Override of another request",
+			initialLevel:  zerolog.InfoLevel,
+			changedLevel:  zerolog.WarnLevel,
+			override:      levelPtr(zerolog.DebugLevel),
+			otherRequest:  true,
+			expectedLines: []string{"info before"},
+		},
+		{
+			name:          "Logger without sampling keeps the level",
+			initialLevel:  zerolog.InfoLevel,
+			changedLevel:  zerolog.WarnLevel,
+			unsampled:     true,
+			expectedLines: []string{"info before"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetLogger(t)
+
+			path := filepath.Join(t.TempDir(), "oauth2.log")
+			if err := Configure(config.Log{Level: int(tt.initialLevel), Format: FormatJSON, Output: path}, nil); err != nil {
+				t.Fatalf("could not configure logger: %v\n", err)
+			}
+
+			requestID := "request-" + tt.name
+			if tt.override != nil {
+				overridden := requestID
+				if tt.otherRequest {
+					overridden = "other-" + requestID
+				}
+
+				SetOverride(OverrideRequestID, overridden, *tt.override, time.Minute)
+			}
+
+			// captured before the change, like the loggers of long-running goroutines
+			log := FromContext(ContextWithRequestID(context.Background(), requestID))
+			if tt.unsampled {
+				zerolog.DisableSampling(true)
+				defer zerolog.DisableSampling(false)
+
+				log = log.Sample(nil)
+			}
+
+			log.Debug().Msg("debug before")
+			log.Info().Msg("info before")
+
+			SetLogLevel(int(tt.changedLevel))
+
+			log.Debug().Msg("debug after")
+			log.Info().Msg("info after")
+
+			var messages []string
+			for _, line := range readLines(t, path) {
+				var fields map[string]interface{}
+				if err := json.Unmarshal([]byte(line), &fields); err != nil {
+					t.Fatalf("could not decode log line %q: %v\n", line, err)
+				}
+
+				messages = append(messages, fields["message"].(string))
+			}
+
+			if strings.Join(messages, ",") != strings.Join(tt.expectedLines, ",") {
+				t.Errorf("got lines %q but wanted %q\n", messages, tt.expectedLines)
+			}
+		})
+	}
+}
+
+func levelPtr(level zerolog.Level) *zerolog.Level {
+	return &level
+}
@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "oauth2"
+
+// Outcomes of the validation of a bearer token.
+const (
+	ValidationValid   = "valid"
+	ValidationInvalid = "invalid"
+	ValidationExpired = "expired"
+	ValidationError   = "error"
+)
+
+// Results of a config reload.
+const (
+	ReloadSuccess = "success"
+	ReloadFailure = "failure"
+)
+
+// Reasons of a failed client authentication.
+const (
+	AuthMissingCredentials = "missing_credentials"
+	AuthUnknownClient      = "unknown_client"
+	AuthInvalidCredentials = "invalid_credentials"
+)
+
+var (
+	// HTTPRequests counts the served requests by route, method and status code.
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of served HTTP requests.",
+	}, []string{"route", "method", "status"})
+
+	// HTTPRequestDuration observes the latency of the served requests by route, method and status code.
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of served HTTP requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	// HTTPRequestsInFlight is the number of requests being served.
+	HTTPRequestsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "http_requests_in_flight",
+		Help:      "Number of HTTP requests being served.",
+	})
+
+	// TokensIssued counts the issued access tokens by client and grant type.
+	TokensIssued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_issued_total",
+		Help:      "Number of issued access tokens.",
+	}, []string{"client_id", "grant_type"})
+
+	// ClientAuthFailures counts the failed client authentications by reason.
+	ClientAuthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "client_auth_failures_total",
+		Help:      "Number of failed client authentications.",
+	}, []string{"reason"})
+
+	// TokenValidations counts the validations of bearer tokens by outcome.
+	TokenValidations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_validations_total",
+		Help:      "Number of bearer token validations.",
+	}, []string{"outcome"})
+
+	// TokenSigningDuration observes the latency of signing access tokens.
+	TokenSigningDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "token_signing_duration_seconds",
+		Help:      "Latency of signing access tokens.",
+		Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1},
+	})
+
+	// ConfigReloads counts the reloads of the config by result.
+	ConfigReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "config_reloads_total",
+		Help:      "Number of config reloads.",
+	}, []string{"result"})
+
+	// ConfigLastReloadSuccessful is 1 if the last config reload succeeded, 0 if it was rejected.
+	ConfigLastReloadSuccessful = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last config reload succeeded.",
+	})
+)
+
+// Handler returns the HTTP handler exposing the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
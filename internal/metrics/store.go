@@ -0,0 +1,140 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var tokenStoreSizeDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "token_store_size"),
+	"Number of unexpired codes, access tokens and refresh tokens in the token store.",
+	[]string{"kind"}, nil,
+)
+
+// tokenStorePruneInterval is how often the expired codes and tokens are forgotten by the writes to the token store.
+const tokenStorePruneInterval = time.Minute
+
+// tokenStore is an oauth2.TokenStore that keeps track of the size of the underlying store.
+//
+// The stores of go-oauth2 don't expose their size, so the expiry of every stored code and token is recorded instead.
+// The expired ones are forgotten by the writes, at most every tokenStorePruneInterval, and by the scrapes, so that
+// they don't pile up when the metrics aren't scraped.
+type tokenStore struct {
+	oauth2.TokenStore
+
+	mu       sync.Mutex
+	expires  map[string]map[string]time.Time
+	prunedAt time.Time
+}
+
+// InstrumentTokenStore returns a token store reporting the size of store as the token_store_size metric of reg.
+func InstrumentTokenStore(store oauth2.TokenStore, reg prometheus.Registerer) (oauth2.TokenStore, error) {
+	s := &tokenStore{
+		TokenStore: store,
+		expires: map[string]map[string]time.Time{
+			"code":    {},
+			"access":  {},
+			"refresh": {},
+		},
+	}
+
+	if err := reg.Register(s); err != nil {
+		return nil, errors.Wrap(err, "failed to register token store metrics")
+	}
+
+	return s, nil
+}
+
+func (s *tokenStore) Create(ctx context.Context, info oauth2.TokenInfo) error {
+	if err := s.TokenStore.Create(ctx, info); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now := time.Now(); now.Sub(s.prunedAt) >= tokenStorePruneInterval {
+		s.prune(now)
+	}
+
+	if code := info.GetCode(); code != "" {
+		s.expires["code"][code] = expiry(info.GetCodeCreateAt(), info.GetCodeExpiresIn())
+
+		return nil
+	}
+
+	s.expires["access"][info.GetAccess()] = expiry(info.GetAccessCreateAt(), info.GetAccessExpiresIn())
+	if refresh := info.GetRefresh(); refresh != "" {
+		s.expires["refresh"][refresh] = expiry(info.GetRefreshCreateAt(), info.GetRefreshExpiresIn())
+	}
+
+	return nil
+}
+
+func (s *tokenStore) RemoveByCode(ctx context.Context, code string) error {
+	return s.remove("code", code, s.TokenStore.RemoveByCode(ctx, code))
+}
+
+func (s *tokenStore) RemoveByAccess(ctx context.Context, access string) error {
+	return s.remove("access", access, s.TokenStore.RemoveByAccess(ctx, access))
+}
+
+func (s *tokenStore) RemoveByRefresh(ctx context.Context, refresh string) error {
+	return s.remove("refresh", refresh, s.TokenStore.RemoveByRefresh(ctx, refresh))
+}
+
+func (s *tokenStore) remove(kind, key string, err error) error {
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.expires[kind], key)
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Describe implements prometheus.Collector.
+func (s *tokenStore) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tokenStoreSizeDesc
+}
+
+// Collect implements prometheus.Collector, forgetting the expired codes and tokens.
+func (s *tokenStore) Collect(ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune(time.Now())
+
+	for kind, expires := range s.expires {
+		ch <- prometheus.MustNewConstMetric(tokenStoreSizeDesc, prometheus.GaugeValue, float64(len(expires)), kind)
+	}
+}
+
+// prune forgets the codes and tokens expired at now. s.mu must be held.
+func (s *tokenStore) prune(now time.Time) {
+	for _, expires := range s.expires {
+		for key, exp := range expires {
+			if !exp.IsZero() && exp.Before(now) {
+				delete(expires, key)
+			}
+		}
+	}
+
+	s.prunedAt = now
+}
+
+// expiry returns the expiry time of a code or token, or the zero time if it doesn't expire.
+func expiry(createAt time.Time, expiresIn time.Duration) time.Time {
+	if expiresIn <= 0 {
+		return time.Time{}
+	}
+
+	return createAt.Add(expiresIn)
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4/models"
+	"github.com/go-oauth2/oauth2/v4/store"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestInstrumentTokenStore(t *testing.T) {
+	memoryTokenRepo, err := store.NewMemoryTokenStore()
+	if err != nil {
+		t.Fatalf("could not create token store: %v\n", err)
+	}
+
+	reg := prometheus.NewRegistry()
+
+	tokenRepo, err := InstrumentTokenStore(memoryTokenRepo, reg)
+	if err != nil {
+		t.Fatalf("could not instrument token store: %v\n", err)
+	}
+
+	// another registry takes another token store
+	if _, err := InstrumentTokenStore(memoryTokenRepo, prometheus.NewRegistry()); err != nil {
+		t.Errorf("got error %v but wanted the token store instrumented again\n", err)
+	}
+
+	create := func(access string, createAt time.Time) {
+		info := &models.Token{Access: access, AccessCreateAt: createAt, AccessExpiresIn: time.Minute}
+		if err := tokenRepo.Create(context.Background(), info); err != nil {
+			t.Fatalf("could not create token: %v\n", err)
+		}
+	}
+
+	create("expired", time.Now().Add(-time.Hour))
+
+	// the next write forgets the expired token without a scrape
+	tokenRepo.(*tokenStore).prunedAt = time.Time{}
+	create("valid", time.Now())
+
+	if got := len(tokenRepo.(*tokenStore).expires["access"]); got != 1 {
+		t.Errorf("got %d access tokens but wanted 1\n", got)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("could not gather metrics: %v\n", err)
+	}
+
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			if m.GetLabel()[0].GetValue() == "access" && m.GetGauge().GetValue() != 1 {
+				t.Errorf("got token_store_size %v of the access tokens but wanted 1\n", m.GetGauge().GetValue())
+			}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package reload
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/laonix/oauth2/internal/config"
+	"github.com/laonix/oauth2/internal/logger"
+	"github.com/laonix/oauth2/internal/metrics"
+)
+
+// ApplyFunc applies a reloaded config to the running server.
+//
+// It must apply all of the config or none of it: on error the config is rejected and the current one is kept.
+type ApplyFunc func(cfg *config.Config) error
+
+// Watcher reloads the config once its files, or its clients file, change.
+//
+// A reloaded config is only applied if it is valid. A rejected reload is logged and counted
+// by the config_reloads_total metric, and the current config is kept.
+type Watcher struct {
+	files []string
+	apply ApplyFunc
+
+	mu       sync.Mutex
+	current  *config.Config
+	modTimes map[string]time.Time
+}
+
+// NewWatcher returns a watcher of the config files, current being the config loaded from them.
+func NewWatcher(files []string, current *config.Config, apply ApplyFunc) *Watcher {
+	w := &Watcher{
+		files:   files,
+		apply:   apply,
+		current: current,
+	}
+	w.modTimes = w.stat()
+
+	metrics.ConfigLastReloadSuccessful.Set(1)
+
+	return w
+}
+
+// Run reloads the config whenever its files change, checked every reload interval of the config, until ctx is done.
+//
+// Without reload interval it only waits for ctx to be done.
+func (w *Watcher) Run(ctx context.Context) {
+	interval := w.config().Reload.Interval
+	if interval <= 0 {
+		<-ctx.Done()
+
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if w.changed() {
+				_ = w.Reload(ctx)
+			}
+		}
+	}
+}
+
+// Reload loads the config from its files and applies it, unless it is invalid.
+func (w *Watcher) Reload(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	log := logger.FromContext(ctx)
+
+	// the files are stat'ed first, so that a change during the reload triggers another one
+	w.modTimes = w.stat()
+
+	cfg, err := config.LoadConfig(w.files...)
+	if err == nil {
+		err = w.apply(cfg)
+	}
+
+	if err != nil {
+		metrics.ConfigReloads.WithLabelValues(metrics.ReloadFailure).Inc()
+		metrics.ConfigLastReloadSuccessful.Set(0)
+
+		log.Error().Err(err).Msg("config reload rejected, keeping the current config")
+
+		return errors.Wrap(err, "config reload rejected")
+	}
+
+	if changed := restartRequired(w.current, cfg); len(changed) > 0 {
+		log.Warn().Strs("keys", changed).Msg("config changes that require a restart are ignored")
+	}
+
+	clientsFileChanged := cfg.ClientsFile != w.current.ClientsFile
+	w.current = cfg
+
+	if clientsFileChanged {
+		w.modTimes = w.stat()
+	}
+
+	metrics.ConfigReloads.WithLabelValues(metrics.ReloadSuccess).Inc()
+	metrics.ConfigLastReloadSuccessful.Set(1)
+
+	log.Info().Strs("files", w.files).Int("clients", len(cfg.Clients)).Msg("config reloaded")
+
+	return nil
+}
+
+// config returns the current config.
+func (w *Watcher) config() *config.Config {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.current
+}
+
+// changed reports whether the files changed since the last reload.
+func (w *Watcher) changed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return !reflect.DeepEqual(w.stat(), w.modTimes)
+}
+
+// stat returns, with the lock held, the modification times of the config files and of the clients file.
+//
+// Files are stat'ed through their symlinks, as Kubernetes swaps the mounted config maps by symlink.
+// Missing files are left out, so that their removal is noticed too.
+func (w *Watcher) stat() map[string]time.Time {
+	files := w.files
+	if w.current != nil && w.current.ClientsFile != "" {
+		files = append(files[:len(files):len(files)], w.current.ClientsFile)
+	}
+
+	modTimes := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			modTimes[file] = info.ModTime()
+		}
+	}
+
+	return modTimes
+}
+
+// restartRequired returns the config keys changed between old and new that aren't reloaded.
+func restartRequired(old, new *config.Config) []string {
+	var changed []string
+
+	oldLog, newLog := old.Log, new.Log
+	oldLog.Level, newLog.Level = 0, 0
+
+	oldJWT, newJWT := old.JWT, new.JWT
+	oldJWT.AccessTokenExpiresIn, newJWT.AccessTokenExpiresIn = 0, 0
+	oldJWT.RefreshTokenExpiresIn, newJWT.RefreshTokenExpiresIn = 0, 0
+	oldJWT.RefreshTokenMaxLifetime, newJWT.RefreshTokenMaxLifetime = 0, 0
+
+	oldGrants, newGrants := old.Grants, new.Grants
+	oldGrants.AuthorizationCode.CodeExpiresIn, newGrants.AuthorizationCode.CodeExpiresIn = 0, 0
+
+	for _, section := range []struct {
+		key      string
+		old, new interface{}
+	}{
+		{"mode", old.Mode, new.Mode},
+		{"http", old.HTTP, new.HTTP},
+		{"jwt", oldJWT, newJWT},
+		{"log", oldLog, newLog},
+		{"tracing", old.Tracing, new.Tracing},
+		{"admin", old.Admin, new.Admin},
+		{"reload", old.Reload, new.Reload},
+		{"grants", oldGrants, newGrants},
+	} {
+		if !reflect.DeepEqual(section.old, section.new) {
+			changed = append(changed, section.key)
+		}
+	}
+
+	return changed
+}
@@ -0,0 +1,178 @@
+package reload
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/go-oauth2/oauth2/v4/store"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/laonix/oauth2/internal/config"
+	"github.com/laonix/oauth2/internal/metrics"
+	"github.com/laonix/oauth2/internal/service/auth"
+)
+
+// configYAML is a dev config with a client and an access token lifetime.
+func configYAML(clientID, accessTokenExpiresIn, extra string) string {
+	return `
+mode: dev
+reload:
+  interval: 10ms
+jwt:
+  secret: 0123456789abcdef0123456789abcdef
+  access_token_expires_in: ` + accessTokenExpiresIn + `
+clients:
+  - id: ` + clientID + `
+    secret: ` + clientID + `_secret
+` + extra
+}
+
+// writeConfig writes the config file, modified at modTime so that every write is noticed.
+func writeConfig(t *testing.T, path, content string, modTime time.Time) {
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("could not write config: %v\n", err)
+	}
+
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("could not touch config: %v\n", err)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	tests := []struct {
+		name                 string
+		reloaded             string
+		run                  bool
+		expectError          bool
+		expectedClient       string
+		expectedAccessExp    time.Duration
+		expectedLastReload   float64
+		expectedSuccessDelta float64
+		expectedFailureDelta float64
+	}{
+		{
+			name:                 "Reload swaps the clients and the token lifetimes",
+			reloaded:             configYAML("new", "5m", ""),
+			expectedClient:       "new",
+			expectedAccessExp:    5 * time.Minute,
+			expectedLastReload:   1,
+			expectedSuccessDelta: 1,
+		},
+		{
+			name:                 "Changed files are reloaded by Run",
+			reloaded:             configYAML("new", "5m", ""),
+			run:                  true,
+			expectedClient:       "new",
+			expectedAccessExp:    5 * time.Minute,
+			expectedLastReload:   1,
+			expectedSuccessDelta: 1,
+		},
+		{
+			name:                 "Invalid config is rejected and the current one kept",
+			reloaded:             configYAML("new", "5m", "unknown_key: true\n"),
+			expectError:          true,
+			expectedClient:       "old",
+			expectedAccessExp:    time.Hour,
+			expectedLastReload:   0,
+			expectedFailureDelta: 1,
+		},
+		{
+			name:                 "Config failing to apply is rejected and the current one kept",
+			reloaded:             configYAML("fail", "5m", ""),
+			expectError:          true,
+			expectedClient:       "old",
+			expectedAccessExp:    time.Hour,
+			expectedLastReload:   0,
+			expectedFailureDelta: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			start := time.Now().Add(-time.Minute)
+			writeConfig(t, path, configYAML("old", "1h", ""), start)
+
+			cfg, err := config.LoadConfig(path)
+			if err != nil {
+				t.Fatalf("could not load config: %v\n", err)
+			}
+
+			clients, err := auth.NewClientRegistry(cfg.Clients)
+			if err != nil {
+				t.Fatalf("could not register clients: %v\n", err)
+			}
+
+			tokenRepo, err := store.NewMemoryTokenStore()
+			if err != nil {
+				t.Fatalf("could not create token store: %v\n", err)
+			}
+
+			manager := auth.NewManager(cfg, tokenRepo, clients)
+
+			// the apply func of serve, failing for the client named fail
+			w := NewWatcher([]string{path}, cfg, func(reloaded *config.Config) error {
+				if reloaded.Clients[0].ID == "fail" {
+					return os.ErrInvalid
+				}
+
+				if err := clients.Replace(reloaded.Clients); err != nil {
+					return err
+				}
+
+				manager.Reload(reloaded)
+
+				return nil
+			})
+
+			successes := testutil.ToFloat64(metrics.ConfigReloads.WithLabelValues(metrics.ReloadSuccess))
+			failures := testutil.ToFloat64(metrics.ConfigReloads.WithLabelValues(metrics.ReloadFailure))
+
+			writeConfig(t, path, tt.reloaded, start.Add(time.Second))
+
+			if tt.run {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				go w.Run(ctx)
+
+				deadline := time.Now().Add(time.Second)
+				for time.Now().Before(deadline) && testutil.ToFloat64(metrics.ConfigReloads.WithLabelValues(metrics.ReloadSuccess)) == successes {
+					time.Sleep(10 * time.Millisecond)
+				}
+			} else if err := w.Reload(context.Background()); tt.expectError != (err != nil) {
+				t.Fatalf("got error %v but wanted error %t\n", err, tt.expectError)
+			}
+
+			ctx := context.Background()
+			for _, id := range []string{"old", "new"} {
+				if _, err := clients.GetByID(ctx, id); (err == nil) != (id == tt.expectedClient) {
+					t.Errorf("got client %q registered %t but wanted client %q\n", id, err == nil, tt.expectedClient)
+				}
+			}
+
+			ti, err := manager.IssueAccessToken(ctx, &oauth2.TokenGenerateRequest{ClientID: tt.expectedClient})
+			if err != nil {
+				t.Fatalf("could not issue token: %v\n", err)
+			}
+
+			if ti.GetAccessExpiresIn() != tt.expectedAccessExp {
+				t.Errorf("got access token lifetime %s but wanted %s\n", ti.GetAccessExpiresIn(), tt.expectedAccessExp)
+			}
+
+			if got := testutil.ToFloat64(metrics.ConfigLastReloadSuccessful); got != tt.expectedLastReload {
+				t.Errorf("got config_last_reload_successful %g but wanted %g\n", got, tt.expectedLastReload)
+			}
+
+			if got := testutil.ToFloat64(metrics.ConfigReloads.WithLabelValues(metrics.ReloadSuccess)) - successes; got != tt.expectedSuccessDelta {
+				t.Errorf("got %g successful reloads but wanted %g\n", got, tt.expectedSuccessDelta)
+			}
+
+			if got := testutil.ToFloat64(metrics.ConfigReloads.WithLabelValues(metrics.ReloadFailure)) - failures; got != tt.expectedFailureDelta {
+				t.Errorf("got %g failed reloads but wanted %g\n", got, tt.expectedFailureDelta)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/go-oauth2/oauth2/v4/models"
+	"github.com/go-oauth2/oauth2/v4/store"
+	"github.com/pkg/errors"
+
+	"github.com/laonix/oauth2/internal/config"
+)
+
+// Client is a registered client along with the server specific settings of the client.
+type Client struct {
+	models.Client
+
+	RefreshTokens bool
+	RedirectURIs  []string
+	Audience      string
+}
+
+// GetRedirectURIs returns the redirect URIs registered for the client.
+func (c *Client) GetRedirectURIs() []string {
+	return c.RedirectURIs
+}
+
+// NewClientStore creates a client store holding the registered clients.
+func NewClientStore(clients []config.Client) (*store.ClientStore, error) {
+	clientRepo := store.NewClientStore()
+	registered := make(map[string]bool, len(clients))
+
+	for _, c := range clients {
+		if c.ID == "" {
+			return nil, errors.New("client without id")
+		}
+
+		if registered[c.ID] {
+			return nil, errors.Errorf("client %q is registered twice", c.ID)
+		}
+		registered[c.ID] = true
+
+		if c.Public && c.Secret != "" {
+			return nil, errors.Errorf("public client %q must not have a secret", c.ID)
+		}
+
+		if !c.Public && c.Secret == "" {
+			return nil, errors.Errorf("confidential client %q has no secret", c.ID)
+		}
+
+		if err := clientRepo.Set(c.ID, &Client{
+			Client: models.Client{
+				ID:     c.ID,
+				Secret: c.Secret,
+				Public: c.Public,
+			},
+			RefreshTokens: c.RefreshTokens,
+			RedirectURIs:  c.RedirectURIs,
+			Audience:      c.Audience,
+		}); err != nil {
+			return nil, errors.Wrapf(errors.WithStack(err), "failed to register client %q", c.ID)
+		}
+	}
+
+	return clientRepo, nil
+}
+
+// ClientRegistry is a client store whose clients are replaced at runtime.
+type ClientRegistry struct {
+	clients atomic.Pointer[store.ClientStore]
+}
+
+// NewClientRegistry creates a client registry holding the registered clients.
+func NewClientRegistry(clients []config.Client) (*ClientRegistry, error) {
+	r := &ClientRegistry{}
+	if err := r.Replace(clients); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Replace replaces the registered clients, keeping the current ones if any of the new clients is invalid.
+//
+// The tokens already issued to the removed clients stay valid until they expire.
+func (r *ClientRegistry) Replace(clients []config.Client) error {
+	clientRepo, err := NewClientStore(clients)
+	if err != nil {
+		return err
+	}
+
+	r.clients.Store(clientRepo)
+
+	return nil
+}
+
+// GetByID returns the client by its id, see oauth2.ClientStore.
+func (r *ClientRegistry) GetByID(ctx context.Context, id string) (oauth2.ClientInfo, error) {
+	return r.clients.Load().GetByID(ctx, id)
+}
+
+// refreshTokensEnabled reports whether refresh tokens are issued to the client.
+func refreshTokensEnabled(cli oauth2.ClientInfo) bool {
+	c, ok := cli.(*Client)
+
+	return ok && c.RefreshTokens
+}
+
+// audienceOf returns the aud claim of the tokens issued to the client: its Audience, or its id without one.
+func audienceOf(cli oauth2.ClientInfo) string {
+	if c, ok := cli.(*Client); ok && c.Audience != "" {
+		return c.Audience
+	}
+
+	return cli.GetID()
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/laonix/oauth2/internal/config"
+)
+
+func TestClientRegistryReplace(t *testing.T) {
+	tests := []struct {
+		name           string
+		clients        []config.Client
+		expectError    bool
+		expectedClient string
+	}{
+		{
+			name:           "Valid clients replace the current ones",
+			clients:        []config.Client{{ID: "new", Secret: "new_secret"}},
+			expectedClient: "new",
+		},
+		{
+			name:           "Client registered twice keeps the current ones",
+			clients:        []config.Client{{ID: "new", Secret: "new_secret"}, {ID: "new", Secret: "other"}},
+			expectError:    true,
+			expectedClient: "old",
+		},
+		{
+			name:           "Public client with a secret keeps the current ones",
+			clients:        []config.Client{{ID: "new", Secret: "new_secret", Public: true}},
+			expectError:    true,
+			expectedClient: "old",
+		},
+		{
+			name:           "Confidential client without secret keeps the current ones",
+			clients:        []config.Client{{ID: "new"}},
+			expectError:    true,
+			expectedClient: "old",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewClientRegistry([]config.Client{{ID: "old", Secret: "old_secret"}})
+			if err != nil {
+				t.Fatalf("could not register clients: %v\n", err)
+			}
+
+			if err := r.Replace(tt.clients); tt.expectError != (err != nil) {
+				t.Errorf("got error %v but wanted error %t\n", err, tt.expectError)
+			}
+
+			for _, id := range []string{"old", "new"} {
+				if _, err := r.GetByID(context.Background(), id); (err == nil) != (id == tt.expectedClient) {
+					t.Errorf("got client %q registered %t but wanted client %q\n", id, err == nil, tt.expectedClient)
+				}
+			}
+		})
+	}
+}
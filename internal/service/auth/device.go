@@ -0,0 +1,257 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4"
+	oerrors "github.com/go-oauth2/oauth2/v4/errors"
+	"github.com/go-oauth2/oauth2/v4/models"
+	"github.com/pkg/errors"
+
+	"github.com/laonix/oauth2/internal/config"
+)
+
+// DeviceCodeGrantType is the grant type of the device authorization grant (RFC 8628).
+const DeviceCodeGrantType oauth2.GrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+const (
+	// userCodeAlphabet has no vowels, so that user codes don't spell words, and no easily confused characters.
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+
+	// deviceKeyPrefix separates the device authorizations from the authorization codes in the token store.
+	deviceKeyPrefix = "device:"
+
+	// slowDownIncrement is added to the polling interval of a device told to slow down (RFC 8628 section 3.5).
+	slowDownIncrement = 5 * time.Second
+)
+
+// DeviceGrant serves the device authorization grant (RFC 8628) for devices without a browser.
+//
+// A device authorization is kept in the token store as the code token information of its user code:
+// the code challenge holds the hash of the device secret, the user id is set once the user approves
+// the authorization, the access creation time is the last time the device polled and the access expiry
+// is the polling interval of the device, increased on every slow_down.
+// The device code handed to the device is made of the user code and the device secret.
+type DeviceGrant struct {
+	manager         *Manager
+	verificationURI string
+	expiresIn       time.Duration
+	interval        time.Duration
+
+	mu sync.Mutex
+}
+
+// NewDeviceGrant creates a new instance of DeviceGrant.
+func NewDeviceGrant(cfg config.DeviceCode, manager *Manager) *DeviceGrant {
+	return &DeviceGrant{
+		manager:         manager,
+		verificationURI: cfg.VerificationURI,
+		expiresIn:       cfg.ExpiresIn,
+		interval:        cfg.Interval,
+	}
+}
+
+// HandleDeviceAuthorizationRequest authenticates the client and starts a device authorization (RFC 8628 section 3.1).
+//
+// It returns the parameters of the device authorization response.
+func (g *DeviceGrant) HandleDeviceAuthorizationRequest(r *http.Request) (map[string]interface{}, error) {
+	ctx := r.Context()
+
+	cli, err := g.manager.AuthenticateClient(r)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var userCode string
+	for {
+		userCode, err = newUserCode()
+		if err != nil {
+			return nil, err
+		}
+
+		ti, err := g.manager.tokenRepo.GetByCode(ctx, deviceKeyPrefix+userCode)
+		if err != nil {
+			return nil, err
+		}
+
+		if ti == nil {
+			break
+		}
+	}
+
+	ti := models.NewToken()
+	ti.SetCode(deviceKeyPrefix + userCode)
+	ti.SetClientID(cli.GetID())
+	ti.SetScope(r.FormValue("scope"))
+	ti.SetCodeCreateAt(time.Now())
+	ti.SetCodeExpiresIn(g.expiresIn)
+	ti.SetCodeChallenge(hashSecret(secret))
+	ti.SetAccessExpiresIn(g.interval)
+
+	if err := g.manager.tokenRepo.Create(ctx, ti); err != nil {
+		return nil, err
+	}
+
+	displayCode := userCode[:userCodeLength/2] + "-" + userCode[userCodeLength/2:]
+
+	return map[string]interface{}{
+		"device_code":               userCode + "." + secret,
+		"user_code":                 displayCode,
+		"verification_uri":          g.verificationURI,
+		"verification_uri_complete": g.verificationURI + "?" + url.Values{"user_code": {displayCode}}.Encode(),
+		"expires_in":                int64(g.expiresIn / time.Second),
+		"interval":                  int64(g.interval / time.Second),
+	}, nil
+}
+
+// HandleTokenRequest answers the polling of the device (RFC 8628 section 3.4).
+//
+// The access token is issued once the user has approved the device authorization, until then
+// the device is told to keep polling or, if it polls too often, to slow down: its polling interval
+// then grows by 5 seconds for this and every later request.
+func (g *DeviceGrant) HandleTokenRequest(r *http.Request) (oauth2.TokenInfo, error) {
+	ctx := r.Context()
+
+	cli, err := g.manager.AuthenticateClient(r)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceCode := r.FormValue("device_code")
+	if deviceCode == "" {
+		return nil, errors.Wrap(oerrors.ErrInvalidRequest, "device code is missing")
+	}
+
+	userCode, secret, ok := strings.Cut(deviceCode, ".")
+	if !ok {
+		return nil, errors.Wrap(oerrors.ErrInvalidGrant, "malformed device code")
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ti, err := g.manager.tokenRepo.GetByCode(ctx, deviceKeyPrefix+userCode)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	// the token store drops the device authorizations on expiry
+	if ti == nil || ti.GetCodeCreateAt().Add(ti.GetCodeExpiresIn()).Before(now) {
+		return nil, errors.Wrap(ErrExpiredToken, "device code is unknown or expired")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(ti.GetCodeChallenge()), []byte(hashSecret(secret))) != 1 {
+		return nil, errors.Wrap(oerrors.ErrInvalidGrant, "device secret doesn't match")
+	}
+
+	if ti.GetClientID() != cli.GetID() {
+		return nil, errors.Wrap(oerrors.ErrInvalidGrant, "device code is issued to another client")
+	}
+
+	if ti.GetUserID() == "" {
+		lastPoll, interval := ti.GetAccessCreateAt(), ti.GetAccessExpiresIn()
+
+		slowDown := !lastPoll.IsZero() && now.Sub(lastPoll) < interval
+		if slowDown {
+			ti.SetAccessExpiresIn(interval + slowDownIncrement)
+		}
+
+		ti.SetAccessCreateAt(now)
+		if err := g.manager.tokenRepo.Create(ctx, ti); err != nil {
+			return nil, err
+		}
+
+		if slowDown {
+			return nil, ErrSlowDown
+		}
+
+		return nil, ErrAuthorizationPending
+	}
+
+	// the device code is single use
+	if err := g.manager.tokenRepo.RemoveByCode(ctx, deviceKeyPrefix+userCode); err != nil {
+		return nil, err
+	}
+
+	return g.manager.IssueAccessToken(ctx, &oauth2.TokenGenerateRequest{
+		ClientID: cli.GetID(),
+		UserID:   ti.GetUserID(),
+		Scope:    ti.GetScope(),
+		Request:  r,
+	})
+}
+
+// Approve approves the device authorization of the user code on behalf of the user.
+func (g *DeviceGrant) Approve(ctx context.Context, userCode, userID string) error {
+	userCode = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(userCode))
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ti, err := g.manager.tokenRepo.GetByCode(ctx, deviceKeyPrefix+userCode)
+	if err != nil {
+		return err
+	}
+
+	if ti == nil || ti.GetCodeCreateAt().Add(ti.GetCodeExpiresIn()).Before(time.Now()) {
+		return errors.Wrap(oerrors.ErrInvalidRequest, "user code is unknown or expired")
+	}
+
+	if ti.GetUserID() != "" {
+		return errors.Wrap(oerrors.ErrInvalidRequest, "user code is already approved")
+	}
+
+	ti.SetUserID(userID)
+
+	return g.manager.tokenRepo.Create(ctx, ti)
+}
+
+func newUserCode() (string, error) {
+	code := make([]byte, userCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+
+		code[i] = userCodeAlphabet[n.Int64()]
+	}
+
+	return string(code), nil
+}
+
+func randomString(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/laonix/oauth2/internal/config"
+)
+
+func TestDeviceGrantSlowDown(t *testing.T) {
+	m := newTestManager(t, config.Client{ID: "cli", Public: true})
+	g := NewDeviceGrant(config.DeviceCode{ExpiresIn: time.Hour, Interval: time.Second}, m)
+
+	request := func(form url.Values) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		return req
+	}
+
+	authorization, err := g.HandleDeviceAuthorizationRequest(request(url.Values{"client_id": {"cli"}}))
+	if err != nil {
+		t.Fatalf("could not start device authorization: %v\n", err)
+	}
+
+	deviceCode := authorization["device_code"].(string)
+	userCode, _, _ := strings.Cut(deviceCode, ".")
+
+	tests := []struct {
+		name string
+		// sinceLastPoll is the time since the last poll, 0 for the first one
+		sinceLastPoll time.Duration
+		expectedErr   error
+	}{
+		{
+			name:        "First poll",
+			expectedErr: ErrAuthorizationPending,
+		},
+		{
+			name:          "Poll within the interval",
+			sinceLastPoll: 500 * time.Millisecond,
+			expectedErr:   ErrSlowDown,
+		},
+		{
+			name:          "Poll after the initial interval, within the one grown by 5 seconds",
+			sinceLastPoll: 2 * time.Second,
+			expectedErr:   ErrSlowDown,
+		},
+		{
+			name:          "Poll within the interval grown again",
+			sinceLastPoll: 10 * time.Second,
+			expectedErr:   ErrSlowDown,
+		},
+		{
+			name:          "Poll after the interval",
+			sinceLastPoll: 16 * time.Second,
+			expectedErr:   ErrAuthorizationPending,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.sinceLastPoll > 0 {
+				ti, err := m.tokenRepo.GetByCode(context.Background(), deviceKeyPrefix+userCode)
+				if err != nil {
+					t.Fatalf("could not load device authorization: %v\n", err)
+				}
+
+				ti.SetAccessCreateAt(time.Now().Add(-tt.sinceLastPoll))
+				if err := m.tokenRepo.Create(context.Background(), ti); err != nil {
+					t.Fatalf("could not store device authorization: %v\n", err)
+				}
+			}
+
+			_, err := g.HandleTokenRequest(request(url.Values{
+				"grant_type":  {string(DeviceCodeGrantType)},
+				"client_id":   {"cli"},
+				"device_code": {deviceCode},
+			}))
+			if err != tt.expectedErr {
+				t.Errorf("got error %v but wanted %v\n", err, tt.expectedErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"net/http"
+
+	oerrors "github.com/go-oauth2/oauth2/v4/errors"
+)
+
+// Errors of the extension grants, in addition to the RFC 6749 ones defined by the oauth2 errors package.
+var (
+	// ErrInvalidTarget is returned when the requested audience of a token exchange isn't allowed (RFC 8693 section 2.2.2).
+	ErrInvalidTarget = oerrors.New("invalid_target")
+
+	// ErrAuthorizationPending is returned when the user hasn't approved the device authorization yet (RFC 8628 section 3.5).
+	ErrAuthorizationPending = oerrors.New("authorization_pending")
+	// ErrSlowDown is returned when the device polls more often than the polling interval (RFC 8628 section 3.5).
+	ErrSlowDown = oerrors.New("slow_down")
+	// ErrExpiredToken is returned when the device code has expired (RFC 8628 section 3.5).
+	ErrExpiredToken = oerrors.New("expired_token")
+)
+
+// register the descriptions and status codes so that server.Server.GetErrorData reports the errors as is
+func init() {
+	oerrors.Descriptions[ErrInvalidTarget] = "The requested audience is invalid, unknown, or not allowed for the client"
+	oerrors.StatusCodes[ErrInvalidTarget] = http.StatusBadRequest
+
+	oerrors.Descriptions[ErrAuthorizationPending] = "The authorization request is still pending as the user hasn't approved it yet"
+	oerrors.StatusCodes[ErrAuthorizationPending] = http.StatusBadRequest
+
+	oerrors.Descriptions[ErrSlowDown] = "The authorization request is still pending and polling should be slowed down"
+	oerrors.StatusCodes[ErrSlowDown] = http.StatusBadRequest
+
+	oerrors.Descriptions[ErrExpiredToken] = "The device code has expired, a new device authorization request is required"
+	oerrors.StatusCodes[ErrExpiredToken] = http.StatusBadRequest
+}
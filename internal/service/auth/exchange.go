@@ -0,0 +1,226 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4"
+	oerrors "github.com/go-oauth2/oauth2/v4/errors"
+	"github.com/golang-jwt/jwt"
+	"github.com/pkg/errors"
+
+	"github.com/laonix/oauth2/internal/config"
+)
+
+// TokenExchangeGrantType is the grant type of the token exchange grant (RFC 8693).
+const TokenExchangeGrantType oauth2.GrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+// Token type identifiers (RFC 8693 section 3) of the tokens accepted and issued by the token exchange grant.
+const (
+	AccessTokenType = "urn:ietf:params:oauth:token-type:access_token"
+	JWTTokenType    = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// TokenExchangeGrant exchanges access tokens issued by the server for down-scoped or re-audienced ones.
+//
+// The exchanged token is issued to the requesting client on behalf of the subject of the subject token.
+// Unless the client impersonates the subject, the token carries an act claim naming the acting party,
+// which is the subject of the actor token or the requesting client itself.
+type TokenExchangeGrant struct {
+	manager  *Manager
+	policies map[string]*exchangePolicy
+}
+
+type exchangePolicy struct {
+	audiences     []string
+	scopes        []string
+	impersonation bool
+}
+
+// exchangedToken is the token information of an exchanged token.
+type exchangedToken struct {
+	oauth2.TokenInfo
+}
+
+// ExtensionFields returns the token response parameters required by RFC 8693 section 2.2.1.
+func (t *exchangedToken) ExtensionFields() map[string]interface{} {
+	return map[string]interface{}{
+		"issued_token_type": AccessTokenType,
+	}
+}
+
+// NewTokenExchangeGrant creates a new instance of TokenExchangeGrant.
+func NewTokenExchangeGrant(cfg config.TokenExchange, manager *Manager) (*TokenExchangeGrant, error) {
+	g := &TokenExchangeGrant{
+		manager:  manager,
+		policies: make(map[string]*exchangePolicy, len(cfg.Policies)),
+	}
+
+	for _, pc := range cfg.Policies {
+		if pc.ClientID == "" {
+			return nil, errors.New("token exchange policy without client id")
+		}
+
+		if _, ok := g.policies[pc.ClientID]; ok {
+			return nil, errors.Errorf("token exchange policy of client %q is configured twice", pc.ClientID)
+		}
+
+		g.policies[pc.ClientID] = &exchangePolicy{
+			audiences:     pc.Audiences,
+			scopes:        pc.Scopes,
+			impersonation: pc.Impersonation,
+		}
+	}
+
+	return g, nil
+}
+
+// HandleTokenRequest validates the token exchange request and issues the exchanged access token.
+func (g *TokenExchangeGrant) HandleTokenRequest(r *http.Request) (oauth2.TokenInfo, error) {
+	ctx := r.Context()
+
+	cli, err := g.manager.AuthenticateClient(r)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, ok := g.policies[cli.GetID()]
+	if !ok {
+		return nil, errors.Wrapf(oerrors.ErrUnauthorizedClient, "client %q has no token exchange policy", cli.GetID())
+	}
+
+	if tt := r.FormValue("requested_token_type"); tt != "" && tt != AccessTokenType {
+		return nil, errors.Wrapf(oerrors.ErrInvalidRequest, "requested token type %q is not supported", tt)
+	}
+
+	subject, subjectClaims, err := g.loadToken(ctx, r.FormValue("subject_token"), r.FormValue("subject_token_type"))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid subject token")
+	}
+
+	audience := r.FormValue("audience")
+	if audience == "" {
+		audience = subjectClaims.Audience
+	} else if !slices.Contains(policy.audiences, audience) {
+		return nil, errors.Wrapf(ErrInvalidTarget, "audience %q is not allowed", audience)
+	}
+
+	scope, err := policy.scope(r.FormValue("scope"), subject.GetScope())
+	if err != nil {
+		return nil, err
+	}
+
+	var actor *Actor
+	if actorToken := r.FormValue("actor_token"); actorToken != "" {
+		actorInfo, _, err := g.loadToken(ctx, actorToken, r.FormValue("actor_token_type"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid actor token")
+		}
+
+		actor = &Actor{Subject: subjectOf(actorInfo)}
+	} else if r.FormValue("actor_token_type") != "" {
+		return nil, errors.Wrap(oerrors.ErrInvalidRequest, "actor token type without actor token")
+	} else if !policy.impersonation {
+		actor = &Actor{Subject: cli.GetID()}
+	}
+
+	// prior actors of the subject token stay in the chain, also when the subject is impersonated
+	act := subjectClaims.Actor
+	if actor != nil {
+		actor.Actor = act
+		act = actor
+	}
+
+	// the exchanged token must not outlive the subject token
+	exp := g.manager.tokens().accessTokenExp
+	if subject.GetAccessExpiresIn() > 0 {
+		remaining := time.Until(subject.GetAccessCreateAt().Add(subject.GetAccessExpiresIn()))
+		if exp == 0 || remaining < exp {
+			exp = remaining
+		}
+	}
+
+	ti, err := g.manager.IssueAccessToken(withTokenClaims(ctx, &tokenClaims{
+		Audience: audience,
+		Actor:    act,
+	}), &oauth2.TokenGenerateRequest{
+		ClientID:       cli.GetID(),
+		UserID:         subjectOf(subject),
+		Scope:          scope,
+		AccessTokenExp: exp,
+		Request:        r,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &exchangedToken{TokenInfo: ti}, nil
+}
+
+// loadToken loads an access token issued by the server along with its claims.
+func (g *TokenExchangeGrant) loadToken(ctx context.Context, token, tokenType string) (oauth2.TokenInfo, *AccessClaims, error) {
+	if token == "" || tokenType == "" {
+		return nil, nil, errors.Wrap(oerrors.ErrInvalidRequest, "token or token type is missing")
+	}
+
+	if tokenType != AccessTokenType && tokenType != JWTTokenType {
+		return nil, nil, errors.Wrapf(oerrors.ErrInvalidRequest, "token type %q is not supported", tokenType)
+	}
+
+	ti, err := g.manager.LoadAccessToken(ctx, token)
+	if err != nil {
+		return nil, nil, errors.Wrap(oerrors.ErrInvalidGrant, err.Error())
+	}
+
+	// the token is found in the store, so it's issued by the server and its signature is already trusted
+	claims := &AccessClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil {
+		return nil, nil, errors.Wrap(oerrors.ErrInvalidGrant, err.Error())
+	}
+
+	return ti, claims, nil
+}
+
+// scope resolves the scope of the exchanged token.
+//
+// Requested scopes must be both allowed by the policy and granted to the subject token.
+// Without a scope request the exchanged token gets the granted scopes allowed by the policy.
+func (p *exchangePolicy) scope(requested, granted string) (string, error) {
+	grantedScopes := strings.Fields(granted)
+
+	if requested == "" {
+		var scopes []string
+		for _, s := range grantedScopes {
+			if slices.Contains(p.scopes, s) {
+				scopes = append(scopes, s)
+			}
+		}
+
+		return strings.Join(scopes, " "), nil
+	}
+
+	requestedScopes := strings.Fields(requested)
+	for _, s := range requestedScopes {
+		if !slices.Contains(p.scopes, s) {
+			return "", errors.Wrapf(oerrors.ErrInvalidScope, "scope %q is not allowed", s)
+		}
+
+		if !slices.Contains(grantedScopes, s) {
+			return "", errors.Wrapf(oerrors.ErrInvalidScope, "scope %q is not granted to the subject token", s)
+		}
+	}
+
+	return strings.Join(requestedScopes, " "), nil
+}
+
+// subjectOf returns the subject a token is issued for: its user or, for client tokens, its client.
+func subjectOf(ti oauth2.TokenInfo) string {
+	if userID := ti.GetUserID(); userID != "" {
+		return userID
+	}
+
+	return ti.GetClientID()
+}
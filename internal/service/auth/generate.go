@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/laonix/oauth2/internal/metrics"
+	"github.com/laonix/oauth2/internal/tracing"
+	"github.com/laonix/oauth2/pkg/resource"
+)
+
+// AccessClaims are the claims of the access tokens issued by the server.
+type AccessClaims struct {
+	jwt.StandardClaims
+	Scope string `json:"scope,omitempty"`
+	Actor *Actor `json:"act,omitempty"`
+}
+
+// Actor is the act claim of a delegated token, the one verified by the resource servers.
+type Actor = resource.Actor
+
+type tokenClaimsKey struct{}
+
+// tokenClaims are the claims of a single token that can't be derived from oauth2.GenerateBasic.
+type tokenClaims struct {
+	Audience string
+	Actor    *Actor
+}
+
+// withTokenClaims returns a copy of ctx carrying the claims for the token generated with it.
+func withTokenClaims(ctx context.Context, claims *tokenClaims) context.Context {
+	return context.WithValue(ctx, tokenClaimsKey{}, claims)
+}
+
+// accessGenerate generates JWT access tokens the way generates.JWTAccessGenerate does,
+// adding the scope claim and the claims passed with withTokenClaims.
+//
+// Refresh tokens are only generated for the clients with refresh tokens enabled.
+type accessGenerate struct {
+	issuer string
+	keyID  string
+	key    interface{}
+	method jwt.SigningMethod
+}
+
+// selfTest signs a token and verifies it, to check that the signing key is loaded and usable.
+func (a *accessGenerate) selfTest() error {
+	if key, ok := a.key.([]byte); a.key == nil || (ok && len(key) == 0) {
+		return errors.New("signing key is not loaded")
+	}
+
+	signed, err := jwt.NewWithClaims(a.method, &jwt.StandardClaims{Subject: "self-test"}).SignedString(a.key)
+	if err != nil {
+		return errors.Wrap(err, "failed to sign self-test token")
+	}
+
+	_, err = jwt.Parse(signed, func(token *jwt.Token) (interface{}, error) {
+		return a.verifyKey(), nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to verify self-test token")
+	}
+
+	return nil
+}
+
+// verifyKey returns the key verifying the signatures of the tokens.
+func (a *accessGenerate) verifyKey() interface{} {
+	if signer, ok := a.key.(crypto.Signer); ok {
+		return signer.Public()
+	}
+
+	return a.key
+}
+
+func (a *accessGenerate) Token(ctx context.Context, data *oauth2.GenerateBasic, isGenRefresh bool) (access, refresh string, err error) {
+	_, span := tracing.Tracer().Start(ctx, "GenerateAccessToken",
+		trace.WithAttributes(attribute.String("oauth2.signing_method", a.method.Alg())),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	claims := &AccessClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    a.issuer,
+			Audience:  audienceOf(data.Client),
+			Subject:   data.UserID,
+			IssuedAt:  data.TokenInfo.GetAccessCreateAt().Unix(),
+			ExpiresAt: data.TokenInfo.GetAccessCreateAt().Add(data.TokenInfo.GetAccessExpiresIn()).Unix(),
+		},
+		Scope: data.TokenInfo.GetScope(),
+	}
+
+	if tc, ok := ctx.Value(tokenClaimsKey{}).(*tokenClaims); ok {
+		if tc.Audience != "" {
+			claims.Audience = tc.Audience
+		}
+		claims.Actor = tc.Actor
+	}
+
+	token := jwt.NewWithClaims(a.method, claims)
+	if a.keyID != "" {
+		token.Header["kid"] = a.keyID
+	}
+
+	start := time.Now()
+	access, err = token.SignedString(a.key)
+	metrics.TokenSigningDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return "", "", err
+	}
+
+	if isGenRefresh && refreshTokensEnabled(data.Client) {
+		t := uuid.NewSHA1(uuid.Must(uuid.NewRandom()), []byte(access)).String()
+		refresh = base64.URLEncoding.EncodeToString([]byte(t))
+		refresh = strings.ToUpper(strings.TrimRight(refresh, "="))
+	}
+
+	return access, refresh, nil
+}
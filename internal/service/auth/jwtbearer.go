@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"crypto"
+	"net/http"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4"
+	oerrors "github.com/go-oauth2/oauth2/v4/errors"
+	"github.com/golang-jwt/jwt"
+	"github.com/pkg/errors"
+
+	"github.com/laonix/oauth2/internal/config"
+	"github.com/laonix/oauth2/internal/keys"
+)
+
+// JWTBearerGrantType is the grant type of the JWT bearer assertion grant (RFC 7523 section 2.1).
+const JWTBearerGrantType oauth2.GrantType = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+// assertionLeeway is the clock skew tolerated when checking the time claims of an assertion.
+const assertionLeeway = time.Minute
+
+// assertionMethods are the signing methods accepted for assertions.
+// Symmetric methods are left out on purpose: an issuer must not be able to share its signing key with us.
+var assertionMethods = []string{
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"EdDSA",
+}
+
+// JWTBearerGrant exchanges JWTs signed by trusted issuers for access tokens.
+//
+// The client of the issued token is resolved from the assertion subject, so no client secret is required.
+type JWTBearerGrant struct {
+	manager *Manager
+	issuers map[string]*trustedIssuer
+}
+
+type trustedIssuer struct {
+	audience     string
+	keys         map[string]crypto.PublicKey
+	subjectClaim string
+	clients      map[string]string
+}
+
+// NewJWTBearerGrant creates a new instance of JWTBearerGrant.
+//
+// It fails if a trusted issuer is misconfigured or any of its keys can't be loaded.
+func NewJWTBearerGrant(cfg config.JWTBearer, manager *Manager) (*JWTBearerGrant, error) {
+	g := &JWTBearerGrant{
+		manager: manager,
+		issuers: make(map[string]*trustedIssuer, len(cfg.Issuers)),
+	}
+
+	for _, ic := range cfg.Issuers {
+		if ic.Issuer == "" {
+			return nil, errors.New("trusted issuer without issuer identifier")
+		}
+
+		if ic.Audience == "" {
+			return nil, errors.Errorf("trusted issuer %q has no audience", ic.Issuer)
+		}
+
+		if _, ok := g.issuers[ic.Issuer]; ok {
+			return nil, errors.Errorf("trusted issuer %q is configured twice", ic.Issuer)
+		}
+
+		ti := &trustedIssuer{
+			audience:     ic.Audience,
+			keys:         make(map[string]crypto.PublicKey),
+			subjectClaim: ic.SubjectClaim,
+			clients:      make(map[string]string, len(ic.Clients)),
+		}
+
+		if ti.subjectClaim == "" {
+			ti.subjectClaim = "sub"
+		}
+
+		if ic.JWKSFile != "" {
+			jwks, err := keys.ReadJWKSFile(ic.JWKSFile)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to load keys of trusted issuer %q", ic.Issuer)
+			}
+
+			ti.keys = jwks
+		}
+
+		// PEM keys carry no key id, so they are only picked for assertions without a kid header
+		for i, p := range ic.PublicKeys {
+			key, err := keys.ParsePublicKeyPEM([]byte(p))
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to parse public key %d of trusted issuer %q", i, ic.Issuer)
+			}
+
+			if _, ok := ti.keys[""]; ok {
+				return nil, errors.Errorf("trusted issuer %q has more than one key without key id", ic.Issuer)
+			}
+
+			ti.keys[""] = key
+		}
+
+		if len(ti.keys) == 0 {
+			return nil, errors.Errorf("trusted issuer %q has no keys", ic.Issuer)
+		}
+
+		for _, c := range ic.Clients {
+			ti.clients[c.Subject] = c.ClientID
+		}
+
+		g.issuers[ic.Issuer] = ti
+	}
+
+	return g, nil
+}
+
+// HandleTokenRequest validates the assertion of the token request and issues an access token for the mapped client.
+//
+// Rejected assertions result in ErrInvalidGrant wrapped with the reason of the rejection.
+func (g *JWTBearerGrant) HandleTokenRequest(r *http.Request) (oauth2.TokenInfo, error) {
+	assertion := r.FormValue("assertion")
+	if assertion == "" {
+		return nil, errors.Wrap(oerrors.ErrInvalidRequest, "assertion is missing")
+	}
+
+	var issuer *trustedIssuer
+
+	parser := jwt.Parser{
+		ValidMethods:         assertionMethods,
+		SkipClaimsValidation: true,
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := parser.ParseWithClaims(assertion, claims, func(token *jwt.Token) (interface{}, error) {
+		iss, _ := claims["iss"].(string)
+
+		var ok bool
+		issuer, ok = g.issuers[iss]
+		if !ok {
+			return nil, errors.Errorf("issuer %q is not trusted", iss)
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		key, ok := issuer.keys[kid]
+		if !ok {
+			return nil, errors.Errorf("unknown key id %q", kid)
+		}
+
+		return key, nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(oerrors.ErrInvalidGrant, err.Error())
+	}
+
+	if err := validateAssertionClaims(claims, issuer.audience, time.Now()); err != nil {
+		return nil, errors.Wrap(oerrors.ErrInvalidGrant, err.Error())
+	}
+
+	subject, _ := claims[issuer.subjectClaim].(string)
+	clientID, ok := issuer.clients[subject]
+	if !ok {
+		return nil, errors.Wrapf(oerrors.ErrInvalidGrant, "subject %q is not mapped to a client", subject)
+	}
+
+	return g.manager.IssueAccessToken(r.Context(), &oauth2.TokenGenerateRequest{
+		ClientID: clientID,
+		Scope:    r.FormValue("scope"),
+		Request:  r,
+	})
+}
+
+// validateAssertionClaims checks the claims required by RFC 7523 section 3.
+func validateAssertionClaims(claims jwt.MapClaims, audience string, now time.Time) error {
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return errors.New("sub claim is missing")
+	}
+
+	if !claims.VerifyAudience(audience, true) {
+		return errors.New("aud claim doesn't identify this server")
+	}
+
+	if _, ok := claims["exp"]; !ok {
+		return errors.New("exp claim is missing")
+	}
+
+	if !claims.VerifyExpiresAt(now.Add(-assertionLeeway).Unix(), true) {
+		return errors.New("assertion is expired")
+	}
+
+	if !claims.VerifyNotBefore(now.Add(assertionLeeway).Unix(), false) {
+		return errors.New("assertion is not valid yet")
+	}
+
+	if !claims.VerifyIssuedAt(now.Add(assertionLeeway).Unix(), false) {
+		return errors.New("assertion is issued in the future")
+	}
+
+	return nil
+}
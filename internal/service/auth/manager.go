@@ -1,30 +1,333 @@
 package auth
 
 import (
-	"oauth2/internal/config"
+	"context"
+	"crypto"
+	"crypto/subtle"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/laonix/oauth2/internal/config"
+	"github.com/laonix/oauth2/internal/keys"
+	"github.com/laonix/oauth2/pkg/resource"
 
 	"github.com/go-oauth2/oauth2/v4"
+	oerrors "github.com/go-oauth2/oauth2/v4/errors"
 	"github.com/go-oauth2/oauth2/v4/generates"
 	"github.com/go-oauth2/oauth2/v4/manage"
+	"github.com/go-oauth2/oauth2/v4/models"
 	"github.com/golang-jwt/jwt"
+	"github.com/pkg/errors"
 )
 
-func NewManager(cfg *config.Config, tokenRepo oauth2.TokenStore, clientRepo oauth2.ClientStore) oauth2.Manager {
+// Manager is a manage.Manager that can also issue tokens for extension grants,
+// which authenticate the client on their own instead of using its secret.
+//
+// Its token lifetimes are replaced at runtime by Reload.
+type Manager struct {
+	current        atomic.Pointer[tokenManager]
+	accessGenerate *accessGenerate
+	previousKey    *previousKey
+	tokenRepo      oauth2.TokenStore
+	clientRepo     oauth2.ClientStore
+}
+
+// tokenManager is a manage.Manager configured with the token lifetimes, replaced as a whole on reload.
+type tokenManager struct {
+	*manage.Manager
+
+	accessTokenExp time.Duration
+}
+
+func NewManager(cfg *config.Config, tokenRepo oauth2.TokenStore, clientRepo oauth2.ClientStore) *Manager {
 	if cfg == nil {
 		return nil
 	}
 
+	// the key is checked by config.LoadConfig, a key that fails to parse anyway fails the signing readiness check
+	method := jwt.GetSigningMethod(cfg.JWT.Algorithm)
+	if method == nil {
+		method = jwt.SigningMethodHS256
+	}
+
+	key, _ := keys.ParseSigningKey(method.Alg(), []byte(cfg.JWT.Secret))
+
+	// the tokens name the public key verifying them by its key ID, the kid of the JWKS
+	var keyID string
+	if signer, ok := key.(crypto.Signer); ok {
+		keyID, _ = keys.KeyID(signer.Public())
+	}
+
+	m := &Manager{
+		accessGenerate: &accessGenerate{
+			issuer: cfg.JWT.Issuer,
+			keyID:  keyID,
+			key:    key,
+			method: method,
+		},
+		tokenRepo:  tokenRepo,
+		clientRepo: clientRepo,
+	}
+	m.current.Store(m.newTokenManager(cfg))
+
+	// the tokens signed before the restart with the key replaced by the last rotation are verified until they expire
+	if previous, err := keys.ParseSigningKey(method.Alg(), []byte(cfg.JWT.PreviousSecret)); err == nil && cfg.JWT.PreviousSecret != "" {
+		if signer, ok := previous.(crypto.Signer); ok {
+			if previousKeyID, err := keys.KeyID(signer.Public()); err == nil && previousKeyID != keyID {
+				m.previousKey = &previousKey{
+					keyID: previousKeyID,
+					key:   signer.Public(),
+					until: time.Now().Add(cfg.JWT.AccessTokenExpiresIn),
+				}
+			}
+		}
+	}
+
+	return m
+}
+
+// Reload replaces the token lifetimes with the ones of cfg.
+//
+// The requests being served keep the lifetimes they started with. The signing key isn't replaced.
+func (m *Manager) Reload(cfg *config.Config) {
+	m.current.Store(m.newTokenManager(cfg))
+}
+
+func (m *Manager) newTokenManager(cfg *config.Config) *tokenManager {
 	manager := manage.NewManager()
 	managerCfg := &manage.Config{
-		AccessTokenExp: cfg.JWT.AccessTokenExpiresIn,
+		AccessTokenExp:    cfg.JWT.AccessTokenExpiresIn,
+		RefreshTokenExp:   cfg.JWT.RefreshTokenExpiresIn,
+		IsGenerateRefresh: true,
 	}
 
 	manager.SetClientTokenCfg(managerCfg)
+	manager.SetAuthorizeCodeTokenCfg(managerCfg)
+	manager.SetAuthorizeCodeExp(cfg.Grants.AuthorizationCode.CodeExpiresIn)
+
+	// every refresh rotates the refresh token, see RefreshGrant
+	manager.SetRefreshTokenCfg(&manage.RefreshingConfig{
+		AccessTokenExp:     cfg.JWT.AccessTokenExpiresIn,
+		RefreshTokenExp:    cfg.JWT.RefreshTokenExpiresIn,
+		IsGenerateRefresh:  true,
+		IsResetRefreshTime: true,
+		IsRemoveAccess:     true,
+		IsRemoveRefreshing: true,
+	})
+
+	manager.MapAccessGenerate(m.accessGenerate)
+	manager.MapAuthorizeGenerate(generates.NewAuthorizeGenerate())
+
+	manager.MapTokenStorage(m.tokenRepo)
+	manager.MapClientStorage(m.clientRepo)
+
+	return &tokenManager{
+		Manager:        manager,
+		accessTokenExp: cfg.JWT.AccessTokenExpiresIn,
+	}
+}
+
+// tokens returns the current token manager.
+func (m *Manager) tokens() *tokenManager {
+	return m.current.Load()
+}
+
+// GetClient returns the client information, see oauth2.Manager.
+func (m *Manager) GetClient(ctx context.Context, clientID string) (oauth2.ClientInfo, error) {
+	return m.tokens().GetClient(ctx, clientID)
+}
+
+// GenerateAuthToken generates an authorization code, see oauth2.Manager.
+func (m *Manager) GenerateAuthToken(ctx context.Context, rt oauth2.ResponseType, tgr *oauth2.TokenGenerateRequest) (oauth2.TokenInfo, error) {
+	return m.tokens().GenerateAuthToken(ctx, rt, tgr)
+}
+
+// RefreshAccessToken refreshes an access token, see oauth2.Manager.
+func (m *Manager) RefreshAccessToken(ctx context.Context, tgr *oauth2.TokenGenerateRequest) (oauth2.TokenInfo, error) {
+	return m.tokens().RefreshAccessToken(ctx, tgr)
+}
+
+// RemoveAccessToken removes an access token, see oauth2.Manager.
+func (m *Manager) RemoveAccessToken(ctx context.Context, access string) error {
+	return m.tokens().RemoveAccessToken(ctx, access)
+}
+
+// RemoveRefreshToken removes a refresh token, see oauth2.Manager.
+func (m *Manager) RemoveRefreshToken(ctx context.Context, refresh string) error {
+	return m.tokens().RemoveRefreshToken(ctx, refresh)
+}
+
+// LoadAccessToken returns the token information of an access token, see oauth2.Manager.
+func (m *Manager) LoadAccessToken(ctx context.Context, access string) (oauth2.TokenInfo, error) {
+	return m.tokens().LoadAccessToken(ctx, access)
+}
+
+// LoadRefreshToken returns the token information of a refresh token, see oauth2.Manager.
+func (m *Manager) LoadRefreshToken(ctx context.Context, refresh string) (oauth2.TokenInfo, error) {
+	return m.tokens().LoadRefreshToken(ctx, refresh)
+}
+
+// AuthenticateClient authenticates the client of the request by its Basic Authentication credentials.
+//
+// Public clients have no credentials and are identified by the client_id parameter instead.
+func (m *Manager) AuthenticateClient(r *http.Request) (oauth2.ClientInfo, error) {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		cli, err := m.GetClient(r.Context(), r.FormValue("client_id"))
+		if err != nil || !cli.IsPublic() {
+			return nil, oerrors.ErrInvalidClient
+		}
+
+		return cli, nil
+	}
 
-	manager.MapAccessGenerate(generates.NewJWTAccessGenerate("", []byte(cfg.JWT.Secret), jwt.SigningMethodHS256))
+	cli, err := m.GetClient(r.Context(), clientID)
+	if err != nil {
+		return nil, oerrors.ErrInvalidClient
+	}
+
+	if verifier, ok := cli.(oauth2.ClientPasswordVerifier); ok {
+		if !verifier.VerifyPassword(secret) {
+			return nil, oerrors.ErrInvalidClient
+		}
+	} else if subtle.ConstantTimeCompare([]byte(cli.GetSecret()), []byte(secret)) != 1 {
+		return nil, oerrors.ErrInvalidClient
+	}
+
+	return cli, nil
+}
+
+// GenerateAccessToken is manage.Manager.GenerateAccessToken reporting unknown clients as invalid clients,
+// the way AuthenticateClient does, instead of as server errors.
+func (m *Manager) GenerateAccessToken(ctx context.Context, gt oauth2.GrantType, tgr *oauth2.TokenGenerateRequest) (oauth2.TokenInfo, error) {
+	if _, err := m.GetClient(ctx, tgr.ClientID); err != nil {
+		return nil, oerrors.ErrInvalidClient
+	}
+
+	return m.tokens().GenerateAccessToken(ctx, gt, tgr)
+}
+
+// IssueAccessToken generates and stores an access token for the client of the request.
+//
+// Unlike GenerateAccessToken it doesn't check the client secret: the caller must have authenticated the client already.
+func (m *Manager) IssueAccessToken(ctx context.Context, tgr *oauth2.TokenGenerateRequest) (oauth2.TokenInfo, error) {
+	cli, err := m.GetClient(ctx, tgr.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	ti := models.NewToken()
+	ti.SetClientID(tgr.ClientID)
+	ti.SetUserID(tgr.UserID)
+	ti.SetScope(tgr.Scope)
+
+	createAt := time.Now()
+	ti.SetAccessCreateAt(createAt)
+
+	exp := m.tokens().accessTokenExp
+	if tgr.AccessTokenExp > 0 {
+		exp = tgr.AccessTokenExp
+	}
+	ti.SetAccessExpiresIn(exp)
+
+	access, _, err := m.accessGenerate.Token(ctx, &oauth2.GenerateBasic{
+		Client:    cli,
+		UserID:    tgr.UserID,
+		CreateAt:  createAt,
+		TokenInfo: ti,
+		Request:   tgr.Request,
+	}, false)
+	if err != nil {
+		return nil, err
+	}
+	ti.SetAccess(access)
+
+	if err := m.tokenRepo.Create(ctx, ti); err != nil {
+		return nil, err
+	}
+
+	return ti, nil
+}
+
+// CheckSigning checks that the signing key is loaded, by signing and verifying a token.
+func (m *Manager) CheckSigning(ctx context.Context) error {
+	return m.accessGenerate.selfTest()
+}
+
+// CheckTokenStore checks that the token store is reachable, by looking up a token that doesn't exist.
+func (m *Manager) CheckTokenStore(ctx context.Context) error {
+	if _, err := m.tokenRepo.GetByAccess(ctx, "readiness-check"); err != nil {
+		return errors.Wrap(err, "token store is unreachable")
+	}
+
+	return nil
+}
+
+// Verifier returns the verifier of the access tokens issued by the server, with the signing key and the previous key
+// until the tokens it signed expire.
+//
+// It doesn't look the tokens up in the token store, so revoked tokens pass it.
+func (m *Manager) Verifier() *resource.Verifier {
+	return &resource.Verifier{
+		Keys: &verificationKeys{
+			current:  resource.StaticKey(m.accessGenerate.keyID, m.accessGenerate.verifyKey()),
+			previous: m.previousKey,
+		},
+		Issuer:     m.accessGenerate.issuer,
+		Algorithms: []string{m.accessGenerate.method.Alg()},
+	}
+}
+
+// JWKS returns the public keys verifying the access tokens, for the resource servers: the one of the signing key,
+// and the previous key until the tokens it signed expire.
+//
+// The set is empty for the HMAC algorithms, whose secret can't be published.
+func (m *Manager) JWKS() keys.JWKS {
+	set := keys.JWKS{Keys: []keys.JWK{}}
+
+	if signer, ok := m.accessGenerate.key.(crypto.Signer); ok {
+		jwk, err := keys.NewJWK(signer.Public(), m.accessGenerate.keyID, m.accessGenerate.method.Alg())
+		if err == nil {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
 
-	manager.MapTokenStorage(tokenRepo)
-	manager.MapClientStorage(clientRepo)
+	if p := m.previousKey; p.active() {
+		jwk, err := keys.NewJWK(p.key, p.keyID, m.accessGenerate.method.Alg())
+		if err == nil {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+
+	return set
+}
+
+// previousKey is the public key replaced by the last rotation, see config.JWT.PreviousSecret.
+//
+// It is kept for the access token lifetime of the config the server started with: the lifetimes of a reload only
+// apply to the tokens issued after it.
+type previousKey struct {
+	keyID string
+	key   crypto.PublicKey
+	until time.Time
+}
+
+// active reports whether the tokens signed with the key may not have expired yet.
+func (p *previousKey) active() bool {
+	return p != nil && time.Now().Before(p.until)
+}
+
+// verificationKeys is the resource.KeySource of the signing key and of the previous key while it's active.
+type verificationKeys struct {
+	current  resource.KeySource
+	previous *previousKey
+}
+
+func (k *verificationKeys) Key(ctx context.Context, keyID string) (interface{}, error) {
+	if p := k.previous; p.active() && keyID != "" && keyID == p.keyID {
+		return p.key, nil
+	}
 
-	return manager
+	return k.current.Key(ctx, keyID)
 }
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/go-oauth2/oauth2/v4/store"
+
+	"github.com/laonix/oauth2/internal/config"
+	"github.com/laonix/oauth2/internal/keys"
+)
+
+func TestManagerPreviousKey(t *testing.T) {
+	generate := func() string {
+		key, err := keys.GenerateSigningKey("RS256")
+		if err != nil {
+			t.Fatalf("could not generate key: %v\n", err)
+		}
+
+		return string(key)
+	}
+
+	previous, current := generate(), generate()
+
+	newManager := func(secret, previousSecret string) *Manager {
+		cfg := &config.Config{
+			JWT: config.JWT{
+				Algorithm:             "RS256",
+				Secret:                secret,
+				PreviousSecret:        previousSecret,
+				AccessTokenExpiresIn:  time.Hour,
+				RefreshTokenExpiresIn: time.Hour,
+			},
+		}
+
+		clients, err := NewClientRegistry([]config.Client{{ID: "client_id", Secret: "client_secret"}})
+		if err != nil {
+			t.Fatalf("could not register clients: %v\n", err)
+		}
+
+		tokenRepo, err := store.NewMemoryTokenStore()
+		if err != nil {
+			t.Fatalf("could not create token store: %v\n", err)
+		}
+
+		return NewManager(cfg, tokenRepo, clients)
+	}
+
+	// the token signed before the rotation
+	ti, err := newManager(previous, "").IssueAccessToken(context.Background(), &oauth2.TokenGenerateRequest{ClientID: "client_id"})
+	if err != nil {
+		t.Fatalf("could not issue token: %v\n", err)
+	}
+
+	tests := []struct {
+		name             string
+		previousSecret   string
+		expired          bool
+		expectVerified   bool
+		expectedJWKSKeys int
+	}{
+		{
+			name:             "Token of the previous key is verified until it expires",
+			previousSecret:   previous,
+			expectVerified:   true,
+			expectedJWKSKeys: 2,
+		},
+		{
+			name:             "Token of the previous key is rejected once its tokens expired",
+			previousSecret:   previous,
+			expired:          true,
+			expectVerified:   false,
+			expectedJWKSKeys: 1,
+		},
+		{
+			name:             "Token of the previous key is rejected without it",
+			previousSecret:   "",
+			expectVerified:   false,
+			expectedJWKSKeys: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newManager(current, tt.previousSecret)
+			if tt.expired {
+				m.previousKey.until = time.Now().Add(-time.Second)
+			}
+
+			if _, err := m.Verifier().Verify(context.Background(), ti.GetAccess()); (err == nil) != tt.expectVerified {
+				t.Errorf("got error %v but wanted verified %t\n", err, tt.expectVerified)
+			}
+
+			if jwks := m.JWKS(); len(jwks.Keys) != tt.expectedJWKSKeys {
+				t.Errorf("got %d keys in the JWKS but wanted %d\n", len(jwks.Keys), tt.expectedJWKSKeys)
+			}
+		})
+	}
+}
+
+// newTestManager returns a manager signing with a new RS256 key, with a memory token store and the clients.
+func newTestManager(t *testing.T, clients ...config.Client) *Manager {
+	key, err := keys.GenerateSigningKey("RS256")
+	if err != nil {
+		t.Fatalf("could not generate key: %v\n", err)
+	}
+
+	cfg := &config.Config{
+		JWT: config.JWT{
+			Algorithm:             "RS256",
+			Secret:                string(key),
+			AccessTokenExpiresIn:  time.Hour,
+			RefreshTokenExpiresIn: time.Hour,
+		},
+	}
+
+	registry, err := NewClientRegistry(clients)
+	if err != nil {
+		t.Fatalf("could not register clients: %v\n", err)
+	}
+
+	tokenRepo, err := store.NewMemoryTokenStore()
+	if err != nil {
+		t.Fatalf("could not create token store: %v\n", err)
+	}
+
+	return NewManager(cfg, tokenRepo, registry)
+}
+
+func TestManagerAudience(t *testing.T) {
+	m := newTestManager(t,
+		config.Client{ID: "svc", Secret: "svc_secret"},
+		config.Client{ID: "orders_client", Secret: "orders_secret", Audience: "orders"},
+	)
+
+	tests := []struct {
+		name             string
+		clientID         string
+		expectedAudience string
+	}{
+		{
+			name:             "Client without audience",
+			clientID:         "svc",
+			expectedAudience: "svc",
+		},
+		{
+			name:             "Client with audience",
+			clientID:         "orders_client",
+			expectedAudience: "orders",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ti, err := m.IssueAccessToken(context.Background(), &oauth2.TokenGenerateRequest{ClientID: tt.clientID})
+			if err != nil {
+				t.Fatalf("could not issue token: %v\n", err)
+			}
+
+			verifier := m.Verifier()
+			verifier.Audience = tt.expectedAudience
+
+			if _, err := verifier.Verify(context.Background(), ti.GetAccess()); err != nil {
+				t.Errorf("got error %v but wanted the audience %q\n", err, tt.expectedAudience)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4"
+	oerrors "github.com/go-oauth2/oauth2/v4/errors"
+	"github.com/pkg/errors"
+
+	"github.com/laonix/oauth2/internal/config"
+	"github.com/laonix/oauth2/internal/logger"
+)
+
+// pruneInterval is how often the families past their max lifetime are revoked, and the expired ones forgotten.
+const pruneInterval = time.Minute
+
+// RefreshGrant serves the refresh token grant (RFC 6749 section 6) with refresh token rotation.
+//
+// Every refresh issues a new refresh token of the same token family and invalidates the presented one.
+// Presenting an already used refresh token again revokes the whole family, as it means the refresh token has leaked.
+// A family can't be refreshed past its max lifetime, counted from the issuance of its first refresh token.
+//
+// The families are kept in memory only: after a restart, the refresh tokens issued before it start new families,
+// so the reuse of a refresh token used before the restart isn't detected.
+type RefreshGrant struct {
+	manager     *Manager
+	maxLifetime time.Duration
+
+	mu        sync.Mutex
+	families  map[string]*tokenFamily
+	lastPrune time.Time
+}
+
+// tokenFamily is the chain of refresh tokens descending from a single token request.
+type tokenFamily struct {
+	clientID  string
+	createdAt time.Time
+	access    string
+	refresh   string
+	used      []string
+
+	// refreshExpiresAt is the expiry of the current refresh token, zero if it doesn't expire
+	refreshExpiresAt time.Time
+}
+
+// NewRefreshGrant creates a new instance of RefreshGrant.
+func NewRefreshGrant(cfg config.JWT, manager *Manager) *RefreshGrant {
+	return &RefreshGrant{
+		manager:     manager,
+		maxLifetime: cfg.RefreshTokenMaxLifetime,
+		families:    make(map[string]*tokenFamily),
+	}
+}
+
+// Reload replaces the max lifetime of the token families with the one of cfg.
+func (g *RefreshGrant) Reload(cfg config.JWT) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.maxLifetime = cfg.RefreshTokenMaxLifetime
+}
+
+// HandleTokenRequest authenticates the client, validates its refresh token and rotates it.
+func (g *RefreshGrant) HandleTokenRequest(r *http.Request) (oauth2.TokenInfo, error) {
+	ctx := r.Context()
+
+	cli, err := g.manager.AuthenticateClient(r)
+	if err != nil {
+		return nil, err
+	}
+
+	refresh := r.FormValue("refresh_token")
+	if refresh == "" {
+		return nil, errors.Wrap(oerrors.ErrInvalidRequest, "refresh token is missing")
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	g.prune(ctx, now)
+
+	family, ok := g.families[refresh]
+	if ok && family.refresh != refresh {
+		if err := g.revoke(ctx, family); err != nil {
+			return nil, err
+		}
+
+		log := logger.WithRequestId(r)
+		log.Warn().Str("client_id", family.clientID).Msg("refresh token reused, token family revoked")
+
+		return nil, errors.Wrap(oerrors.ErrInvalidGrant, "refresh token is already used")
+	}
+
+	ti, err := g.manager.LoadRefreshToken(ctx, refresh)
+	if err != nil {
+		return nil, errors.Wrap(oerrors.ErrInvalidGrant, err.Error())
+	}
+
+	if ti.GetClientID() != cli.GetID() {
+		return nil, errors.Wrap(oerrors.ErrInvalidGrant, "refresh token is issued to another client")
+	}
+
+	// a refresh token unknown to the grant is the first one of its family
+	if !ok {
+		family = &tokenFamily{
+			clientID:  ti.GetClientID(),
+			createdAt: ti.GetRefreshCreateAt(),
+			access:    ti.GetAccess(),
+			refresh:   refresh,
+		}
+		family.refreshExpiresAt = refreshExpiry(ti)
+		g.families[refresh] = family
+	}
+
+	if g.maxLifetime > 0 && now.After(family.createdAt.Add(g.maxLifetime)) {
+		if err := g.revoke(ctx, family); err != nil {
+			return nil, err
+		}
+
+		return nil, errors.Wrap(oerrors.ErrInvalidGrant, "token family exceeded its max lifetime")
+	}
+
+	scope := r.FormValue("scope")
+	if scope != "" {
+		granted := strings.Fields(ti.GetScope())
+		for _, s := range strings.Fields(scope) {
+			if !slices.Contains(granted, s) {
+				return nil, errors.Wrapf(oerrors.ErrInvalidScope, "scope %q is not granted to the refresh token", s)
+			}
+		}
+	}
+
+	ti, err = g.manager.RefreshAccessToken(ctx, &oauth2.TokenGenerateRequest{
+		ClientID: cli.GetID(),
+		Refresh:  refresh,
+		Scope:    scope,
+		Request:  r,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	family.used = append(family.used, refresh)
+	family.access = ti.GetAccess()
+	family.refresh = ti.GetRefresh()
+	family.refreshExpiresAt = refreshExpiry(ti)
+
+	// the client can't refresh anymore if refresh tokens were disabled for it
+	if family.refresh != "" {
+		g.families[family.refresh] = family
+	}
+
+	return ti, nil
+}
+
+// refreshExpiry returns the expiry of the refresh token of ti, zero if it doesn't expire.
+func refreshExpiry(ti oauth2.TokenInfo) time.Time {
+	if ti.GetRefresh() == "" || ti.GetRefreshExpiresIn() <= 0 {
+		return time.Time{}
+	}
+
+	return ti.GetRefreshCreateAt().Add(ti.GetRefreshExpiresIn())
+}
+
+// Run revokes the families past their max lifetime every minute until ctx is done.
+//
+// Otherwise they are only revoked while serving refresh requests.
+func (g *RefreshGrant) Run(ctx context.Context) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			g.mu.Lock()
+			g.prune(ctx, now)
+			g.mu.Unlock()
+		}
+	}
+}
+
+// revoke removes the current tokens of the family and forgets the family.
+func (g *RefreshGrant) revoke(ctx context.Context, family *tokenFamily) error {
+	if err := g.manager.RemoveAccessToken(ctx, family.access); err != nil {
+		return errors.Wrap(err, "failed to revoke access token of token family")
+	}
+
+	if family.refresh != "" {
+		if err := g.manager.RemoveRefreshToken(ctx, family.refresh); err != nil {
+			return errors.Wrap(err, "failed to revoke refresh token of token family")
+		}
+	}
+
+	g.forget(family)
+
+	return nil
+}
+
+// prune revokes the families past their max lifetime, and forgets the families whose current refresh token expired.
+//
+// The families past their max lifetime are revoked, otherwise their last refresh token would start a new family
+// once the family is forgotten. An expired refresh token can't be refreshed anymore, so its family is just forgotten.
+func (g *RefreshGrant) prune(ctx context.Context, now time.Time) {
+	if now.Sub(g.lastPrune) < pruneInterval {
+		return
+	}
+	g.lastPrune = now
+
+	for _, family := range g.families {
+		if !family.refreshExpiresAt.IsZero() && now.After(family.refreshExpiresAt) {
+			g.forget(family)
+
+			continue
+		}
+
+		if g.maxLifetime > 0 && now.After(family.createdAt.Add(g.maxLifetime)) {
+			if err := g.revoke(ctx, family); err != nil {
+				log := logger.FromContext(ctx)
+				log.Error().Err(err).Str("client_id", family.clientID).Msg("failed to revoke expired token family")
+			}
+		}
+	}
+}
+
+func (g *RefreshGrant) forget(family *tokenFamily) {
+	for _, refresh := range family.used {
+		delete(g.families, refresh)
+	}
+	delete(g.families, family.refresh)
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRefreshGrantPrune(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name             string
+		refreshExpiresAt time.Time
+		expectForgotten  bool
+	}{
+		{
+			name:             "Family with a valid refresh token is kept",
+			refreshExpiresAt: now.Add(time.Hour),
+			expectForgotten:  false,
+		},
+		{
+			name:             "Family with an expired refresh token is forgotten",
+			refreshExpiresAt: now.Add(-time.Second),
+			expectForgotten:  true,
+		},
+		{
+			name:             "Family with a refresh token without expiry is kept",
+			refreshExpiresAt: time.Time{},
+			expectForgotten:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// no max lifetime, so that the family is only pruned by the expiry of its refresh token
+			g := &RefreshGrant{families: make(map[string]*tokenFamily)}
+
+			family := &tokenFamily{
+				clientID:         "client_id",
+				createdAt:        now.Add(-time.Hour),
+				refresh:          "refresh-2",
+				used:             []string{"refresh-1"},
+				refreshExpiresAt: tt.refreshExpiresAt,
+			}
+			g.families["refresh-1"] = family
+			g.families["refresh-2"] = family
+
+			g.prune(context.Background(), now)
+
+			if forgotten := len(g.families) == 0; forgotten != tt.expectForgotten {
+				t.Errorf("got %d families left but wanted forgotten %t\n", len(g.families), tt.expectForgotten)
+			}
+		})
+	}
+}
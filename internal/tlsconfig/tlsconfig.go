@@ -0,0 +1,177 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/laonix/oauth2/internal/config"
+	"github.com/laonix/oauth2/internal/logger"
+)
+
+const defaultReloadInterval = 10 * time.Second
+
+var minVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// New returns the TLS config of the server, serving the certificate of the reloader.
+//
+// Without cipher suites in cfg, the Go default suites are used. They only apply to TLS 1.2, the TLS 1.3 suites aren't configurable.
+func New(cfg config.TLS, reloader *CertReloader) (*tls.Config, error) {
+	minVersion, ok := minVersions[cfg.MinVersion]
+	if !ok {
+		return nil, errors.Errorf("unsupported min TLS version %q", cfg.MinVersion)
+	}
+
+	tlsCfg := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if len(cfg.CipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+
+		for _, name := range cfg.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, errors.Errorf("unsupported or insecure cipher suite %q", name)
+			}
+
+			tlsCfg.CipherSuites = append(tlsCfg.CipherSuites, id)
+		}
+	}
+
+	if cfg.HTTP2 {
+		tlsCfg.NextProtos = []string{"h2", "http/1.1"}
+	} else {
+		tlsCfg.NextProtos = []string{"http/1.1"}
+	}
+
+	return tlsCfg, nil
+}
+
+// CertReloader serves a certificate and key pair, reloading it when its files change.
+//
+// Established connections keep their certificate, new handshakes get the reloaded one.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewCertReloader loads the certificate and key pair of the files, checking them for changes every interval.
+func NewCertReloader(certFile, keyFile string, interval time.Duration) (*CertReloader, error) {
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: interval,
+	}
+
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, see tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// Run reloads the certificate whenever its files change, until ctx is done.
+//
+// A certificate that fails to load is logged and the current one is kept.
+func (r *CertReloader) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := r.reload()
+			if err != nil {
+				log := logger.FromContext(ctx)
+				log.Error().Err(err).Msg("failed to reload TLS certificate, keeping the current one")
+
+				continue
+			}
+
+			if reloaded {
+				log := logger.FromContext(ctx)
+				log.Info().Str("cert_file", r.certFile).Msg("TLS certificate reloaded")
+			}
+		}
+	}
+}
+
+// reload loads the certificate if its files changed since the last load.
+func (r *CertReloader) reload() (bool, error) {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	unchanged := r.cert != nil && modTime.Equal(r.modTime)
+	r.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to load TLS certificate")
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+
+	return true, nil
+}
+
+// latestModTime returns the latest modification time of the certificate and key files.
+//
+// Files are stat'ed through their symlinks, as Kubernetes swaps the mounted secrets by symlink.
+func (r *CertReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, "failed to stat TLS certificate")
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
@@ -0,0 +1,223 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/laonix/oauth2/internal/config"
+)
+
+// writeCert writes a self-signed certificate of the common name and its key, both modified at modTime.
+func writeCert(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v\n", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v\n", err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("could not marshal key: %v\n", err)
+	}
+
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), modTime)
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), modTime)
+}
+
+func writeFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("could not write %s: %v\n", path, err)
+	}
+
+	// the modification times of the files written within a tick of the filesystem clock may be equal
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("could not touch %s: %v\n", path, err)
+	}
+}
+
+// commonName returns the common name of the certificate served by the reloader.
+func commonName(t *testing.T, r *CertReloader) string {
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("could not get certificate: %v\n", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("could not parse certificate: %v\n", err)
+	}
+
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	tests := []struct {
+		name               string
+		rewrite            func(t *testing.T, certFile, keyFile string, modTime time.Time)
+		expectedCommonName string
+	}{
+		{
+			name: "Rewritten certificate is served",
+			rewrite: func(t *testing.T, certFile, keyFile string, modTime time.Time) {
+				writeCert(t, certFile, keyFile, "renewed", modTime)
+			},
+			expectedCommonName: "renewed",
+		},
+		{
+			name: "Invalid certificate keeps the current one",
+			rewrite: func(t *testing.T, certFile, keyFile string, modTime time.Time) {
+				writeFile(t, certFile, []byte("not a certificate"), modTime)
+			},
+			expectedCommonName: "initial",
+		},
+		{
+			name: "Mismatched key keeps the current one",
+			rewrite: func(t *testing.T, certFile, keyFile string, modTime time.Time) {
+				otherDir := t.TempDir()
+				writeCert(t, filepath.Join(otherDir, "tls.crt"), filepath.Join(otherDir, "tls.key"), "other", modTime)
+
+				data, err := os.ReadFile(filepath.Join(otherDir, "tls.key"))
+				if err != nil {
+					t.Fatalf("could not read key: %v\n", err)
+				}
+				writeFile(t, keyFile, data, modTime)
+			},
+			expectedCommonName: "initial",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+			start := time.Now().Add(-time.Minute)
+			writeCert(t, certFile, keyFile, "initial", start)
+
+			r, err := NewCertReloader(certFile, keyFile, 10*time.Millisecond)
+			if err != nil {
+				t.Fatalf("could not load certificate: %v\n", err)
+			}
+
+			if cn := commonName(t, r); cn != "initial" {
+				t.Fatalf("got certificate %q but wanted %q\n", cn, "initial")
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go r.Run(ctx)
+
+			tt.rewrite(t, certFile, keyFile, start.Add(time.Second))
+
+			// a few reload intervals
+			deadline := time.Now().Add(time.Second)
+			for time.Now().Before(deadline) && commonName(t, r) != tt.expectedCommonName {
+				time.Sleep(10 * time.Millisecond)
+			}
+			time.Sleep(50 * time.Millisecond)
+
+			if cn := commonName(t, r); cn != tt.expectedCommonName {
+				t.Errorf("got certificate %q but wanted %q\n", cn, tt.expectedCommonName)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCert(t, certFile, keyFile, "initial", time.Now())
+
+	reloader, err := NewCertReloader(certFile, keyFile, 0)
+	if err != nil {
+		t.Fatalf("could not load certificate: %v\n", err)
+	}
+
+	tests := []struct {
+		name               string
+		cfg                config.TLS
+		expectedMinVersion uint16
+		expectedSuites     []uint16
+		expectedProtos     []string
+		expectError        bool
+	}{
+		{
+			name:               "Defaults",
+			cfg:                config.TLS{},
+			expectedMinVersion: tls.VersionTLS12,
+			expectedProtos:     []string{"http/1.1"},
+		},
+		{
+			name:               "TLS 1.3 with HTTP/2",
+			cfg:                config.TLS{MinVersion: "1.3", HTTP2: true},
+			expectedMinVersion: tls.VersionTLS13,
+			expectedProtos:     []string{"h2", "http/1.1"},
+		},
+		{
+			name:               "Cipher suites",
+			cfg:                config.TLS{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}},
+			expectedMinVersion: tls.VersionTLS12,
+			expectedSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			expectedProtos:     []string{"http/1.1"},
+		},
+		{
+			name:        "Unsupported min version",
+			cfg:         config.TLS{MinVersion: "1.0"},
+			expectError: true,
+		},
+		{
+			name:        "Insecure cipher suite",
+			cfg:         config.TLS{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+			expectError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsCfg, err := New(tt.cfg, reloader)
+			if tt.expectError != (err != nil) {
+				t.Fatalf("got error %v but wanted error %t\n", err, tt.expectError)
+			}
+			if tt.expectError {
+				return
+			}
+
+			if tlsCfg.MinVersion != tt.expectedMinVersion {
+				t.Errorf("got min version %x but wanted %x\n", tlsCfg.MinVersion, tt.expectedMinVersion)
+			}
+
+			if !slices.Equal(tlsCfg.CipherSuites, tt.expectedSuites) {
+				t.Errorf("got cipher suites %v but wanted %v\n", tlsCfg.CipherSuites, tt.expectedSuites)
+			}
+
+			if !slices.Equal(tlsCfg.NextProtos, tt.expectedProtos) {
+				t.Errorf("got protocols %v but wanted %v\n", tlsCfg.NextProtos, tt.expectedProtos)
+			}
+
+			if cert, err := tlsCfg.GetCertificate(&tls.ClientHelloInfo{}); err != nil || cert == nil {
+				t.Errorf("got certificate %v and error %v but wanted the certificate of the reloader\n", cert, err)
+			}
+		})
+	}
+}
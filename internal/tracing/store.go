@@ -0,0 +1,62 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/go-oauth2/oauth2/v4"
+)
+
+// tokenStore is an oauth2.TokenStore tracing the writes to the underlying store.
+type tokenStore struct {
+	oauth2.TokenStore
+}
+
+// InstrumentTokenStore returns a token store tracing the writes to store.
+func InstrumentTokenStore(store oauth2.TokenStore) oauth2.TokenStore {
+	return &tokenStore{TokenStore: store}
+}
+
+func (s *tokenStore) Create(ctx context.Context, info oauth2.TokenInfo) (err error) {
+	ctx, span := Tracer().Start(ctx, "TokenStore.Create")
+	defer func() { End(span, err) }()
+
+	return s.TokenStore.Create(ctx, info)
+}
+
+func (s *tokenStore) RemoveByCode(ctx context.Context, code string) (err error) {
+	ctx, span := Tracer().Start(ctx, "TokenStore.RemoveByCode")
+	defer func() { End(span, err) }()
+
+	return s.TokenStore.RemoveByCode(ctx, code)
+}
+
+func (s *tokenStore) RemoveByAccess(ctx context.Context, access string) (err error) {
+	ctx, span := Tracer().Start(ctx, "TokenStore.RemoveByAccess")
+	defer func() { End(span, err) }()
+
+	return s.TokenStore.RemoveByAccess(ctx, access)
+}
+
+func (s *tokenStore) RemoveByRefresh(ctx context.Context, refresh string) (err error) {
+	ctx, span := Tracer().Start(ctx, "TokenStore.RemoveByRefresh")
+	defer func() { End(span, err) }()
+
+	return s.TokenStore.RemoveByRefresh(ctx, refresh)
+}
+
+// clientStore is an oauth2.ClientStore tracing the client lookups.
+type clientStore struct {
+	oauth2.ClientStore
+}
+
+// InstrumentClientStore returns a client store tracing the client lookups in store.
+func InstrumentClientStore(store oauth2.ClientStore) oauth2.ClientStore {
+	return &clientStore{ClientStore: store}
+}
+
+func (s *clientStore) GetByID(ctx context.Context, id string) (cli oauth2.ClientInfo, err error) {
+	ctx, span := Tracer().Start(ctx, "ClientStore.GetByID")
+	defer func() { End(span, err) }()
+
+	return s.ClientStore.GetByID(ctx, id)
+}
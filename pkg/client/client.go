@@ -0,0 +1,269 @@
+// Package client gets access tokens from the server with the client credentials grant and attaches them to requests.
+//
+// A TokenSource caches the token and refreshes it shortly before it expires, sharing a single token request
+// between concurrent callers and retrying it with backoff. A Transport attaches the token to every request:
+//
+//	cfg := &client.Config{
+//		TokenURL:     "https://oauth2.example.internal/token",
+//		ClientID:     "orders",
+//		ClientSecret: os.Getenv("ORDERS_CLIENT_SECRET"),
+//		Scopes:       []string{"inventory.read"},
+//	}
+//	httpClient := cfg.Client(ctx)
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
+)
+
+// Defaults of the Config fields left zero.
+const (
+	DefaultRefreshBefore = time.Minute
+	DefaultMaxRetries    = 3
+	DefaultMinBackoff    = 100 * time.Millisecond
+	DefaultMaxBackoff    = 5 * time.Second
+)
+
+// maxErrorBodySize is the size of the error responses read to report them.
+const maxErrorBodySize = 1 << 16
+
+// Config is the client credentials of a client and the token endpoint of the server.
+type Config struct {
+	// TokenURL is the token endpoint, e.g. https://oauth2.example.internal/token.
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+
+	// HTTPClient sends the token requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+
+	// RefreshBefore is how long before its expiry a token is refreshed, at most half its lifetime. Tokens
+	// expiring sooner are refreshed in the background while still being used, and only block the callers once expired.
+	RefreshBefore time.Duration
+
+	// MaxRetries is the number of retries of a token request failing with a network error, a 429 or a 5xx status.
+	// The delay between the retries doubles from MinBackoff up to MaxBackoff, with jitter. -1 disables the retries.
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// TokenSource returns a TokenSource caching the tokens of the config, requested with ctx.
+func (c *Config) TokenSource(ctx context.Context) *TokenSource {
+	cfg := *c
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	if cfg.RefreshBefore == 0 {
+		cfg.RefreshBefore = DefaultRefreshBefore
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = DefaultMaxRetries
+	}
+	if cfg.MinBackoff == 0 {
+		cfg.MinBackoff = DefaultMinBackoff
+	}
+	if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = DefaultMaxBackoff
+	}
+
+	return &TokenSource{ctx: ctx, cfg: cfg}
+}
+
+// Client returns an http.Client attaching the tokens of the config to its requests, see Transport.
+func (c *Config) Client(ctx context.Context) *http.Client {
+	return &http.Client{Transport: &Transport{Source: c.TokenSource(ctx)}}
+}
+
+// TokenSource is an oauth2.TokenSource requesting tokens with the client credentials grant and caching them.
+//
+// It is safe for concurrent use.
+type TokenSource struct {
+	ctx   context.Context
+	cfg   Config
+	group singleflight.Group
+
+	mu        sync.Mutex
+	token     *oauth2.Token
+	refreshAt time.Time
+}
+
+// Token returns the cached token, requesting a new one if there is none or it expired.
+//
+// A token close to its expiry is returned as is, while a new one is requested in the background.
+func (s *TokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	token, refreshAt := s.token, s.refreshAt
+	s.mu.Unlock()
+
+	// a token without expiry is used until invalidated
+	if now := time.Now(); token != nil && (token.Expiry.IsZero() || now.Before(token.Expiry)) {
+		if !token.Expiry.IsZero() && !now.Before(refreshAt) {
+			s.group.DoChan("token", s.fetch)
+		}
+
+		return token, nil
+	}
+
+	v, err, _ := s.group.Do("token", s.fetch)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*oauth2.Token), nil
+}
+
+// Invalidate drops the cached token if it is token, e.g. once rejected by a resource server,
+// so that the next call to Token requests a new one.
+func (s *TokenSource) Invalidate(token *oauth2.Token) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != nil && token != nil && s.token.AccessToken == token.AccessToken {
+		s.token = nil
+	}
+}
+
+// fetch requests a new token, retrying with backoff, and caches it.
+func (s *TokenSource) fetch() (interface{}, error) {
+	backoff := s.cfg.MinBackoff
+
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+
+		token, err := s.request()
+		if err == nil {
+			// short-lived tokens are refreshed halfway through their lifetime at the latest
+			refreshBefore := s.cfg.RefreshBefore
+			if lifetime := token.Expiry.Sub(start); refreshBefore > lifetime/2 {
+				refreshBefore = lifetime / 2
+			}
+
+			s.mu.Lock()
+			s.token, s.refreshAt = token, token.Expiry.Add(-refreshBefore)
+			s.mu.Unlock()
+
+			return token, nil
+		}
+
+		var retrieveErr *RetrieveError
+		if (errors.As(err, &retrieveErr) && !retrieveErr.Temporary()) || attempt >= s.cfg.MaxRetries {
+			return nil, err
+		}
+
+		// full jitter, so that the clients of a restarted server don't retry in lockstep
+		delay := time.Duration(rand.Int63n(int64(backoff))) + 1
+		if backoff *= 2; backoff > s.cfg.MaxBackoff {
+			backoff = s.cfg.MaxBackoff
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return nil, errors.Wrap(err, "token request canceled")
+		case <-time.After(delay):
+		}
+	}
+}
+
+// tokenResponse is the successful response of the token endpoint (RFC 6749 section 5.1).
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// request sends a single token request.
+func (s *TokenSource) request() (*oauth2.Token, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(s.cfg.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.cfg.Scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.cfg.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, errors.Wrap(errors.WithStack(err), "failed to create token request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(s.cfg.ClientID, s.cfg.ClientSecret)
+
+	start := time.Now()
+
+	res, err := s.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(errors.WithStack(err), "token request failed")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorBodySize))
+
+		retrieveErr := &RetrieveError{StatusCode: res.StatusCode, Body: body}
+		_ = json.Unmarshal(body, retrieveErr)
+
+		return nil, errors.WithStack(retrieveErr)
+	}
+
+	var tr tokenResponse
+	if err := json.NewDecoder(res.Body).Decode(&tr); err != nil {
+		return nil, errors.Wrap(errors.WithStack(err), "failed to decode token response")
+	}
+
+	if tr.AccessToken == "" {
+		return nil, errors.New("token response has no access token")
+	}
+
+	token := &oauth2.Token{
+		AccessToken:  tr.AccessToken,
+		TokenType:    tr.TokenType,
+		RefreshToken: tr.RefreshToken,
+	}
+
+	// the lifetime counts from the request, so that the token is never used past its actual expiry
+	if tr.ExpiresIn > 0 {
+		token.Expiry = start.Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+
+	return token.WithExtra(map[string]interface{}{"scope": tr.Scope}), nil
+}
+
+// RetrieveError is an error response of the token endpoint (RFC 6749 section 5.2).
+type RetrieveError struct {
+	StatusCode       int    `json:"-"`
+	Body             []byte `json:"-"`
+	ErrorCode        string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (e *RetrieveError) Error() string {
+	if e.ErrorCode == "" {
+		return fmt.Sprintf("token request failed with status %d", e.StatusCode)
+	}
+
+	if e.ErrorDescription == "" {
+		return fmt.Sprintf("token request failed with status %d: %s", e.StatusCode, e.ErrorCode)
+	}
+
+	return fmt.Sprintf("token request failed with status %d: %s: %s", e.StatusCode, e.ErrorCode, e.ErrorDescription)
+}
+
+// Temporary tells whether the request may succeed once retried: the server is overloaded or failed.
+func (e *RetrieveError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError
+}
@@ -0,0 +1,426 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID     = "client_id"
+	testClientSecret = "client_secret"
+)
+
+// tokenEndpoint is a token endpoint issuing the tokens token-1, token-2... of the test client, valid for expiresIn seconds.
+type tokenEndpoint struct {
+	expiresIn int64
+
+	// failures is the number of first requests failing with 503 Service Unavailable.
+	failures int64
+
+	// release, if set, holds every request until it receives from it, or until it is closed.
+	release chan struct{}
+
+	requests atomic.Int64
+}
+
+func (e *tokenEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := e.requests.Add(1)
+
+	if e.release != nil {
+		<-e.release
+	}
+
+	if n <= e.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if id, secret, _ := r.BasicAuth(); id != testClientID || secret != testClientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"error":"invalid_client"}`))
+
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(&tokenResponse{
+		AccessToken: "token-" + strconv.FormatInt(n-e.failures, 10),
+		TokenType:   "Bearer",
+		ExpiresIn:   e.expiresIn,
+	})
+}
+
+func TestTokenSource(t *testing.T) {
+	tests := []struct {
+		name                  string
+		clientSecret          string
+		failedTokenRequests   int64
+		callers               int
+		expectedTokenRequests int64
+		expectError           bool
+	}{
+		{
+			name:                  "Concurrent callers share a single token request",
+			clientSecret:          testClientSecret,
+			callers:               10,
+			expectedTokenRequests: 1,
+		},
+		{
+			name:                  "Failed token requests are retried",
+			clientSecret:          testClientSecret,
+			failedTokenRequests:   2,
+			callers:               1,
+			expectedTokenRequests: 3,
+		},
+		{
+			name:                  "Token requests failing more than MaxRetries times fail",
+			clientSecret:          testClientSecret,
+			failedTokenRequests:   5,
+			callers:               1,
+			expectedTokenRequests: 4,
+			expectError:           true,
+		},
+		{
+			name:                  "Invalid client isn't retried",
+			clientSecret:          "wrong",
+			callers:               1,
+			expectedTokenRequests: 1,
+			expectError:           true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint := &tokenEndpoint{expiresIn: 3600, failures: tt.failedTokenRequests, release: make(chan struct{})}
+			srv := httptest.NewServer(endpoint)
+			defer srv.Close()
+
+			source := (&Config{
+				TokenURL:     srv.URL,
+				ClientID:     testClientID,
+				ClientSecret: tt.clientSecret,
+				MinBackoff:   time.Millisecond,
+			}).TokenSource(context.Background())
+
+			var wg sync.WaitGroup
+			tokens := make([]string, tt.callers)
+			errs := make([]error, tt.callers)
+			for i := 0; i < tt.callers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+
+					token, err := source.Token()
+					if err != nil {
+						errs[i] = err
+
+						return
+					}
+					tokens[i] = token.AccessToken
+				}(i)
+			}
+
+			// the callers wait for the first token request
+			for endpoint.requests.Load() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			close(endpoint.release)
+			wg.Wait()
+
+			for i := range errs {
+				if tt.expectError != (errs[i] != nil) {
+					t.Errorf("got error %v but wanted error %t\n", errs[i], tt.expectError)
+				}
+
+				if !tt.expectError && tokens[i] != "token-1" {
+					t.Errorf("got token %q but wanted token-1\n", tokens[i])
+				}
+			}
+
+			if got := endpoint.requests.Load(); got != tt.expectedTokenRequests {
+				t.Errorf("got %d token requests but wanted %d\n", got, tt.expectedTokenRequests)
+			}
+		})
+	}
+}
+
+func TestTokenSourceRefresh(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresIn int64
+		// prepare moves the cached token through its lifetime
+		prepare               func(s *TokenSource)
+		expectedToken         string
+		expectedTokenRequests int64
+	}{
+		{
+			name:                  "Token before its refresh time is cached",
+			expiresIn:             3600,
+			prepare:               func(s *TokenSource) {},
+			expectedToken:         "token-1",
+			expectedTokenRequests: 1,
+		},
+		{
+			name:      "Token within RefreshBefore of its expiry is returned while refreshed in the background",
+			expiresIn: 3600,
+			prepare: func(s *TokenSource) {
+				s.refreshAt = time.Now().Add(-time.Second)
+			},
+			expectedToken:         "token-1",
+			expectedTokenRequests: 2,
+		},
+		{
+			name:      "Expired token is refreshed before being returned",
+			expiresIn: 3600,
+			prepare: func(s *TokenSource) {
+				s.token.Expiry = time.Now().Add(-time.Second)
+			},
+			expectedToken:         "token-2",
+			expectedTokenRequests: 2,
+		},
+		{
+			name:      "Token without expiry is never refreshed",
+			expiresIn: 0,
+			prepare: func(s *TokenSource) {
+				s.refreshAt = time.Now().Add(-time.Second)
+			},
+			expectedToken:         "token-1",
+			expectedTokenRequests: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint := &tokenEndpoint{expiresIn: tt.expiresIn}
+			srv := httptest.NewServer(endpoint)
+			defer srv.Close()
+
+			source := (&Config{
+				TokenURL:     srv.URL,
+				ClientID:     testClientID,
+				ClientSecret: testClientSecret,
+			}).TokenSource(context.Background())
+
+			if _, err := source.Token(); err != nil {
+				t.Fatalf("could not get token: %v\n", err)
+			}
+
+			source.mu.Lock()
+			tt.prepare(source)
+			source.mu.Unlock()
+
+			token, err := source.Token()
+			if err != nil {
+				t.Fatalf("could not get token: %v\n", err)
+			}
+
+			if token.AccessToken != tt.expectedToken {
+				t.Errorf("got token %q but wanted %q\n", token.AccessToken, tt.expectedToken)
+			}
+
+			// the background refresh replaces the cached token once done
+			deadline := time.Now().Add(time.Second)
+			for time.Now().Before(deadline) && endpoint.requests.Load() < tt.expectedTokenRequests {
+				time.Sleep(time.Millisecond)
+			}
+
+			if got := endpoint.requests.Load(); got != tt.expectedTokenRequests {
+				t.Errorf("got %d token requests but wanted %d\n", got, tt.expectedTokenRequests)
+			}
+
+			expectedCached := "token-" + strconv.FormatInt(tt.expectedTokenRequests, 10)
+			for time.Now().Before(deadline) {
+				if token, _ := source.Token(); token.AccessToken == expectedCached {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			if token, _ := source.Token(); token.AccessToken != expectedCached {
+				t.Errorf("got cached token %q but wanted %q\n", token.AccessToken, expectedCached)
+			}
+		})
+	}
+}
+
+func TestTokenSourceRefreshBefore(t *testing.T) {
+	tests := []struct {
+		name                  string
+		expiresIn             int64
+		refreshBefore         time.Duration
+		expectedRefreshBefore time.Duration
+	}{
+		{
+			name:                  "Token refreshed RefreshBefore its expiry",
+			expiresIn:             3600,
+			refreshBefore:         time.Minute,
+			expectedRefreshBefore: time.Minute,
+		},
+		{
+			name:                  "Short-lived token refreshed halfway through its lifetime",
+			expiresIn:             60,
+			refreshBefore:         time.Minute,
+			expectedRefreshBefore: 30 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(&tokenEndpoint{expiresIn: tt.expiresIn})
+			defer srv.Close()
+
+			source := (&Config{
+				TokenURL:      srv.URL,
+				ClientID:      testClientID,
+				ClientSecret:  testClientSecret,
+				RefreshBefore: tt.refreshBefore,
+			}).TokenSource(context.Background())
+
+			token, err := source.Token()
+			if err != nil {
+				t.Fatalf("could not get token: %v\n", err)
+			}
+
+			source.mu.Lock()
+			refreshBefore := token.Expiry.Sub(source.refreshAt)
+			source.mu.Unlock()
+
+			// the lifetime counts from the start of the request, a little before the response
+			if diff := refreshBefore - tt.expectedRefreshBefore; diff < -time.Second || diff > time.Second {
+				t.Errorf("got token refreshed %s before its expiry but wanted %s\n", refreshBefore, tt.expectedRefreshBefore)
+			}
+		})
+	}
+}
+
+func TestTokenSourceRefreshIsShared(t *testing.T) {
+	// the first token request goes through, the background refresh is held until every caller got the cached token
+	endpoint := &tokenEndpoint{expiresIn: 3600, release: make(chan struct{}, 1)}
+	endpoint.release <- struct{}{}
+
+	srv := httptest.NewServer(endpoint)
+	defer srv.Close()
+
+	source := (&Config{
+		TokenURL:     srv.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+	}).TokenSource(context.Background())
+
+	if _, err := source.Token(); err != nil {
+		t.Fatalf("could not get token: %v\n", err)
+	}
+
+	source.mu.Lock()
+	source.refreshAt = time.Now().Add(-time.Second)
+	source.mu.Unlock()
+
+	for i := 0; i < 10; i++ {
+		if token, err := source.Token(); err != nil || token.AccessToken != "token-1" {
+			t.Fatalf("got token %v and error %v but wanted the cached token-1\n", token, err)
+		}
+	}
+
+	close(endpoint.release)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if token, _ := source.Token(); token.AccessToken == "token-2" {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if got := endpoint.requests.Load(); got != 2 {
+		t.Errorf("got %d token requests but wanted a single background refresh\n", got)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	tests := []struct {
+		name                  string
+		rejectedRequests      int64
+		expectedStatusCode    int
+		expectedTokenRequests int64
+	}{
+		{
+			name:                  "Token is attached to the request",
+			expectedStatusCode:    http.StatusOK,
+			expectedTokenRequests: 1,
+		},
+		{
+			name:                  "Rejected token is replaced once",
+			rejectedRequests:      1,
+			expectedStatusCode:    http.StatusOK,
+			expectedTokenRequests: 2,
+		},
+		{
+			name:                  "Token rejected twice isn't replaced again",
+			rejectedRequests:      2,
+			expectedStatusCode:    http.StatusUnauthorized,
+			expectedTokenRequests: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint := &tokenEndpoint{expiresIn: 3600}
+
+			var resourceRequests atomic.Int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/token" {
+					endpoint.ServeHTTP(w, r)
+
+					return
+				}
+
+				if resourceRequests.Add(1) <= tt.rejectedRequests {
+					w.WriteHeader(http.StatusUnauthorized)
+
+					return
+				}
+
+				// the retried request has the same body
+				var body struct{ Order string }
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Order != "1" {
+					w.WriteHeader(http.StatusBadRequest)
+
+					return
+				}
+
+				if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer token-") {
+					w.WriteHeader(http.StatusUnauthorized)
+
+					return
+				}
+			}))
+			defer srv.Close()
+
+			httpClient := (&Config{
+				TokenURL:     srv.URL + "/token",
+				ClientID:     testClientID,
+				ClientSecret: testClientSecret,
+			}).Client(context.Background())
+
+			res, err := httpClient.Post(srv.URL+"/orders", "application/json", strings.NewReader(`{"order":"1"}`))
+			if err != nil {
+				t.Fatalf("could not send request: %v\n", err)
+			}
+			_ = res.Body.Close()
+
+			if res.StatusCode != tt.expectedStatusCode {
+				t.Errorf("got status %d but wanted %d\n", res.StatusCode, tt.expectedStatusCode)
+			}
+
+			if got := endpoint.requests.Load(); got != tt.expectedTokenRequests {
+				t.Errorf("got %d token requests but wanted %d\n", got, tt.expectedTokenRequests)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"net/http"
+
+	"golang.org/x/oauth2"
+)
+
+// Transport is an http.RoundTripper attaching the token of Source as a bearer token to the requests.
+//
+// A request rejected with 401 Unauthorized is retried once with a new token, when the token was revoked or
+// the signing key rotated. The new token is requested if Source is a *TokenSource, which drops the rejected one.
+// Requests with a body are only retried if the body can be replayed, see http.Request.GetBody.
+type Transport struct {
+	Source oauth2.TokenSource
+
+	// Base sends the requests, http.DefaultTransport if nil.
+	Base http.RoundTripper
+}
+
+// RoundTrip sends the request with the token, see http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.Source.Token()
+	if err != nil {
+		closeBody(req)
+
+		return nil, err
+	}
+
+	res, err := t.base().RoundTrip(withToken(req, token))
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+
+	source, ok := t.Source.(*TokenSource)
+	if !ok || (req.Body != nil && req.GetBody == nil) {
+		return res, nil
+	}
+
+	source.Invalidate(token)
+
+	retry, err := source.Token()
+	if err != nil {
+		return res, nil
+	}
+
+	retryReq := withToken(req, retry)
+	if req.Body != nil {
+		if retryReq.Body, err = req.GetBody(); err != nil {
+			return res, nil
+		}
+	}
+
+	_ = res.Body.Close()
+
+	return t.base().RoundTrip(retryReq)
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+
+	return http.DefaultTransport
+}
+
+// withToken returns a copy of the request with the token in its Authorization header.
+//
+// The request itself isn't modified, as required by http.RoundTripper.
+func withToken(req *http.Request, token *oauth2.Token) *http.Request {
+	clone := req.Clone(req.Context())
+	token.SetAuthHeader(clone)
+
+	return clone
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+}
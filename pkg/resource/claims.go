@@ -0,0 +1,69 @@
+package resource
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+)
+
+// Claims are the claims of the access tokens issued by the server.
+//
+// The time claims are in seconds since the Unix epoch.
+type Claims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+	Actor     *Actor   `json:"act,omitempty"`
+}
+
+// Valid implements jwt.Claims. The claims are checked by Verifier, with its leeway.
+func (c *Claims) Valid() error {
+	return nil
+}
+
+// Scopes returns the scopes of the scope claim.
+func (c *Claims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// HasScope tells whether the scope is granted to the token.
+func (c *Claims) HasScope(scope string) bool {
+	return slices.Contains(c.Scopes(), scope)
+}
+
+// Actor is the act claim of a delegated token (RFC 8693 section 4.1).
+//
+// A nested Actor is the party that acted before the current one, the outermost Actor is the current one.
+type Actor struct {
+	Subject string `json:"sub"`
+	Actor   *Actor `json:"act,omitempty"`
+}
+
+// Audience is the aud claim, a single string or an array of strings (RFC 7519 section 4.1.3).
+type Audience []string
+
+// MarshalJSON encodes a single audience as a string.
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+
+	return json.Marshal([]string(a))
+}
+
+// UnmarshalJSON decodes a string or an array of strings.
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+
+		return nil
+	}
+
+	return json.Unmarshal(data, (*[]string)(a))
+}
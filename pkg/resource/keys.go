@@ -0,0 +1,225 @@
+package resource
+
+import (
+	"context"
+	"crypto"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/laonix/oauth2/internal/keys"
+)
+
+// Defaults of the JWKSConfig fields left zero.
+const (
+	DefaultRefreshInterval    = 5 * time.Minute
+	DefaultMinRefetchInterval = 30 * time.Second
+)
+
+// maxJWKSSize is the size of the largest JWKS fetched.
+const maxJWKSSize = 1 << 20
+
+// ErrKeyNotFound is returned by a KeySource that has no key of the key ID.
+var ErrKeyNotFound = errors.New("key not found")
+
+// KeySource returns the keys verifying the signatures of the tokens.
+type KeySource interface {
+	// Key returns the key of the key ID, the kid header of a token, empty if the token has none.
+	Key(ctx context.Context, keyID string) (interface{}, error)
+}
+
+// StaticKey returns a KeySource of a single key: a public key, or the secret of the HMAC algorithms.
+//
+// With a keyID, the tokens naming another key are rejected.
+func StaticKey(keyID string, key interface{}) KeySource {
+	return &staticKey{keyID: keyID, key: key}
+}
+
+type staticKey struct {
+	keyID string
+	key   interface{}
+}
+
+func (s *staticKey) Key(ctx context.Context, keyID string) (interface{}, error) {
+	if keyID != "" && s.keyID != "" && keyID != s.keyID {
+		return nil, errors.Wrapf(ErrKeyNotFound, "kid %q", keyID)
+	}
+
+	return s.key, nil
+}
+
+// JWKSConfig configures a JWKS.
+type JWKSConfig struct {
+	// URL is the JWKS of the server, e.g. https://oauth2.example.internal/.well-known/jwks.json. File is read instead if set.
+	URL  string
+	File string
+
+	// HTTPClient fetches URL, http.DefaultClient if nil.
+	HTTPClient *http.Client
+
+	// RefreshInterval is how often the keys are fetched again, to pick up the rotated keys.
+	RefreshInterval time.Duration
+
+	// MinRefetchInterval is the min time between two fetches triggered by an unknown key ID,
+	// so that tokens with made-up key IDs can't flood the server.
+	MinRefetchInterval time.Duration
+
+	// OnRefreshError is called with the errors of the fetches, the keys fetched before being kept.
+	OnRefreshError func(err error)
+}
+
+// JWKS is a KeySource of the keys of a JSON Web Key Set, fetched from a URL or read from a file.
+//
+// The keys are refreshed every RefreshInterval, and as soon as a token names an unknown key.
+type JWKS struct {
+	cfg JWKSConfig
+
+	fetchMu   sync.Mutex
+	fetchedAt time.Time
+
+	mu   sync.RWMutex
+	keys map[string]crypto.PublicKey
+}
+
+// NewJWKS fetches the keys and refreshes them in the background until ctx is done.
+func NewJWKS(ctx context.Context, cfg JWKSConfig) (*JWKS, error) {
+	if cfg.URL == "" && cfg.File == "" {
+		return nil, errors.New("JWKS URL or file is required")
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	if cfg.RefreshInterval == 0 {
+		cfg.RefreshInterval = DefaultRefreshInterval
+	}
+	if cfg.MinRefetchInterval == 0 {
+		cfg.MinRefetchInterval = DefaultMinRefetchInterval
+	}
+
+	j := &JWKS{cfg: cfg}
+	if err := j.refresh(ctx, 0); err != nil {
+		return nil, err
+	}
+
+	go j.run(ctx)
+
+	return j, nil
+}
+
+// Key returns the key of the key ID, fetching the keys again if it is unknown.
+//
+// A token without key ID is verified with the only key of the set, if there is a single one.
+func (j *JWKS) Key(ctx context.Context, keyID string) (interface{}, error) {
+	if key, ok := j.lookup(keyID); ok {
+		return key, nil
+	}
+
+	if err := j.refresh(ctx, j.cfg.MinRefetchInterval); err != nil {
+		return nil, err
+	}
+
+	if key, ok := j.lookup(keyID); ok {
+		return key, nil
+	}
+
+	return nil, errors.Wrapf(ErrKeyNotFound, "kid %q", keyID)
+}
+
+func (j *JWKS) lookup(keyID string) (crypto.PublicKey, bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	if key, ok := j.keys[keyID]; ok {
+		return key, true
+	}
+
+	if keyID == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, true
+		}
+	}
+
+	return nil, false
+}
+
+func (j *JWKS) run(ctx context.Context) {
+	ticker := time.NewTicker(j.cfg.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := j.refresh(ctx, 0); err != nil && j.cfg.OnRefreshError != nil {
+				j.cfg.OnRefreshError(err)
+			}
+		}
+	}
+}
+
+// refresh fetches the keys, unless they were fetched, or failed to be, less than minInterval ago.
+//
+// Concurrent refreshes wait for the one in progress, and don't fetch again.
+func (j *JWKS) refresh(ctx context.Context, minInterval time.Duration) error {
+	requested := time.Now()
+
+	j.fetchMu.Lock()
+	defer j.fetchMu.Unlock()
+
+	if j.fetchedAt.After(requested) || time.Since(j.fetchedAt) < minInterval {
+		return nil
+	}
+
+	data, err := j.fetch(ctx)
+
+	// a failed attempt counts too, so that the tokens naming unknown keys don't refetch a failing JWKS on every request
+	j.fetchedAt = time.Now()
+
+	if err != nil {
+		return err
+	}
+
+	set, err := keys.ParseJWKS(data)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	j.keys = set
+	j.mu.Unlock()
+
+	return nil
+}
+
+func (j *JWKS) fetch(ctx context.Context) ([]byte, error) {
+	if j.cfg.File != "" {
+		data, err := os.ReadFile(j.cfg.File)
+
+		return data, errors.Wrap(errors.WithStack(err), "failed to read JWKS file")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.cfg.URL, nil)
+	if err != nil {
+		return nil, errors.Wrap(errors.WithStack(err), "failed to create JWKS request")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := j.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(errors.WithStack(err), "failed to fetch JWKS")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to fetch JWKS: status %d", res.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxJWKSSize))
+
+	return data, errors.Wrap(errors.WithStack(err), "failed to read JWKS")
+}
@@ -0,0 +1,194 @@
+package resource
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/laonix/oauth2/internal/keys"
+)
+
+// newTestKey returns a new RS256 signing key and its key ID.
+func newTestKey(t *testing.T) (crypto.Signer, string) {
+	pemKey, err := keys.GenerateSigningKey("RS256")
+	if err != nil {
+		t.Fatalf("could not generate key: %v\n", err)
+	}
+
+	signer, err := keys.ParsePrivateKeyPEM(pemKey)
+	if err != nil {
+		t.Fatalf("could not parse key: %v\n", err)
+	}
+
+	keyID, err := keys.KeyID(signer.Public())
+	if err != nil {
+		t.Fatalf("could not get key ID: %v\n", err)
+	}
+
+	return signer, keyID
+}
+
+// jwksServer serves the JWKS of the public keys of its signers, and counts the requests.
+type jwksServer struct {
+	mu      sync.Mutex
+	signers []crypto.Signer
+	failing bool
+
+	requests atomic.Int64
+}
+
+// set replaces the keys of the JWKS, or makes it fail with 503 Service Unavailable.
+func (s *jwksServer) set(failing bool, signers ...crypto.Signer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.signers, s.failing = signers, failing
+}
+
+func (s *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.requests.Add(1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failing {
+		w.WriteHeader(http.StatusServiceUnavailable)
+
+		return
+	}
+
+	set := keys.JWKS{Keys: []keys.JWK{}}
+	for _, signer := range s.signers {
+		keyID, _ := keys.KeyID(signer.Public())
+
+		jwk, err := keys.NewJWK(signer.Public(), keyID, "RS256")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&set)
+}
+
+func TestJWKS(t *testing.T) {
+	current, currentKeyID := newTestKey(t)
+	rotated, rotatedKeyID := newTestKey(t)
+
+	tests := []struct {
+		name string
+		// rotate changes the JWKS served after the initial fetch
+		rotate               func(s *jwksServer)
+		minRefetchInterval   time.Duration
+		keyIDs               []string
+		expectedErrs         []error
+		expectedJWKSRequests int64
+	}{
+		{
+			name:                 "Known key isn't fetched again",
+			rotate:               func(s *jwksServer) {},
+			keyIDs:               []string{currentKeyID, currentKeyID},
+			expectedErrs:         []error{nil, nil},
+			expectedJWKSRequests: 1,
+		},
+		{
+			name:                 "Token without key ID uses the only key",
+			rotate:               func(s *jwksServer) {},
+			keyIDs:               []string{""},
+			expectedErrs:         []error{nil},
+			expectedJWKSRequests: 1,
+		},
+		{
+			name: "Unknown key is fetched again, picking up a rotated key",
+			rotate: func(s *jwksServer) {
+				s.set(false, current, rotated)
+			},
+			keyIDs:               []string{rotatedKeyID, rotatedKeyID},
+			expectedErrs:         []error{nil, nil},
+			expectedJWKSRequests: 2,
+		},
+		{
+			name:                 "Unknown keys are fetched again at most every MinRefetchInterval",
+			rotate:               func(s *jwksServer) {},
+			minRefetchInterval:   time.Hour,
+			keyIDs:               []string{"unknown", "other", "another"},
+			expectedErrs:         []error{ErrKeyNotFound, ErrKeyNotFound, ErrKeyNotFound},
+			expectedJWKSRequests: 2,
+		},
+		{
+			name: "Failed fetches are throttled too",
+			rotate: func(s *jwksServer) {
+				s.set(true)
+			},
+			minRefetchInterval:   time.Hour,
+			keyIDs:               []string{"unknown", "other", currentKeyID},
+			expectedErrs:         []error{errFetch, ErrKeyNotFound, nil},
+			expectedJWKSRequests: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &jwksServer{}
+			server.set(false, current)
+
+			srv := httptest.NewServer(server)
+			defer srv.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// the initial fetch counts for MinRefetchInterval too
+			jwks, err := NewJWKS(ctx, JWKSConfig{URL: srv.URL, MinRefetchInterval: time.Nanosecond})
+			if err != nil {
+				t.Fatalf("could not fetch JWKS: %v\n", err)
+			}
+
+			tt.rotate(server)
+			if tt.minRefetchInterval > 0 {
+				jwks.cfg.MinRefetchInterval = tt.minRefetchInterval
+				jwks.fetchedAt = time.Time{}
+			}
+
+			for i, keyID := range tt.keyIDs {
+				_, err := jwks.Key(ctx, keyID)
+
+				switch expected := tt.expectedErrs[i]; {
+				case expected == errFetch:
+					if err == nil || errors.Is(err, ErrKeyNotFound) {
+						t.Errorf("got error %v for kid %q but wanted the fetch to fail\n", err, keyID)
+					}
+				case !errors.Is(err, expected):
+					t.Errorf("got error %v for kid %q but wanted %v\n", err, keyID, expected)
+				}
+			}
+
+			if got := server.requests.Load(); got != tt.expectedJWKSRequests {
+				t.Errorf("got %d JWKS requests but wanted %d\n", got, tt.expectedJWKSRequests)
+			}
+		})
+	}
+}
+
+// errFetch stands for the error of a failed fetch in the expectations of TestJWKS.
+var errFetch = errors.New("fetch failed")
+
+func TestStaticKey(t *testing.T) {
+	signer, keyID := newTestKey(t)
+	source := StaticKey(keyID, signer.Public())
+
+	for kid, expectedErr := range map[string]error{keyID: nil, "": nil, "other": ErrKeyNotFound} {
+		if _, err := source.Key(context.Background(), kid); !errors.Is(err, expectedErr) {
+			t.Errorf("got error %v for kid %q but wanted %v\n", err, kid, expectedErr)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// Package resource verifies the access tokens of the server in the resource servers, without calling the server.
+//
+// A Verifier checks the signature of a token with the public keys of a KeySource, usually the JWKS published by the
+// server at /.well-known/jwks.json, and its issuer, audience, algorithm and expiry. Its Middleware puts the claims
+// of the verified token in the request context:
+//
+//	jwks, err := resource.NewJWKS(ctx, resource.JWKSConfig{URL: "https://oauth2.example.internal/.well-known/jwks.json"})
+//	if err != nil {
+//		return err
+//	}
+//
+//	verifier := &resource.Verifier{Keys: jwks, Issuer: "https://oauth2.example.internal", Leeway: 30 * time.Second}
+//	http.Handle("/orders", verifier.Middleware(orders))
+//
+// The server verifies the tokens presented to /secure with the same Verifier, before checking that they aren't revoked.
+package resource
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/pkg/errors"
+)
+
+// Errors of Verify, wrapped with the reason of the failure.
+var (
+	ErrMissingToken = errors.New("access token is missing")
+	ErrInvalidToken = errors.New("access token is invalid")
+	ErrExpiredToken = errors.New("access token is expired")
+)
+
+// AsymmetricAlgorithms are the algorithms accepted by a Verifier without Algorithms.
+var AsymmetricAlgorithms = []string{
+	"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA",
+}
+
+// Verifier verifies access tokens.
+type Verifier struct {
+	// Keys are the keys verifying the signatures, looked up by the kid header of the tokens.
+	Keys KeySource
+
+	// Issuer is the required iss claim, if set.
+	Issuer string
+
+	// Audience is required among the aud claim, if set.
+	Audience string
+
+	// Algorithms are the accepted signing algorithms, AsymmetricAlgorithms by default.
+	// The key of a token must also be of the type of its algorithm.
+	Algorithms []string
+
+	// Leeway is the clock skew tolerated when checking the exp, nbf and iat claims.
+	Leeway time.Duration
+}
+
+// Verify verifies the signature and the claims of an access token and returns its claims.
+//
+// The returned error wraps ErrInvalidToken, or ErrExpiredToken once the token expired.
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	if token == "" {
+		return nil, ErrMissingToken
+	}
+
+	algorithms := v.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = AsymmetricAlgorithms
+	}
+
+	parser := &jwt.Parser{ValidMethods: algorithms, SkipClaimsValidation: true}
+
+	claims := &Claims{}
+	if _, err := parser.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		keyID, _ := t.Header["kid"].(string)
+
+		key, err := v.Keys.Key(ctx, keyID)
+		if err != nil {
+			return nil, err
+		}
+
+		if !keyMatches(t.Method.Alg(), key) {
+			return nil, errors.Errorf("key %q can't verify %s signatures", keyID, t.Method.Alg())
+		}
+
+		return key, nil
+	}); err != nil {
+		return nil, errors.Wrap(ErrInvalidToken, err.Error())
+	}
+
+	if err := v.checkClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (v *Verifier) checkClaims(claims *Claims, now time.Time) error {
+	if claims.ExpiresAt == 0 {
+		return errors.Wrap(ErrInvalidToken, "exp claim is missing")
+	}
+
+	if now.Add(-v.Leeway).Unix() >= claims.ExpiresAt {
+		return errors.Wrapf(ErrExpiredToken, "expired at %s", time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	}
+
+	if claims.NotBefore != 0 && now.Add(v.Leeway).Unix() < claims.NotBefore {
+		return errors.Wrap(ErrInvalidToken, "token isn't valid yet")
+	}
+
+	if claims.IssuedAt != 0 && now.Add(v.Leeway).Unix() < claims.IssuedAt {
+		return errors.Wrap(ErrInvalidToken, "token is issued in the future")
+	}
+
+	if v.Issuer != "" && claims.Issuer != v.Issuer {
+		return errors.Wrapf(ErrInvalidToken, "issuer %q isn't %q", claims.Issuer, v.Issuer)
+	}
+
+	if v.Audience != "" && !slices.Contains(claims.Audience, v.Audience) {
+		return errors.Wrapf(ErrInvalidToken, "audience %q isn't among %q", v.Audience, claims.Audience)
+	}
+
+	return nil
+}
+
+// keyMatches tells whether the key is of the type of the algorithm, so that a public key can't be used as an HMAC
+// secret, or a key meant for another curve.
+func keyMatches(alg string, key interface{}) bool {
+	switch alg {
+	case "HS256", "HS384", "HS512":
+		_, ok := key.([]byte)
+
+		return ok
+	case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+		_, ok := key.(*rsa.PublicKey)
+
+		return ok
+	case "ES256", "ES384", "ES512":
+		k, ok := key.(*ecdsa.PublicKey)
+
+		return ok && "ES"+curveSizes[k.Curve.Params().Name] == alg
+	case "EdDSA":
+		_, ok := key.(ed25519.PublicKey)
+
+		return ok
+	default:
+		return false
+	}
+}
+
+// curveSizes are the hash sizes of the ES* algorithms by curve.
+var curveSizes = map[string]string{
+	"P-256": "256",
+	"P-384": "384",
+	"P-521": "512",
+}
+
+// Middleware verifies the bearer token of the requests and puts its claims in the request context, see ClaimsFromContext.
+//
+// Requests without a valid token are rejected with 401 Unauthorized (RFC 6750 section 3).
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := v.Verify(r.Context(), BearerToken(r))
+		if err != nil {
+			Unauthorized(w, err)
+
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), claims)))
+	})
+}
+
+// BearerToken returns the bearer token of the Authorization header of the request, empty if there is none.
+func BearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+
+	return strings.TrimSpace(token)
+}
+
+// Unauthorized responds 401 Unauthorized to a request whose token failed verification with err.
+func Unauthorized(w http.ResponseWriter, err error) {
+	// a request without token gets no error code, see RFC 6750 section 3.1
+	challenge := "Bearer"
+	body := map[string]string{"error": "invalid_token", "error_description": err.Error()}
+
+	if errors.Is(err, ErrMissingToken) {
+		body = map[string]string{"error": "invalid_request", "error_description": err.Error()}
+	} else {
+		challenge += ` error="invalid_token"`
+	}
+
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+type claimsKey struct{}
+
+// WithClaims returns a copy of ctx carrying the claims of a verified token.
+func WithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// ClaimsFromContext returns the claims of the token verified by Middleware.
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*Claims)
+
+	return claims, ok
+}
@@ -0,0 +1,193 @@
+package resource
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+
+	"github.com/laonix/oauth2/internal/keys"
+)
+
+func TestVerifier(t *testing.T) {
+	const issuer = "http://localhost:3000"
+
+	signingKey, keyID := newTestKey(t)
+	otherKey, _ := newTestKey(t)
+
+	publicKeyPEM, err := keys.EncodePublicKeyPEM(signingKey.Public())
+	if err != nil {
+		t.Fatalf("could not encode public key: %v\n", err)
+	}
+
+	sign := func(method jwt.SigningMethod, kid string, key interface{}, claims *Claims) string {
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = kid
+
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("could not sign token: %v\n", err)
+		}
+
+		return signed
+	}
+
+	tests := []struct {
+		name                 string
+		token                func(claims *Claims) string
+		prepareClaims        func(claims *Claims)
+		audience             string
+		leeway               time.Duration
+		expectedErr          error
+		expectedJWKSRequests int
+	}{
+		{
+			name: "Valid token",
+			token: func(claims *Claims) string {
+				return sign(jwt.SigningMethodRS256, keyID, signingKey, claims)
+			},
+			prepareClaims:        func(claims *Claims) {},
+			expectedJWKSRequests: 1,
+		},
+		{
+			name: "Missing token",
+			token: func(claims *Claims) string {
+				return ""
+			},
+			prepareClaims:        func(claims *Claims) {},
+			expectedErr:          ErrMissingToken,
+			expectedJWKSRequests: 1,
+		},
+		{
+			name: "Wrong issuer",
+			token: func(claims *Claims) string {
+				return sign(jwt.SigningMethodRS256, keyID, signingKey, claims)
+			},
+			prepareClaims: func(claims *Claims) {
+				claims.Issuer = "http://evil.example"
+			},
+			expectedErr:          ErrInvalidToken,
+			expectedJWKSRequests: 1,
+		},
+		{
+			name: "Wrong audience",
+			token: func(claims *Claims) string {
+				return sign(jwt.SigningMethodRS256, keyID, signingKey, claims)
+			},
+			prepareClaims:        func(claims *Claims) {},
+			audience:             "inventory",
+			expectedErr:          ErrInvalidToken,
+			expectedJWKSRequests: 1,
+		},
+		{
+			name: "Expired token",
+			token: func(claims *Claims) string {
+				return sign(jwt.SigningMethodRS256, keyID, signingKey, claims)
+			},
+			prepareClaims: func(claims *Claims) {
+				claims.ExpiresAt = time.Now().Add(-10 * time.Second).Unix()
+			},
+			expectedErr:          ErrExpiredToken,
+			expectedJWKSRequests: 1,
+		},
+		{
+			name: "Expired token within the leeway",
+			token: func(claims *Claims) string {
+				return sign(jwt.SigningMethodRS256, keyID, signingKey, claims)
+			},
+			prepareClaims: func(claims *Claims) {
+				claims.ExpiresAt = time.Now().Add(-10 * time.Second).Unix()
+			},
+			leeway:               time.Minute,
+			expectedJWKSRequests: 1,
+		},
+		{
+			name: "Unknown key is fetched again",
+			token: func(claims *Claims) string {
+				return sign(jwt.SigningMethodRS256, "unknown", otherKey, claims)
+			},
+			prepareClaims: func(claims *Claims) {},
+			expectedErr:   ErrInvalidToken,
+			// the initial fetch, then one by each of the middleware and Verify
+			expectedJWKSRequests: 3,
+		},
+		{
+			name: "Public key used as HMAC secret",
+			token: func(claims *Claims) string {
+				return sign(jwt.SigningMethodHS256, keyID, publicKeyPEM, claims)
+			},
+			prepareClaims:        func(claims *Claims) {},
+			expectedErr:          ErrInvalidToken,
+			expectedJWKSRequests: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &jwksServer{}
+			server.set(false, signingKey)
+
+			srv := httptest.NewServer(server)
+			defer srv.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			jwks, err := NewJWKS(ctx, JWKSConfig{
+				URL:                srv.URL,
+				MinRefetchInterval: time.Nanosecond,
+			})
+			if err != nil {
+				t.Fatalf("could not fetch JWKS: %v\n", err)
+			}
+
+			verifier := &Verifier{
+				Keys:     jwks,
+				Issuer:   issuer,
+				Audience: tt.audience,
+				Leeway:   tt.leeway,
+			}
+
+			claims := &Claims{
+				Issuer:    issuer,
+				Subject:   "client_id",
+				Audience:  Audience{"client_id"},
+				ExpiresAt: time.Now().Add(time.Minute).Unix(),
+				IssuedAt:  time.Now().Unix(),
+			}
+			tt.prepareClaims(claims)
+
+			var gotClaims *Claims
+			resourceServer := verifier.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotClaims, _ = ClaimsFromContext(r.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+			if token := tt.token(claims); token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+			resourceServer.ServeHTTP(w, req)
+
+			_, err = verifier.Verify(ctx, BearerToken(req))
+			if !errors.Is(err, tt.expectedErr) {
+				t.Errorf("got error %v but wanted %v\n", err, tt.expectedErr)
+			}
+
+			if tt.expectedErr == nil {
+				if w.Code != http.StatusOK || gotClaims == nil || gotClaims.Subject != "client_id" {
+					t.Errorf("got status %d and claims %+v but wanted the claims of the token\n", w.Code, gotClaims)
+				}
+			} else if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("got status %d but wanted %d with a challenge\n", w.Code, http.StatusUnauthorized)
+			}
+
+			if got := server.requests.Load(); got != int64(tt.expectedJWKSRequests) {
+				t.Errorf("got %d JWKS requests but wanted %d\n", got, tt.expectedJWKSRequests)
+			}
+		})
+	}
+}